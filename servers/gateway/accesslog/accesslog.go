@@ -0,0 +1,232 @@
+// Package accesslog records every request a server handles
+// as a line of JSON, tagged with a request ID
+// that is passed on from the gateway to the microservices,
+// so that the logs of one request can be matched across all of them.
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// HeaderRequestID is the header request IDs are passed on in.
+const HeaderRequestID = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from clients.
+// Anything else is replaced, so that clients can't inject junk into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Entry is the access log entry of a request.
+// Handlers down the chain can add what they know about the request
+// to the Entry returned by FromContext.
+type Entry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"requestID"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Status        int       `json:"status"`
+	Bytes         int64     `json:"bytes"`
+	LatencyMillis float64   `json:"latencyMillis"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	// UserID is the ID of the authenticated user, if any.
+	UserID string `json:"userID,omitempty"`
+	// Service is the microservice the request was forwarded to, if any.
+	Service string `json:"service,omitempty"`
+	// Instance is the address of the instance that answered the request.
+	Instance string `json:"instance,omitempty"`
+	// Attempts is the number of instances the request was sent to.
+	Attempts int `json:"attempts,omitempty"`
+	// TraceID is the ID of the trace of the request, if it is traced.
+	TraceID string `json:"traceID,omitempty"`
+}
+
+// Logger writes access log entries as lines of JSON.
+// It is safe for concurrent use.
+type Logger struct {
+	out io.Writer
+	mx  sync.Mutex
+}
+
+// NewLogger constructs a new Logger writing to out.
+func NewLogger(out io.Writer) *Logger {
+	if out == nil {
+		panic("nil access log writer")
+	}
+	return &Logger{out: out}
+}
+
+// Log writes entry to the log.
+func (logger *Logger) Log(entry *Entry) {
+	j, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("error marshalling access log entry: %v", err)
+		return
+	}
+	logger.mx.Lock()
+	defer logger.mx.Unlock()
+	logger.out.Write(append(j, '\n'))
+}
+
+// contextKey is the type of keys of values
+// this package puts in request contexts.
+type contextKey string
+
+// entryKey is the context key of the Entry of a request.
+const entryKey = contextKey("entry")
+
+// FromContext returns the Entry of the request ctx belongs to.
+// If the request is not logged, it returns an Entry that is logged nowhere,
+// so that callers don't need to check.
+// Entries are not safe for concurrent use,
+// so only the goroutine serving the request may change them.
+func FromContext(ctx context.Context) *Entry {
+	if entry, ok := ctx.Value(entryKey).(*Entry); ok {
+		return entry
+	}
+	return &Entry{}
+}
+
+// WithEntry returns a copy of ctx in which entry is the Entry of the request,
+// so that work done on behalf of a request
+// can be recorded apart from the request's own Entry.
+func WithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, entryKey, entry)
+}
+
+// NewRequestID generates a new random request ID.
+func NewRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		// Still tell requests apart in the unlikely event
+		// that the system runs out of randomness.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Handler is a middleware handler that logs every request
+// it passes on to the wrapped handler.
+type Handler struct {
+	handler http.Handler
+	logger  *Logger
+}
+
+// NewHandler wraps another handler into Handler, logging to logger.
+func NewHandler(handlerToWrap http.Handler, logger *Logger) *Handler {
+	if logger == nil {
+		panic("nil access logger")
+	}
+	return &Handler{handlerToWrap, logger}
+}
+
+// ServeHTTP implements the http.Handler interface for the Handler.
+// Requests keep the valid request ID they came with, or get a new one,
+// which is set on both the request, to be passed on, and the response.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(HeaderRequestID)
+	if !validRequestID.MatchString(requestID) {
+		requestID = NewRequestID()
+		r.Header.Set(HeaderRequestID, requestID)
+	}
+	w.Header().Set(HeaderRequestID, requestID)
+
+	entry := &Entry{
+		Time:       time.Now(),
+		RequestID:  requestID,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+	}
+	recorder := NewResponseRecorder(w)
+	h.handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), entryKey, entry)))
+
+	entry.Status = recorder.Status()
+	entry.Bytes = recorder.Bytes()
+	entry.LatencyMillis = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+	h.logger.Log(entry)
+}
+
+// ResponseRecorder records the status code and size of a response
+// as it is written, for logs and metrics.
+// It can be hijacked and flushed if the ResponseWriter it wraps can.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// NewResponseRecorder wraps w into a ResponseRecorder.
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+// Status returns the status code of the response.
+// Responses written without a status code are 200 OK.
+func (rec *ResponseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Bytes returns the size of the response body written so far.
+func (rec *ResponseRecorder) Bytes() int64 {
+	return rec.bytes
+}
+
+// WriteHeader records the status code and writes it.
+func (rec *ResponseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the body and writes it.
+func (rec *ResponseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the response, if the wrapped ResponseWriter can,
+// so that proxied streams are not held back.
+func (rec *ResponseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection.
+// Hijacked connections are logged as switching protocols.
+func (rec *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped ResponseWriter,
+// for http.ResponseController.
+func (rec *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
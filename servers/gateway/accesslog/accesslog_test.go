@@ -0,0 +1,92 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	cases := []struct {
+		name              string
+		requestID         string
+		expectedRequestID string
+	}{
+		{
+			"No Request ID",
+			"",
+			"",
+		},
+		{
+			"Valid Request ID",
+			"0af7651916cd43dd8448eb211c80319c",
+			"0af7651916cd43dd8448eb211c80319c",
+		},
+		{
+			"Invalid Request ID",
+			"bad id\n{\"status\":200}",
+			"",
+		},
+		{
+			"Too Long Request ID",
+			strings.Repeat("a", 129),
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		var forwarded string
+		handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded = r.Header.Get(HeaderRequestID)
+			entry := FromContext(r.Context())
+			entry.Service = "test"
+			entry.UserID = "1234"
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+		}), NewLogger(buf))
+
+		r := httptest.NewRequest("POST", "/v1/test", nil)
+		if len(c.requestID) != 0 {
+			r.Header.Set(HeaderRequestID, c.requestID)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+
+		requestID := resp.Header().Get(HeaderRequestID)
+		if len(c.expectedRequestID) != 0 && requestID != c.expectedRequestID {
+			t.Errorf("case %s: incorrect request ID: expected %s but got %s", c.name, c.expectedRequestID, requestID)
+		}
+		if len(c.expectedRequestID) == 0 && (len(requestID) != 32 || requestID == c.requestID) {
+			t.Errorf("case %s: expected a new request ID but got %q", c.name, requestID)
+		}
+		if forwarded != requestID {
+			t.Errorf("case %s: request ID not set on the request: expected %s but got %s", c.name, requestID, forwarded)
+		}
+
+		entry := &Entry{}
+		if err := json.Unmarshal(buf.Bytes(), entry); err != nil {
+			t.Errorf("case %s: error unmarshalling log entry %q: %v", c.name, buf.String(), err)
+			continue
+		}
+		if strings.Count(buf.String(), "\n") != 1 {
+			t.Errorf("case %s: expected one line in the log but got %q", c.name, buf.String())
+		}
+		if entry.RequestID != requestID || entry.Method != "POST" || entry.Path != "/v1/test" ||
+			entry.Status != http.StatusCreated || entry.Bytes != 5 ||
+			entry.Service != "test" || entry.UserID != "1234" || entry.LatencyMillis < 0 {
+			t.Errorf("case %s: incorrect log entry: %s", c.name, buf.String())
+		}
+	}
+}
+
+func TestFromContextWithoutEntry(t *testing.T) {
+	// Handlers can annotate requests that are not logged.
+	r := httptest.NewRequest("GET", "/", nil)
+	if entry := FromContext(r.Context()); entry == nil {
+		t.Errorf("expected an entry but got nil")
+	}
+}
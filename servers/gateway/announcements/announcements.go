@@ -0,0 +1,86 @@
+package announcements
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MaxAge is how old an announcement may be before it is rejected,
+// so that a captured announcement can't be replayed
+// to keep a dead instance registered.
+// Microservices announce themselves every few seconds,
+// so this only needs to leave room for clock skew.
+const MaxAge = time.Minute
+
+// ErrInvalidSignature is returned from Verify when an announcement
+// was not signed with the registration key.
+var ErrInvalidSignature = errors.New("invalid announcement signature")
+
+// ErrExpired is returned from Verify when an announcement is too old,
+// or claims to come from the future.
+var ErrExpired = errors.New("announcement expired")
+
+// Announcement is what microservices publish to the Redis "microservices" channel.
+// Service is signed along with Timestamp with HMAC-SHA256,
+// using the registration key shared by the gateway and the microservices.
+type Announcement struct {
+	Service   json.RawMessage `json:"service"`
+	Timestamp int64           `json:"timestamp"`
+	// Signature is the hex-encoded HMAC-SHA256 of
+	// the Timestamp in decimal, a ".", and the Service JSON.
+	Signature string `json:"signature"`
+}
+
+// Sign marshals service into a signed Announcement, ready to be published.
+func Sign(service interface{}, key string) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("registration key has length of zero")
+	}
+	svcJSON, err := json.Marshal(service)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling service: %v", err)
+	}
+	timestamp := time.Now().Unix()
+	return json.Marshal(&Announcement{
+		Service:   svcJSON,
+		Timestamp: timestamp,
+		Signature: hex.EncodeToString(signature(svcJSON, timestamp, key)),
+	})
+}
+
+// Verify checks that msg is an Announcement signed with key
+// no longer than MaxAge ago, and returns the JSON of the announced service.
+func Verify(msg []byte, key string) (json.RawMessage, error) {
+	announcement := &Announcement{}
+	if err := json.Unmarshal(msg, announcement); err != nil {
+		return nil, fmt.Errorf("error unmarshaling announcement: %v", err)
+	}
+	sig, err := hex.DecodeString(announcement.Signature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	// Compare in constant time, so that the time it takes
+	// doesn't tell a forger how much of the signature is right.
+	if !hmac.Equal(sig, signature(announcement.Service, announcement.Timestamp, key)) {
+		return nil, ErrInvalidSignature
+	}
+	age := time.Since(time.Unix(announcement.Timestamp, 0))
+	if age > MaxAge || age < -MaxAge {
+		return nil, ErrExpired
+	}
+	return announcement.Service, nil
+}
+
+// signature computes the signature of the service JSON and timestamp.
+func signature(svcJSON []byte, timestamp int64, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(svcJSON)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package announcements
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	key := "registration key"
+	service := map[string]string{"Name": "summary"}
+	signed, err := Sign(service, key)
+	if err != nil {
+		t.Fatalf("error signing announcement: %v", err)
+	}
+
+	// expired is a correctly signed announcement from long ago.
+	old := time.Now().Add(-MaxAge * 2).Unix()
+	expired, _ := json.Marshal(&Announcement{
+		Service:   json.RawMessage(`{"Name":"summary"}`),
+		Timestamp: old,
+		Signature: hex.EncodeToString(signature([]byte(`{"Name":"summary"}`), old, key)),
+	})
+
+	// tampered claims another service with the original signature.
+	announcement := &Announcement{}
+	json.Unmarshal(signed, announcement)
+	announcement.Service = json.RawMessage(`{"Name":"evil"}`)
+	tampered, _ := json.Marshal(announcement)
+
+	cases := []struct {
+		name        string
+		msg         []byte
+		key         string
+		expectedErr error
+	}{
+		{
+			"Valid Announcement",
+			signed,
+			key,
+			nil,
+		},
+		{
+			"Wrong Key",
+			signed,
+			"another key",
+			ErrInvalidSignature,
+		},
+		{
+			"Tampered Service",
+			tampered,
+			key,
+			ErrInvalidSignature,
+		},
+		{
+			"Unsigned Service",
+			[]byte(`{"service":{"Name":"summary"}}`),
+			key,
+			ErrInvalidSignature,
+		},
+		{
+			"Expired Announcement",
+			expired,
+			key,
+			ErrExpired,
+		},
+	}
+
+	for _, c := range cases {
+		svcJSON, err := Verify(c.msg, c.key)
+		if err != c.expectedErr {
+			t.Errorf("case %s: expected error %v but got %v", c.name, c.expectedErr, err)
+			continue
+		}
+		if err == nil && string(svcJSON) != `{"Name":"summary"}` {
+			t.Errorf("case %s: incorrect service JSON: %s", c.name, svcJSON)
+		}
+	}
+
+	if _, err := Verify([]byte("not JSON"), key); err == nil {
+		t.Errorf("expected an error verifying invalid JSON")
+	}
+}
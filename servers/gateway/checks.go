@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/health"
+	"gopkg.in/mgo.v2"
+	"sync"
+	"time"
+)
+
+// redisCheck checks that the Redis server of client answers pings.
+func redisCheck(client *redis.Client) health.Check {
+	return func(ctx context.Context) error {
+		return client.WithContext(ctx).Ping().Err()
+	}
+}
+
+// mongoCheck checks that the MongoDB session answers pings.
+// It pings the session itself rather than a copy,
+// since a session that died keeps failing until it is refreshed.
+func mongoCheck(session *mgo.Session) health.Check {
+	return sharedPingCheck(session.Ping)
+}
+
+// pendingPing is a ping that is done once err is set and done is closed.
+type pendingPing struct {
+	done chan struct{}
+	err  error
+}
+
+// sharedPingCheck checks that ping succeeds.
+// For pings that can't be canceled, such as mgo's,
+// which only time out along with the session's socket,
+// checks made while a ping is in flight wait for that ping,
+// rather than each leaving another one behind when they give up.
+func sharedPingCheck(ping func() error) health.Check {
+	mx := sync.Mutex{}
+	var pending *pendingPing
+	return func(ctx context.Context) error {
+		mx.Lock()
+		p := pending
+		if p == nil {
+			p = &pendingPing{done: make(chan struct{})}
+			pending = p
+			go func() {
+				p.err = ping()
+				mx.Lock()
+				pending = nil
+				mx.Unlock()
+				close(p.done)
+			}()
+		}
+		mx.Unlock()
+
+		select {
+		case <-p.done:
+			return p.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// busCheck checks that the event bus reporting its status through reporter
+// is connected, so that its consumers get messages.
+func busCheck(reporter eventbus.StatusReporter) health.Check {
+	return func(ctx context.Context) error {
+		status := reporter.Status()
+		if !status.Connected {
+			if len(status.LastError) != 0 {
+				return fmt.Errorf("disconnected since %s: %s", status.Since.Format(time.RFC3339), status.LastError)
+			}
+			return fmt.Errorf("disconnected since %s", status.Since.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
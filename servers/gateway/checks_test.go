@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+)
+
+// fakeStatusReporter reports a fixed status.
+type fakeStatusReporter struct {
+	status *eventbus.Status
+}
+
+func (f *fakeStatusReporter) Status() *eventbus.Status {
+	return f.status
+}
+
+/*
+TestRedisCheck needs a redis server running on its default
+port (6379), or at the address in the REDISADDR environment variable.
+*/
+func TestRedisCheck(t *testing.T) {
+	redisaddr := os.Getenv("REDISADDR")
+	if len(redisaddr) == 0 {
+		redisaddr = "127.0.0.1:6379"
+	}
+
+	up := redis.NewClient(&redis.Options{Addr: redisaddr})
+	if err := redisCheck(up)(context.Background()); err != nil {
+		t.Errorf("expected Redis at %s to be up but got: %v", redisaddr, err)
+	}
+
+	// Nothing listens on port 1.
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: 0})
+	if err := redisCheck(down)(context.Background()); err == nil {
+		t.Errorf("expected an error for an unreachable Redis server")
+	}
+}
+
+func TestSharedPingCheck(t *testing.T) {
+	// A ping that hangs until released.
+	var pings int32
+	release := make(chan struct{})
+	check := sharedPingCheck(func() error {
+		atomic.AddInt32(&pings, 1)
+		<-release
+		return errors.New("server went away")
+	})
+
+	// Checks give up once their context is done,
+	// without starting another ping while one is in flight.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		if err := check(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected check to time out but got %v", err)
+		}
+		cancel()
+	}
+	if n := atomic.LoadInt32(&pings); n != 1 {
+		t.Errorf("expected 1 ping in flight but got %d", n)
+	}
+
+	// A check waiting for the ping gets its result.
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		close(release)
+	}()
+	if err := check(context.Background()); err == nil || err.Error() != "server went away" {
+		t.Errorf("expected the result of the ping but got %v", err)
+	}
+	// Once it is done, the next check pings again.
+	check(context.Background())
+	if n := atomic.LoadInt32(&pings); n != 2 {
+		t.Errorf("expected a new ping once the last one was done but got %d pings", n)
+	}
+}
+
+func TestBusCheck(t *testing.T) {
+	connected := &fakeStatusReporter{&eventbus.Status{Connected: true}}
+	if err := busCheck(connected)(context.Background()); err != nil {
+		t.Errorf("expected connected bus to be ok but got %v", err)
+	}
+	disconnected := &fakeStatusReporter{&eventbus.Status{Connected: false, LastError: "connection reset"}}
+	if err := busCheck(disconnected)(context.Background()); err == nil {
+		t.Errorf("expected an error for a disconnected bus")
+	}
+}
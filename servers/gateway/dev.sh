@@ -7,6 +7,9 @@ export TLSCERT="/c/Users/Zico Deng/Desktop/go/src/github.com/info344-a17/challen
 export TLSKEY="/c/Users/Zico Deng/Desktop/go/src/github.com/info344-a17/challenges-zicodeng/tls/privkey.pem"
 
 export SESSIONKEY="secret signing key"
+export REGISTRATIONKEY="secret registration key"
+export IDENTITYKEY="secret identity key"
+export SERVICEALLOWLIST="messaging=/v1/channels,/v1/messages;summary=/v1/summary"
 
 export REDISADDR=192.168.99.100:6379
 export MQADDR=192.168.99.100:5672
@@ -17,6 +20,12 @@ export REDIS_CONTAINER=redis-server
 export MONGO_CONTAINER=mongo-server
 export MQ_CONTAINER=rabbitmq-server
 
+export ADMINKEY="secret admin key"
+export METRICSKEY="secret metrics key"
+export RATELIMITS="default=300/m,50;/v1/users=60/m,10;/v1/resetcodes=5/m,2;service:summary=60/m,10"
+# Write spans to a file rather than a collector.
+export TRACEEXPORTER="file:gateway-spans.json"
+
 export MESSAGESVCADDR=localhost:4000
 export SUMMARYSVCADDR=localhost:5000
 
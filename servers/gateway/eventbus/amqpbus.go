@@ -0,0 +1,390 @@
+package eventbus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned from AMQPBus.Publish
+// when the AMQPBus is not connected to the MQ server.
+var ErrNotConnected = errors.New("not connected to MQ server")
+
+// minBackoff and maxBackoff bound how long the AMQPBus waits
+// before reconnecting to the MQ server.
+const minBackoff = time.Second
+const maxBackoff = time.Second * 30
+
+// AMQPConfig configures an AMQPBus.
+type AMQPConfig struct {
+	// Addr is the address of the MQ server.
+	Addr string
+	// Durable makes exchanges and group queues survive MQ server restarts.
+	// It must match how anyone else declares the same exchanges and queues,
+	// or the MQ server refuses the declaration.
+	Durable bool
+}
+
+// Status reports the state of the connection to a broker.
+type Status struct {
+	Connected bool `json:"connected"`
+	// Since is when the Bus last connected or disconnected.
+	Since time.Time `json:"since"`
+	// Reconnects is how many times the Bus has
+	// connected again after losing its connection.
+	Reconnects int    `json:"reconnects"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// AMQPBus is a Bus backed by a RabbitMQ server.
+// Every topic is a fanout exchange.
+// Subscriptions without a group get their own exclusive queue bound to it,
+// while each group is a queue named after the group,
+// so that microservices may also send to it directly.
+// The AMQPBus watches its connection, and reconnects with backoff
+// whenever it drops, declaring everything its Subscriptions need again.
+// Losing any of its channels, which the MQ server closes
+// after errors such as a failed declaration or a deleted queue,
+// makes it reconnect too, so that nothing stops silently.
+type AMQPBus struct {
+	config *AMQPConfig
+	// Everything below is protected by mx.
+	conn  *amqp.Connection
+	pubCh *amqp.Channel
+	// lost receives why a channel of the current connection was lost.
+	lost chan error
+	// exchanges holds the exchanges declared on the current connection.
+	exchanges     map[string]bool
+	subs          map[*Subscription]bool
+	status        *Status
+	everConnected bool
+	closed        bool
+	mx            sync.Mutex
+	// done is closed once the AMQPBus is closed.
+	done chan struct{}
+}
+
+// NewAMQPBus constructs a new AMQPBus,
+// and starts connecting to the MQ server in the background.
+func NewAMQPBus(config *AMQPConfig) *AMQPBus {
+	if config == nil || len(config.Addr) == 0 {
+		panic("no MQ address found")
+	}
+	b := &AMQPBus{
+		config:    config,
+		exchanges: make(map[string]bool),
+		subs:      make(map[*Subscription]bool),
+		status:    &Status{Since: time.Now()},
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Publish publishes body to the exchange named topic.
+func (b *AMQPBus) Publish(topic string, body []byte) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if b.pubCh == nil {
+		return ErrNotConnected
+	}
+	if !b.exchanges[topic] {
+		if err := b.declareExchange(b.pubCh, topic); err != nil {
+			return err
+		}
+	}
+	return b.pubCh.Publish(topic, "", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
+
+// Subscribe subscribes to topic.
+// If the AMQPBus is not connected at the moment,
+// the Subscription starts receiving messages once it is.
+func (b *AMQPBus) Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	var sub *Subscription
+	sub = newSubscription(topic, opts, func() {
+		b.mx.Lock()
+		delete(b.subs, sub)
+		b.mx.Unlock()
+	})
+	if b.conn != nil {
+		if err := b.consume(b.conn, b.lost, sub); err != nil {
+			return nil, err
+		}
+	}
+	b.subs[sub] = true
+	return sub, nil
+}
+
+// Close closes the AMQPBus and all of its Subscriptions,
+// and disconnects from the MQ server.
+func (b *AMQPBus) Close() error {
+	b.mx.Lock()
+	if b.closed {
+		b.mx.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	subs := []*Subscription{}
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mx.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	return nil
+}
+
+// Status returns a copy of the current Status of the AMQPBus.
+func (b *AMQPBus) Status() *Status {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	status := *b.status
+	return &status
+}
+
+// run connects to the MQ server,
+// and reconnects whenever the connection drops, until the AMQPBus is closed.
+func (b *AMQPBus) run() {
+	backoff := minBackoff
+	for {
+		connected, err := b.connect()
+		b.setDisconnected(err)
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		// Start over with a short wait if we had managed to connect,
+		// since the MQ server is probably just restarting.
+		if connected {
+			backoff = minBackoff
+		}
+		log.Printf("disconnected from MQ server: %v", err)
+		log.Printf("will attempt another connection in %v", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// connect connects to the MQ server,
+// sets up all Subscriptions on the new connection,
+// and blocks until the connection is lost or the AMQPBus is closed.
+// It reports whether it managed to connect.
+func (b *AMQPBus) connect() (bool, error) {
+	conn, err := amqp.Dial("amqp://" + b.config.Addr)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to MQ server: %v", err)
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	// Use a separate channel to publish,
+	// so that publishing never competes with consuming.
+	pubCh, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("error opening channel: %v", err)
+	}
+	pubClosed := pubCh.NotifyClose(make(chan *amqp.Error, 1))
+	lost := make(chan error, 1)
+
+	if err := b.setConnected(conn, pubCh, lost); err != nil {
+		return false, err
+	}
+	log.Printf("connected to MQ server")
+
+	// Channels can't be used again once the MQ server closes them,
+	// so start over with a new connection whenever one is lost.
+	select {
+	case amqpErr := <-closed:
+		if amqpErr == nil {
+			return true, errors.New("connection closed")
+		}
+		return true, amqpErr
+	case amqpErr := <-pubClosed:
+		return true, fmt.Errorf("publishing channel closed: %v", amqpErr)
+	case err := <-lost:
+		return true, err
+	case <-b.done:
+		return true, ErrClosed
+	}
+}
+
+// consume declares what sub needs on conn,
+// and delivers the messages received there to sub
+// until either sub or the channel is closed.
+// If the channel closes first, why is sent to lost.
+// Callers must hold b.mx.
+func (b *AMQPBus) consume(conn *amqp.Connection, lost chan error, sub *Subscription) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("error opening channel: %v", err)
+	}
+	if err := b.declareExchange(ch, sub.Topic); err != nil {
+		ch.Close()
+		return err
+	}
+
+	var q amqp.Queue
+	if len(sub.group) == 0 {
+		// Let the server name the queue,
+		// and delete it as soon as the Subscription goes away.
+		q, err = ch.QueueDeclare("", false, true, true, false, nil)
+	} else {
+		q, err = ch.QueueDeclare(sub.group, b.config.Durable, false, false, false, nil)
+	}
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("error declaring queue: %v", err)
+	}
+	if err := ch.QueueBind(q.Name, "", sub.Topic, false, nil); err != nil {
+		ch.Close()
+		return fmt.Errorf("error binding queue %s to exchange %s: %v", q.Name, sub.Topic, err)
+	}
+
+	exclusive := len(sub.group) == 0
+	deliveries, err := ch.Consume(q.Name, "", !sub.manualAck, exclusive, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("error listening to queue %s: %v", q.Name, err)
+	}
+
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	go func() {
+		// Closing the channel cancels the consumer,
+		// and hands unacknowledged messages back to the queue.
+		defer ch.Close()
+		for {
+			select {
+			case d, ok := <-deliveries:
+				if !ok {
+					// Either the channel was closed,
+					// or the MQ server cancelled the consumer,
+					// such as when the queue was deleted.
+					reason := "consumer cancelled"
+					select {
+					case amqpErr := <-chClosed:
+						if amqpErr != nil {
+							reason = amqpErr.Error()
+						}
+					default:
+					}
+					// Only one reason is needed,
+					// and the connection may already be gone anyway.
+					select {
+					case lost <- fmt.Errorf("stopped consuming from queue %s: %s", q.Name, reason):
+					default:
+					}
+					return
+				}
+				if !sub.deliver(newAMQPMessage(sub, d)) {
+					return
+				}
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// declareExchange declares the fanout exchange named topic.
+// Callers must hold b.mx.
+func (b *AMQPBus) declareExchange(ch *amqp.Channel, topic string) error {
+	err := ch.ExchangeDeclare(topic, amqp.ExchangeFanout, b.config.Durable, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring exchange %s: %v", topic, err)
+	}
+	b.exchanges[topic] = true
+	return nil
+}
+
+// newAMQPMessage constructs a new Message from a delivery.
+func newAMQPMessage(sub *Subscription, d amqp.Delivery) *Message {
+	msg := &Message{Topic: sub.Topic, Body: d.Body}
+	if !sub.manualAck {
+		return msg
+	}
+	msg.ack = func() error {
+		return d.Ack(false)
+	}
+	msg.nack = func(requeue bool) error {
+		return d.Nack(false, requeue)
+	}
+	return msg
+}
+
+// setConnected sets up all Subscriptions on conn,
+// and publishes through pubCh from now on.
+// The channels lost from then on are reported to lost.
+func (b *AMQPBus) setConnected(conn *amqp.Connection, pubCh *amqp.Channel, lost chan error) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.exchanges = make(map[string]bool)
+	for sub := range b.subs {
+		if err := b.consume(conn, lost, sub); err != nil {
+			return err
+		}
+	}
+	// Having been connected before means this is a reconnection.
+	if b.everConnected {
+		b.status.Reconnects++
+	}
+	b.everConnected = true
+	b.conn = conn
+	b.pubCh = pubCh
+	b.lost = lost
+	b.status.Connected = true
+	b.status.Since = time.Now()
+	return nil
+}
+
+// setDisconnected records that the AMQPBus lost its connection because of err.
+func (b *AMQPBus) setDisconnected(err error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.conn = nil
+	b.pubCh = nil
+	b.lost = nil
+	if b.status.Connected {
+		b.status.Since = time.Now()
+	}
+	b.status.Connected = false
+	if err != nil {
+		b.status.LastError = err.Error()
+	}
+}
+
+// nextBackoff doubles the backoff, up to maxBackoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
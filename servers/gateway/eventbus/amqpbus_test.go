@@ -0,0 +1,79 @@
+package eventbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		backoff  time.Duration
+		expected time.Duration
+	}{
+		{
+			"Doubles",
+			minBackoff,
+			minBackoff * 2,
+		},
+		{
+			"Capped",
+			maxBackoff / 2 * 3,
+			maxBackoff,
+		},
+		{
+			"Stays At Max",
+			maxBackoff,
+			maxBackoff,
+		},
+	}
+
+	for _, c := range cases {
+		if got := nextBackoff(c.backoff); got != c.expected {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestAMQPBusStatus(t *testing.T) {
+	// Nothing listens on port 1, so the bus never connects.
+	bus := NewAMQPBus(&AMQPConfig{Addr: "127.0.0.1:1"})
+	defer bus.Close()
+	if bus.Status().Connected {
+		t.Errorf("expected a new bus to be disconnected")
+	}
+	if err := bus.Publish("events", []byte(`{}`)); err != ErrNotConnected {
+		t.Errorf("expected ErrNotConnected when publishing while disconnected but got %v", err)
+	}
+	// Subscribing while disconnected waits for the connection.
+	if _, err := bus.Subscribe("events", nil); err != nil {
+		t.Errorf("error subscribing while disconnected: %v", err)
+	}
+
+	// A bus without a running connection loop.
+	idle := &AMQPBus{
+		config: &AMQPConfig{},
+		subs:   make(map[*Subscription]bool),
+		status: &Status{},
+	}
+	idle.setConnected(nil, nil, nil)
+	idle.setDisconnected(errors.New("connection reset"))
+	idle.setConnected(nil, nil, nil)
+	status := idle.Status()
+	if !status.Connected {
+		t.Errorf("expected bus to be connected")
+	}
+	if status.Reconnects != 1 {
+		t.Errorf("expected 1 reconnect but got %d", status.Reconnects)
+	}
+	if status.LastError != "connection reset" {
+		t.Errorf("incorrect last error: %s", status.LastError)
+	}
+
+	// Changing the returned Status must not change the bus's.
+	status.Connected = false
+	if !idle.Status().Connected {
+		t.Errorf("expected Status to return a copy")
+	}
+}
@@ -0,0 +1,143 @@
+package eventbus
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when using a Bus that has been closed.
+var ErrClosed = errors.New("event bus is closed")
+
+// subscriptionQueueSize is how many messages a Subscription
+// buffers before its Bus has to wait for them to be read.
+const subscriptionQueueSize = 256
+
+// Bus publishes messages to topics,
+// and delivers them to the subscribers of those topics.
+type Bus interface {
+	// Publish publishes body to topic.
+	Publish(topic string, body []byte) error
+
+	// Subscribe subscribes to topic.
+	// opts may be nil, in which case every message
+	// published to topic is delivered to the Subscription,
+	// and acknowledged as soon as it is delivered.
+	Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error)
+
+	// Close closes the Bus and all of its Subscriptions.
+	Close() error
+}
+
+// SubscribeOptions configures a Subscription.
+type SubscribeOptions struct {
+	// Group makes Subscriptions that share it compete for messages,
+	// so that each message published to the topic is delivered
+	// to only one of them.
+	// Subscriptions without a Group receive every message.
+	Group string
+
+	// ManualAck requires every message delivered to the Subscription
+	// to be acknowledged with Ack or handed back with Nack.
+	// Otherwise messages are acknowledged as soon as they are delivered.
+	ManualAck bool
+}
+
+// Message is a message delivered to a Subscription.
+type Message struct {
+	Topic string
+	Body  []byte
+	ack   func() error
+	nack  func(requeue bool) error
+}
+
+// Ack acknowledges the Message, so that it is not delivered again.
+// It does nothing unless the Subscription uses ManualAck.
+func (m *Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// Nack tells the Bus the Message could not be processed.
+// If requeue is true, the Bus delivers it again,
+// possibly to another Subscription in the same Group.
+// It does nothing unless the Subscription uses ManualAck.
+func (m *Message) Nack(requeue bool) error {
+	if m.nack == nil {
+		return nil
+	}
+	return m.nack(requeue)
+}
+
+// StatusReporter is implemented by Buses that can report
+// the status of their connection to a broker.
+type StatusReporter interface {
+	Status() *Status
+}
+
+// Subscription is a subscription to a topic.
+type Subscription struct {
+	Topic     string
+	group     string
+	manualAck bool
+	msgs      chan *Message
+	// done is closed once the Subscription is closed.
+	done      chan struct{}
+	closeOnce sync.Once
+	// unsubscribe is called once when the Subscription is closed,
+	// to release whatever the Bus holds for it.
+	unsubscribe func()
+}
+
+// newSubscription constructs a new Subscription.
+func newSubscription(topic string, opts *SubscribeOptions, unsubscribe func()) *Subscription {
+	return &Subscription{
+		Topic:       topic,
+		group:       opts.Group,
+		manualAck:   opts.ManualAck,
+		msgs:        make(chan *Message, subscriptionQueueSize),
+		done:        make(chan struct{}),
+		unsubscribe: unsubscribe,
+	}
+}
+
+// Messages returns the channel messages are delivered on.
+// It is never closed, so also select on Done to know
+// when no more messages will be delivered.
+func (s *Subscription) Messages() <-chan *Message {
+	return s.msgs
+}
+
+// Done returns a channel that is closed once the Subscription is closed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close unsubscribes from the topic.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.unsubscribe != nil {
+			s.unsubscribe()
+		}
+	})
+	return nil
+}
+
+// deliver delivers msg to the Subscription,
+// waiting for room in its queue.
+// It reports false if the Subscription was closed first.
+func (s *Subscription) deliver(msg *Message) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	select {
+	case s.msgs <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
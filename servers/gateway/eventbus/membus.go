@@ -0,0 +1,188 @@
+package eventbus
+
+import (
+	"sync"
+)
+
+// MemBus is an in-process Bus.
+// It needs no broker, which makes it handy for tests
+// and for running a single gateway instance.
+type MemBus struct {
+	// The key of the topics map is the topic name.
+	topics map[string]*memTopic
+	closed bool
+	mx     sync.Mutex
+}
+
+// memTopic holds the Subscriptions to a topic.
+type memTopic struct {
+	subs map[*Subscription]bool
+	// The key of the groups map is the group name.
+	groups map[string]*memGroup
+}
+
+// memGroup holds the Subscriptions competing for a topic's messages.
+type memGroup struct {
+	subs []*Subscription
+	// next is the index of the Subscription that gets the next message.
+	next int
+}
+
+// NewMemBus constructs a new MemBus.
+func NewMemBus() *MemBus {
+	return &MemBus{
+		topics: make(map[string]*memTopic),
+	}
+}
+
+// Publish delivers body to every Subscription to topic without a group,
+// and to one Subscription in each group subscribed to topic.
+func (b *MemBus) Publish(topic string, body []byte) error {
+	b.mx.Lock()
+	if b.closed {
+		b.mx.Unlock()
+		return ErrClosed
+	}
+	targets := []*Subscription{}
+	t, found := b.topics[topic]
+	if found {
+		for sub := range t.subs {
+			targets = append(targets, sub)
+		}
+		for _, group := range t.groups {
+			targets = append(targets, group.pick())
+		}
+	}
+	b.mx.Unlock()
+
+	// Don't hold the lock while delivering,
+	// so that subscribers may publish while handling messages.
+	for _, sub := range targets {
+		sub.deliver(b.newMessage(sub, topic, body))
+	}
+	return nil
+}
+
+// Subscribe subscribes to topic.
+func (b *MemBus) Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	t, found := b.topics[topic]
+	if !found {
+		t = &memTopic{
+			subs:   make(map[*Subscription]bool),
+			groups: make(map[string]*memGroup),
+		}
+		b.topics[topic] = t
+	}
+
+	var sub *Subscription
+	sub = newSubscription(topic, opts, func() {
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		b.unsubscribe(sub)
+	})
+	if len(opts.Group) == 0 {
+		t.subs[sub] = true
+	} else {
+		group, found := t.groups[opts.Group]
+		if !found {
+			group = &memGroup{}
+			t.groups[opts.Group] = group
+		}
+		group.subs = append(group.subs, sub)
+	}
+	return sub, nil
+}
+
+// Close closes the MemBus and all of its Subscriptions.
+func (b *MemBus) Close() error {
+	b.mx.Lock()
+	b.closed = true
+	subs := []*Subscription{}
+	for _, t := range b.topics {
+		for sub := range t.subs {
+			subs = append(subs, sub)
+		}
+		for _, group := range t.groups {
+			subs = append(subs, group.subs...)
+		}
+	}
+	b.mx.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	return nil
+}
+
+// newMessage constructs a new Message for sub.
+// Handing back a Message of a group Subscription with Nack
+// publishes it to the group again.
+func (b *MemBus) newMessage(sub *Subscription, topic string, body []byte) *Message {
+	msg := &Message{Topic: topic, Body: body}
+	if !sub.manualAck {
+		return msg
+	}
+	msg.ack = func() error {
+		return nil
+	}
+	msg.nack = func(requeue bool) error {
+		if !requeue {
+			return nil
+		}
+		b.mx.Lock()
+		var target *Subscription
+		if t, found := b.topics[topic]; found {
+			if group, found := t.groups[sub.group]; found {
+				target = group.pick()
+			} else if t.subs[sub] {
+				target = sub
+			}
+		}
+		b.mx.Unlock()
+		if target != nil {
+			target.deliver(b.newMessage(target, topic, body))
+		}
+		return nil
+	}
+	return msg
+}
+
+// unsubscribe removes sub from the MemBus.
+// Callers must hold b.mx.
+func (b *MemBus) unsubscribe(sub *Subscription) {
+	t, found := b.topics[sub.Topic]
+	if !found {
+		return
+	}
+	delete(t.subs, sub)
+	if group, found := t.groups[sub.group]; found {
+		for i, s := range group.subs {
+			if s == sub {
+				group.subs = append(group.subs[:i], group.subs[i+1:]...)
+				break
+			}
+		}
+		if len(group.subs) == 0 {
+			delete(t.groups, sub.group)
+		}
+	}
+	if len(t.subs) == 0 && len(t.groups) == 0 {
+		delete(b.topics, sub.Topic)
+	}
+}
+
+// pick picks the Subscription that gets the next message, round-robin.
+func (g *memGroup) pick() *Subscription {
+	sub := g.subs[g.next%len(g.subs)]
+	g.next++
+	return sub
+}
@@ -0,0 +1,96 @@
+package eventbus
+
+import (
+	"testing"
+	"time"
+)
+
+// expectMessage fails unless sub receives a message with the given body.
+func expectMessage(t *testing.T, step string, sub *Subscription, body string) *Message {
+	select {
+	case msg := <-sub.Messages():
+		if string(msg.Body) != body {
+			t.Errorf("%s: expected message %s but got %s", step, body, msg.Body)
+		}
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatalf("%s: expected message %s", step, body)
+	}
+	return nil
+}
+
+// expectNoMessage fails if sub receives a message
+// within a short while.
+func expectNoMessage(t *testing.T, step string, sub *Subscription) {
+	select {
+	case msg := <-sub.Messages():
+		t.Errorf("%s: expected no message but got %s", step, msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// testBus runs a Bus through broadcast and group subscriptions.
+// topic should be unique to each run, since groups may be remembered by the Bus.
+func testBus(t *testing.T, bus Bus, topic string) {
+	defer bus.Close()
+
+	all1, err := bus.Subscribe(topic, nil)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	all2, err := bus.Subscribe(topic, nil)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	workOpts := &SubscribeOptions{Group: "workers", ManualAck: true}
+	worker1, err := bus.Subscribe(topic, workOpts)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	worker2, err := bus.Subscribe(topic, workOpts)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	if err := bus.Publish(topic, []byte("first")); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	expectMessage(t, "broadcast", all1, "first")
+	expectMessage(t, "broadcast", all2, "first")
+
+	// Exactly one worker gets the message.
+	var msg *Message
+	var other *Subscription
+	select {
+	case msg = <-worker1.Messages():
+		other = worker2
+	case msg = <-worker2.Messages():
+		other = worker1
+	case <-time.After(3 * time.Second):
+		t.Fatal("group: expected a worker to receive the message")
+	}
+	expectNoMessage(t, "group", other)
+
+	// A message handed back is delivered again.
+	worker1.Close()
+	if err := msg.Nack(true); err != nil {
+		t.Fatalf("error handing message back: %v", err)
+	}
+	msg = expectMessage(t, "requeue", worker2, "first")
+	if err := msg.Ack(); err != nil {
+		t.Errorf("error acknowledging message: %v", err)
+	}
+
+	// Closed Subscriptions receive nothing more.
+	all1.Close()
+	if err := bus.Publish(topic, []byte("second")); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	expectMessage(t, "after closing", all2, "second")
+	expectMessage(t, "after closing", worker2, "second")
+	expectNoMessage(t, "after closing", all1)
+}
+
+func TestMemBus(t *testing.T) {
+	testBus(t, NewMemBus(), "events")
+}
@@ -0,0 +1,188 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"log"
+	"sync"
+	"time"
+)
+
+// groupPollTimeout is how long a group Subscription
+// blocks waiting for a message before checking if it was closed.
+const groupPollTimeout = time.Second
+
+// RedisBus is a Bus backed by Redis.
+// Subscriptions without a group use Redis Pub/Sub.
+// Redis Pub/Sub has no way of delivering a message to only one subscriber,
+// so each group gets its own Redis list instead,
+// which Publish pushes to and the group's Subscriptions pop from.
+type RedisBus struct {
+	Client *redis.Client
+	// subs is protected by mx.
+	subs   map[*Subscription]bool
+	closed bool
+	mx     sync.Mutex
+}
+
+// NewRedisBus constructs a new RedisBus.
+func NewRedisBus(client *redis.Client) *RedisBus {
+	if client == nil {
+		panic("nil Redis client")
+	}
+	return &RedisBus{
+		Client: client,
+		subs:   make(map[*Subscription]bool),
+	}
+}
+
+// Publish publishes body to topic.
+func (b *RedisBus) Publish(topic string, body []byte) error {
+	groups, err := b.Client.SMembers(groupsKey(topic)).Result()
+	if err != nil {
+		return fmt.Errorf("error getting groups of topic %s: %v", topic, err)
+	}
+	pipe := b.Client.TxPipeline()
+	pipe.Publish(topic, body)
+	for _, group := range groups {
+		pipe.LPush(groupKey(topic, group), body)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("error publishing to topic %s: %v", topic, err)
+	}
+	return nil
+}
+
+// Subscribe subscribes to topic.
+// Groups are remembered in Redis,
+// so messages published while all of a group's Subscriptions
+// are gone wait for the next one.
+func (b *RedisBus) Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	var sub *Subscription
+	if len(opts.Group) == 0 {
+		pubsub := b.Client.Subscribe(topic)
+		// Wait for the subscription to be confirmed,
+		// so that no message published after Subscribe returns is missed.
+		if _, err := pubsub.Receive(); err != nil {
+			pubsub.Close()
+			return nil, fmt.Errorf("error subscribing to topic %s: %v", topic, err)
+		}
+		sub = newSubscription(topic, opts, func() {
+			pubsub.Close()
+			b.remove(sub)
+		})
+		go b.receive(sub, pubsub)
+	} else {
+		if err := b.Client.SAdd(groupsKey(topic), opts.Group).Err(); err != nil {
+			return nil, fmt.Errorf("error adding group %s to topic %s: %v", opts.Group, topic, err)
+		}
+		sub = newSubscription(topic, opts, func() {
+			b.remove(sub)
+		})
+		go b.pop(sub)
+	}
+	b.subs[sub] = true
+	return sub, nil
+}
+
+// Close closes all Subscriptions of the RedisBus.
+// It does not close the Redis client, which is usually shared.
+func (b *RedisBus) Close() error {
+	b.mx.Lock()
+	b.closed = true
+	subs := []*Subscription{}
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mx.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	return nil
+}
+
+// remove forgets about a closed Subscription.
+func (b *RedisBus) remove(sub *Subscription) {
+	b.mx.Lock()
+	delete(b.subs, sub)
+	b.mx.Unlock()
+}
+
+// receive delivers messages received from Redis Pub/Sub to sub.
+// The channel returned by pubsub.Channel() reconnects on its own
+// if the Redis server goes away, and is closed when pubsub is.
+func (b *RedisBus) receive(sub *Subscription, pubsub *redis.PubSub) {
+	for msg := range pubsub.Channel() {
+		if !sub.deliver(&Message{Topic: sub.Topic, Body: []byte(msg.Payload)}) {
+			return
+		}
+	}
+}
+
+// pop delivers messages popped off the list of sub's group to sub.
+func (b *RedisBus) pop(sub *Subscription) {
+	key := groupKey(sub.Topic, sub.group)
+	for {
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+		result, err := b.Client.BRPop(groupPollTimeout, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("error receiving message from group %s: %v", sub.group, err)
+			time.Sleep(groupPollTimeout)
+			continue
+		}
+		// result holds the key followed by the value.
+		body := []byte(result[1])
+		if !sub.deliver(b.newMessage(sub, key, body)) {
+			// Put the message back for another Subscription.
+			b.Client.RPush(key, body)
+			return
+		}
+	}
+}
+
+// newMessage constructs a new Message for a group Subscription.
+// Messages handed back with Nack are pushed back to the end
+// of the list they were popped from, so they are delivered next.
+func (b *RedisBus) newMessage(sub *Subscription, key string, body []byte) *Message {
+	msg := &Message{Topic: sub.Topic, Body: body}
+	if !sub.manualAck {
+		return msg
+	}
+	msg.ack = func() error {
+		return nil
+	}
+	msg.nack = func(requeue bool) error {
+		if !requeue {
+			return nil
+		}
+		return b.Client.RPush(key, body).Err()
+	}
+	return msg
+}
+
+// groupsKey returns the key of the set of groups subscribed to topic.
+func groupsKey(topic string) string {
+	return "eventbus:groups:" + topic
+}
+
+// groupKey returns the key of the list of messages of a group.
+func groupKey(topic string, group string) string {
+	return "eventbus:group:" + topic + ":" + group
+}
@@ -0,0 +1,28 @@
+package eventbus
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+TestRedisBus tests the RedisBus object.
+Like the RedisStore tests, this is really more of an
+integration test, and needs a redis server running on its default
+port (6379), or at the address in the REDISADDR environment variable.
+*/
+func TestRedisBus(t *testing.T) {
+	redisaddr := os.Getenv("REDISADDR")
+	if len(redisaddr) == 0 {
+		redisaddr = "127.0.0.1:6379"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: redisaddr,
+	})
+
+	testBus(t, NewRedisBus(client), "events-"+bson.NewObjectId().Hex())
+}
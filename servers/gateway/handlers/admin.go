@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// schemeAdmin is the Authorization scheme of the admin credential,
+// kept apart from the "Bearer" scheme of user sessions.
+const schemeAdmin = "Admin "
+
+// AdminServicesPath is the resource path of the service registry admin API.
+const AdminServicesPath = "/v1/admin/services"
+
+// PinRequest is the body of a request pinning a microservice to static addresses.
+// The route only needs to be given if the microservice is not registered yet.
+type PinRequest struct {
+	Addresses   []string `json:"addresses"`
+	PathPattern string   `json:"pathPattern,omitempty"`
+	PathPrefix  string   `json:"pathPrefix,omitempty"`
+	Priority    int      `json:"priority,omitempty"`
+	Methods     []string `json:"methods,omitempty"`
+}
+
+// DrainRequest is the body of a request draining an instance.
+type DrainRequest struct {
+	Draining bool `json:"draining"`
+}
+
+// AdminHandler serves the service registry admin API:
+//
+//	GET    /v1/admin/services                           lists registered microservices
+//	PUT    /v1/admin/services/{name}/pin                pins a microservice to static addresses
+//	DELETE /v1/admin/services/{name}/pin                unpins it
+//	PATCH  /v1/admin/services/{name}/instances/{addr}   drains an instance or undrains it
+//	DELETE /v1/admin/services/{name}/instances/{addr}   deregisters an instance
+//
+// Every request must carry the admin key in an "Authorization: Admin <key>" header.
+type AdminHandler struct {
+	adminKey    string
+	serviceList *ServiceList
+}
+
+// NewAdminHandler constructs a new AdminHandler.
+func NewAdminHandler(adminKey string, serviceList *ServiceList) *AdminHandler {
+	if len(adminKey) == 0 {
+		panic("admin key has length of zero")
+	}
+	if serviceList == nil {
+		panic("nil service list")
+	}
+	return &AdminHandler{adminKey, serviceList}
+}
+
+// ServeHTTP implements the http.Handler interface for the AdminHandler.
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ah.authorized(r) {
+		http.Error(w, "invalid or missing admin credential", http.StatusUnauthorized)
+		return
+	}
+
+	// Split what follows the admin path into
+	// {name}, "pin" or "instances", and {addr}.
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminServicesPath), "/")
+	segments := []string{}
+	if len(rest) != 0 {
+		segments = strings.Split(rest, "/")
+	}
+
+	switch {
+	case len(segments) == 0:
+		ah.handleServices(w, r)
+	case len(segments) == 2 && segments[1] == "pin":
+		ah.handlePin(w, r, segments[0])
+	case len(segments) == 3 && segments[1] == "instances":
+		ah.handleInstance(w, r, segments[0], segments[2])
+	default:
+		http.Error(w, fmt.Sprintf("no admin resource found at %s", r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// authorized reports whether r carries the admin key.
+func (ah *AdminHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get(headerAuthorization)
+	if !strings.HasPrefix(auth, schemeAdmin) {
+		return false
+	}
+	key := strings.TrimPrefix(auth, schemeAdmin)
+	// Compare in constant time, so that the time it takes
+	// doesn't tell an attacker how much of the key is right.
+	return subtle.ConstantTimeCompare([]byte(key), []byte(ah.adminKey)) == 1
+}
+
+// handleServices lists registered microservices.
+func (ah *AdminHandler) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "expect GET method only", http.StatusMethodNotAllowed)
+		return
+	}
+	respondWithJSON(w, ah.serviceList.Services())
+}
+
+// handlePin pins a microservice to static addresses, or unpins it.
+func (ah *AdminHandler) handlePin(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "PUT":
+		pin := &PinRequest{}
+		if err := json.NewDecoder(r.Body).Decode(pin); err != nil {
+			http.Error(w, fmt.Sprintf("error decoding request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		receivedSvc := &ReceivedService{
+			Name:        name,
+			PathPattern: pin.PathPattern,
+			PathPrefix:  pin.PathPrefix,
+			Priority:    pin.Priority,
+			Methods:     pin.Methods,
+		}
+		if err := ah.serviceList.Pin(receivedSvc, pin.Addresses); err != nil {
+			http.Error(w, fmt.Sprintf("error pinning microservice: %v", err), http.StatusBadRequest)
+			return
+		}
+		ah.respondWithService(w, name)
+	case "DELETE":
+		if err := ah.serviceList.Unpin(name); err != nil {
+			http.Error(w, fmt.Sprintf("error unpinning microservice: %v", err), statusOf(err))
+			return
+		}
+		w.Write([]byte("microservice unpinned"))
+	default:
+		http.Error(w, "expect PUT or DELETE method only", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInstance drains, undrains or deregisters an instance.
+func (ah *AdminHandler) handleInstance(w http.ResponseWriter, r *http.Request, name string, addr string) {
+	switch r.Method {
+	case "PATCH":
+		drain := &DrainRequest{}
+		if err := json.NewDecoder(r.Body).Decode(drain); err != nil {
+			http.Error(w, fmt.Sprintf("error decoding request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := ah.serviceList.Drain(name, addr, drain.Draining); err != nil {
+			http.Error(w, fmt.Sprintf("error draining instance: %v", err), statusOf(err))
+			return
+		}
+		ah.respondWithService(w, name)
+	case "DELETE":
+		if err := ah.serviceList.Deregister(name, addr); err != nil {
+			http.Error(w, fmt.Sprintf("error deregistering instance: %v", err), statusOf(err))
+			return
+		}
+		w.Write([]byte("instance deregistered"))
+	default:
+		http.Error(w, "expect PATCH or DELETE method only", http.StatusMethodNotAllowed)
+	}
+}
+
+// respondWithService responds with the description of a microservice.
+func (ah *AdminHandler) respondWithService(w http.ResponseWriter, name string) {
+	info, err := ah.serviceList.Service(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting microservice: %v", err), statusOf(err))
+		return
+	}
+	respondWithJSON(w, info)
+}
+
+// respondWithJSON responds with v encoded as JSON.
+func respondWithJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, fmt.Sprintf("error encoding response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// statusOf returns the status code to respond with for a registry error.
+func statusOf(err error) int {
+	if err == ErrServiceNotFound || err == ErrInstanceNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAdminKey = "test admin key"
+
+// adminRequest sends a request to handler with the admin credential,
+// and returns the response.
+func adminRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set(headerAuthorization, schemeAdmin+testAdminKey)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, r)
+	return resp
+}
+
+func TestAdminHandlerAuthorization(t *testing.T) {
+	handler := NewAdminHandler(testAdminKey, NewServiceList())
+
+	cases := []struct {
+		name           string
+		auth           string
+		expectedStatus int
+	}{
+		{
+			"Admin Key",
+			schemeAdmin + testAdminKey,
+			http.StatusOK,
+		},
+		{
+			"No Credential",
+			"",
+			http.StatusUnauthorized,
+		},
+		{
+			"Wrong Key",
+			schemeAdmin + "guess",
+			http.StatusUnauthorized,
+		},
+		{
+			"Session Token",
+			"Bearer " + testAdminKey,
+			http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", AdminServicesPath, nil)
+		if len(c.auth) != 0 {
+			r.Header.Set(headerAuthorization, c.auth)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+		}
+	}
+}
+
+func TestAdminHandlerInstances(t *testing.T) {
+	serviceList := NewServiceList()
+	for _, addr := range []string{"messaging1:80", "messaging2:80"} {
+		svc := validTestService()
+		svc.Address = addr
+		serviceList.Register(svc)
+	}
+	handler := NewAdminHandler(testAdminKey, serviceList)
+
+	resp := adminRequest(handler, "GET", AdminServicesPath, "")
+	services := []*ServiceInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		t.Fatalf("error decoding services: %v", err)
+	}
+	if len(services) != 1 || len(services[0].Instances) != 2 || services[0].PathPattern != validTestService().PathPattern {
+		t.Fatalf("incorrect services listed: %s", resp.Body.String())
+	}
+
+	// A draining instance gets no requests.
+	resp = adminRequest(handler, "PATCH", AdminServicesPath+"/messaging/instances/messaging1:80", `{"draining":true}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("error draining instance: %s", resp.Body.String())
+	}
+	svc := serviceList.services["messaging"]
+	for i := 0; i < 4; i++ {
+		if instance := svc.pick(""); instance.address != "messaging2:80" {
+			t.Errorf("expected draining instance to get no requests but got %s", instance.address)
+		}
+	}
+
+	resp = adminRequest(handler, "DELETE", AdminServicesPath+"/messaging/instances/messaging2:80", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("error deregistering instance: %s", resp.Body.String())
+	}
+	if _, found := svc.instances["messaging2:80"]; found {
+		t.Errorf("expected instance to be deregistered")
+	}
+
+	resp = adminRequest(handler, "DELETE", AdminServicesPath+"/messaging/instances/unknown:80", "")
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d deregistering an unknown instance but got %d", http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestAdminHandlerPin(t *testing.T) {
+	serviceList := NewServiceList()
+	serviceList.Register(validTestService())
+	handler := NewAdminHandler(testAdminKey, serviceList)
+
+	// Pinning a service that isn't registered needs a route.
+	resp := adminRequest(handler, "PUT", AdminServicesPath+"/summary/pin", `{"addresses":["summary:80"]}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d pinning an unknown service without a route but got %d", http.StatusBadRequest, resp.Code)
+	}
+
+	resp = adminRequest(handler, "PUT", AdminServicesPath+"/messaging/pin", `{"addresses":["static:80"]}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("error pinning service: %s", resp.Body.String())
+	}
+	svc := serviceList.services["messaging"]
+	for i := 0; i < 4; i++ {
+		if instance := svc.pick(""); instance.address != "static:80" {
+			t.Errorf("expected pinned service to use its static address but got %s", instance.address)
+		}
+	}
+
+	resp = adminRequest(handler, "DELETE", AdminServicesPath+"/messaging/pin", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("error unpinning service: %s", resp.Body.String())
+	}
+	if instance := svc.pick(""); instance.address != validTestService().Address {
+		t.Errorf("expected unpinned service to use its discovered instance but got %s", instance.address)
+	}
+}
+
+func TestServiceListFallback(t *testing.T) {
+	serviceList := NewServiceList()
+	fallback := &ReceivedService{Name: "messaging", PathPattern: "/v1/(channels|messages)/?"}
+	if err := serviceList.AddFallback(fallback, []string{"static:80"}); err != nil {
+		t.Fatalf("error adding fallback: %v", err)
+	}
+	svc := serviceList.services["messaging"]
+	if instance := svc.pick(""); instance == nil || instance.address != "static:80" {
+		t.Fatalf("expected the static address to be used without discovered instances")
+	}
+
+	serviceList.Register(validTestService())
+	if instance := svc.pick(""); instance.address != validTestService().Address {
+		t.Errorf("expected discovered instance to be preferred but got %s", instance.address)
+	}
+
+	// Static instances never expire.
+	serviceList.Deregister("messaging", validTestService().Address)
+	serviceList.Remove()
+	if instance := svc.pick(""); instance == nil || instance.address != "static:80" {
+		t.Errorf("expected to fall back to the static address")
+	}
+}
+
+func TestServiceListPinKeepsFallbacks(t *testing.T) {
+	serviceList := NewServiceList()
+	fallback := &ReceivedService{Name: "messaging", PathPattern: "/v1/(channels|messages)/?"}
+	if err := serviceList.AddFallback(fallback, []string{"fallback:80"}); err != nil {
+		t.Fatalf("error adding fallback: %v", err)
+	}
+	serviceList.Register(validTestService())
+	discovered := validTestService().Address
+
+	if err := serviceList.Pin(fallback, []string{"pinned:80", discovered}); err != nil {
+		t.Fatalf("error pinning service: %v", err)
+	}
+	svc := serviceList.services["messaging"]
+	// Pinned services only use the addresses they are pinned to, not their fallbacks.
+	for i := 0; i < 4; i++ {
+		if instance := svc.pick(""); instance.address == "fallback:80" {
+			t.Errorf("expected pinned service to skip its fallback")
+		}
+	}
+
+	if err := serviceList.Unpin("messaging"); err != nil {
+		t.Fatalf("error unpinning service: %v", err)
+	}
+	if _, found := svc.instances["pinned:80"]; found {
+		t.Errorf("expected the instance added by pinning to be removed")
+	}
+	if instance, found := svc.instances["fallback:80"]; !found || !instance.static {
+		t.Errorf("expected the fallback to survive unpinning")
+	}
+	if instance, found := svc.instances[discovered]; !found || instance.configured() {
+		t.Errorf("expected the discovered instance to survive unpinning as a discovered instance")
+	}
+	if instance := svc.pick(""); instance == nil || instance.address != discovered {
+		t.Errorf("expected unpinned service to use its discovered instance")
+	}
+}
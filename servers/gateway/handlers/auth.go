@@ -8,6 +8,7 @@ import (
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/resetcodes"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
 	"gopkg.in/mgo.v2/bson"
 	"net/http"
 	"net/smtp"
@@ -27,7 +28,7 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 	case "GET":
 		// Get session state from session store.
 		sessionState := &SessionState{}
-		_, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
+		_, err := ctx.getSessionState(r, sessionState)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
 			return
@@ -45,6 +46,8 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 			}
 		}
 
+		_, span := tracing.Start(r.Context(), "trie.Search")
+		span.SetAttribute("search.query", q)
 		tokens := strings.Split(q, " ")
 		intersection := make(map[bson.ObjectId]bool)
 
@@ -81,8 +84,10 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 				}
 			}
 		}
+		span.SetAttribute("search.results", len(intersection))
+		span.End()
 
-		results, err = ctx.UserStore.ConvertToUsers(intersection)
+		results, err = ctx.userStore(r).ConvertToUsers(intersection)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error converting to users: %v", err), http.StatusInternalServerError)
 			return
@@ -118,21 +123,21 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 		}
 
 		// Ensure there isn't already a user in the user store with the same email address.
-		_, err = ctx.UserStore.GetByEmail(newUser.Email)
+		_, err = ctx.userStore(r).GetByEmail(newUser.Email)
 		if err == nil {
 			http.Error(w, "user with the same email already exists", http.StatusBadRequest)
 			return
 		}
 
 		// Ensure there isn't already a user in the user store with the same user name.
-		_, err = ctx.UserStore.GetByUserName(newUser.UserName)
+		_, err = ctx.userStore(r).GetByUserName(newUser.UserName)
 		if err == nil {
 			http.Error(w, "user with the same username already exists", http.StatusBadRequest)
 			return
 		}
 
 		// Insert the new user into the user store.
-		user, err := ctx.UserStore.Insert(newUser)
+		user, err := ctx.userStore(r).Insert(newUser)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error inserting new user: %s", err), http.StatusInternalServerError)
 			return
@@ -156,7 +161,7 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 func (ctx *HandlerContext) UsersMeHandler(w http.ResponseWriter, r *http.Request) {
 	// Get session state from session store.
 	sessionState := &SessionState{}
-	sessionID, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
+	sessionID, err := ctx.getSessionState(r, sessionState)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
 		return
@@ -200,7 +205,7 @@ func (ctx *HandlerContext) UsersMeHandler(w http.ResponseWriter, r *http.Request
 		}
 
 		// Update user store.
-		err = ctx.UserStore.Update(sessionState.User.ID, updates)
+		err = ctx.userStore(r).Update(sessionState.User.ID, updates)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error updating user store: %s", err), http.StatusInternalServerError)
 			return
@@ -250,8 +255,9 @@ func (ctx *HandlerContext) SessionsHandler(w http.ResponseWriter, r *http.Reques
 	// Get the user with the provided email from the UserStore.
 	// If not found, respond with an http.StatusUnauthorized error
 	// and the message "invalid credentials".
-	user, err := ctx.UserStore.GetByEmail(credentials.Email)
+	user, err := ctx.userStore(r).GetByEmail(credentials.Email)
 	if err != nil {
+		ctx.Metrics.signInFailures.Inc()
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
@@ -261,6 +267,7 @@ func (ctx *HandlerContext) SessionsHandler(w http.ResponseWriter, r *http.Reques
 	// and the message "invalid credentials".
 	err = user.Authenticate(credentials.Password)
 	if err != nil {
+		ctx.Metrics.signInFailures.Inc()
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
@@ -287,7 +294,7 @@ func (ctx *HandlerContext) SessionsMineHandler(w http.ResponseWriter, r *http.Re
 
 	// Get session state from session store.
 	sessionState := &SessionState{}
-	_, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
+	_, err := ctx.getSessionState(r, sessionState)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
 		return
@@ -363,6 +370,7 @@ func blockRepeatedFailedSignIns(ctx *HandlerContext, email string) error {
 				if err != nil {
 					return fmt.Errorf("error saving data to Redis: %v", err)
 				}
+				ctx.Metrics.signInLockouts.Inc()
 			}
 			// If this email is already blocked for further sign-in,
 			// report error.
@@ -392,7 +400,7 @@ func (ctx *HandlerContext) ResetCodesHandler(w http.ResponseWriter, r *http.Requ
 
 	// Check if the reset request actually contains
 	// email that has associated user stored in our database.
-	_, err = ctx.UserStore.GetByEmail(resetCodeRequest.Email)
+	_, err = ctx.userStore(r).GetByEmail(resetCodeRequest.Email)
 	if err != nil {
 		http.Error(w, "no user found with this email", http.StatusBadRequest)
 		return
@@ -489,14 +497,14 @@ func (ctx *HandlerContext) ResetPasswordHandler(w http.ResponseWriter, r *http.R
 	}
 
 	// Get the user with the provided email.
-	oldUser, err := ctx.UserStore.GetByEmail(email)
+	oldUser, err := ctx.userStore(r).GetByEmail(email)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error retrieving user data: %s", err), http.StatusBadRequest)
 		return
 	}
 
 	// Delete the old user.
-	err = ctx.UserStore.Delete(oldUser.ID)
+	err = ctx.userStore(r).Delete(oldUser.ID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error deleting user data: %s", err), http.StatusInternalServerError)
 		return
@@ -520,7 +528,7 @@ func (ctx *HandlerContext) ResetPasswordHandler(w http.ResponseWriter, r *http.R
 	}
 
 	// Insert the new user into the user store.
-	user, err := ctx.UserStore.Insert(newUser)
+	user, err := ctx.userStore(r).Insert(newUser)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error inserting new user: %s", err), http.StatusInternalServerError)
 		return
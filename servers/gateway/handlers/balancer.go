@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing strategies a microservice may announce.
+const (
+	// StrategyRoundRobin takes turns between instances.
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastOutstanding prefers the instance
+	// with the fewest requests in flight.
+	StrategyLeastOutstanding = "least-outstanding"
+	// StrategyWeighted takes turns between instances
+	// in proportion to their announced weights.
+	StrategyWeighted = "weighted"
+	// StrategyConsistentHash sends all requests of a user
+	// to the same instance, for as long as it is available.
+	StrategyConsistentHash = "consistent-hash"
+)
+
+// balancer decides which instance of a microservice a request goes to.
+type balancer interface {
+	// order returns instances in the order they should be tried
+	// for a request with the given key.
+	// instances is sorted by address.
+	order(instances []*serviceInstance, key string) []*serviceInstance
+}
+
+// newBalancer constructs the balancer of the given strategy.
+// It reports false if there is no such strategy.
+func newBalancer(strategy string) (balancer, bool) {
+	switch strategy {
+	case "", StrategyRoundRobin:
+		return &roundRobinBalancer{}, true
+	case StrategyLeastOutstanding:
+		return &leastOutstandingBalancer{}, true
+	case StrategyWeighted:
+		return newWeightedBalancer(), true
+	case StrategyConsistentHash:
+		return &consistentHashBalancer{}, true
+	default:
+		return nil, false
+	}
+}
+
+// rotate returns instances rotated left by n.
+func rotate(instances []*serviceInstance, n uint64) []*serviceInstance {
+	if len(instances) == 0 {
+		return instances
+	}
+	i := int(n % uint64(len(instances)))
+	return append(instances[i:len(instances):len(instances)], instances[:i]...)
+}
+
+// roundRobinBalancer takes turns between instances.
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) order(instances []*serviceInstance, key string) []*serviceInstance {
+	return rotate(instances, atomic.AddUint64(&b.next, 1)-1)
+}
+
+// leastOutstandingBalancer prefers the instance with the fewest requests in flight.
+type leastOutstandingBalancer struct {
+	next uint64
+}
+
+func (b *leastOutstandingBalancer) order(instances []*serviceInstance, key string) []*serviceInstance {
+	// Read the counts once, since requests keep coming and going.
+	outstanding := make(map[*serviceInstance]int64)
+	for _, instance := range instances {
+		outstanding[instance] = atomic.LoadInt64(&instance.outstanding)
+	}
+	ordered := append([]*serviceInstance{}, instances...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return outstanding[ordered[i]] < outstanding[ordered[j]]
+	})
+	// Take turns between the instances that are least busy.
+	tied := 1
+	for tied < len(ordered) && outstanding[ordered[tied]] == outstanding[ordered[0]] {
+		tied++
+	}
+	if tied > 1 {
+		copy(ordered, rotate(ordered[:tied], atomic.AddUint64(&b.next, 1)-1))
+	}
+	return ordered
+}
+
+// weightedBalancer takes turns between instances in proportion to their weights,
+// spreading the turns of heavy instances out instead of bunching them up.
+// It is the smooth weighted round-robin used by nginx:
+// every turn, each instance earns its weight,
+// and the richest one is picked and pays back the total.
+type weightedBalancer struct {
+	// The key of the current map is the instance's address.
+	current map[string]int
+	mx      sync.Mutex
+}
+
+// newWeightedBalancer constructs a new weightedBalancer.
+func newWeightedBalancer() *weightedBalancer {
+	return &weightedBalancer{current: make(map[string]int)}
+}
+
+func (b *weightedBalancer) order(instances []*serviceInstance, key string) []*serviceInstance {
+	if len(instances) == 0 {
+		return instances
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	total := 0
+	best := 0
+	live := make(map[string]bool)
+	for i, instance := range instances {
+		live[instance.address] = true
+		total += instance.weight
+		b.current[instance.address] += instance.weight
+		if b.current[instance.address] > b.current[instances[best].address] {
+			best = i
+		}
+	}
+	b.current[instances[best].address] -= total
+	// Forget about instances that are gone.
+	for addr := range b.current {
+		if !live[addr] {
+			delete(b.current, addr)
+		}
+	}
+
+	// Should the picked instance be unavailable,
+	// fall back to the others, heaviest first.
+	ordered := []*serviceInstance{instances[best]}
+	rest := append(append([]*serviceInstance{}, instances[:best]...), instances[best+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].weight > rest[j].weight
+	})
+	return append(ordered, rest...)
+}
+
+// ringReplicas is how many points each instance gets on the hash ring.
+// More points spread users more evenly between instances.
+const ringReplicas = 100
+
+// consistentHashBalancer sends all requests with the same key
+// to the same instance.
+// Instances are placed on a hash ring, and a key goes to the first
+// instance after it on the ring, so that adding or removing an instance
+// only moves the keys of its neighbours.
+type consistentHashBalancer struct {
+	// ring and ringInstances are protected by mx.
+	ring []ringPoint
+	// ringInstances are the instances ring was built from.
+	ringInstances []*serviceInstance
+	mx            sync.Mutex
+}
+
+// ringPoint is a point on the hash ring.
+type ringPoint struct {
+	hash     uint32
+	instance *serviceInstance
+}
+
+func (b *consistentHashBalancer) order(instances []*serviceInstance, key string) []*serviceInstance {
+	ring := b.ringOf(instances)
+	if len(ring) == 0 {
+		return instances
+	}
+
+	// Walk the ring from the key, collecting every instance once,
+	// so that the next instance on the ring takes over
+	// if the key's instance is unavailable.
+	hash := hashOf(key)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	ordered := []*serviceInstance{}
+	seen := make(map[*serviceInstance]bool)
+	for i := 0; i < len(ring) && len(ordered) < len(instances); i++ {
+		instance := ring[(start+i)%len(ring)].instance
+		if !seen[instance] {
+			seen[instance] = true
+			ordered = append(ordered, instance)
+		}
+	}
+	return ordered
+}
+
+// ringOf returns the hash ring of instances,
+// rebuilding it only if instances changed.
+func (b *consistentHashBalancer) ringOf(instances []*serviceInstance) []ringPoint {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if sameInstances(instances, b.ringInstances) {
+		return b.ring
+	}
+	ring := make([]ringPoint, 0, len(instances)*ringReplicas)
+	for _, instance := range instances {
+		for i := 0; i < ringReplicas; i++ {
+			ring = append(ring, ringPoint{hashOf(instance.address + "#" + strconv.Itoa(i)), instance})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	b.ring = ring
+	b.ringInstances = append([]*serviceInstance{}, instances...)
+	return ring
+}
+
+// sameInstances reports whether a and b hold the same instances in the same order.
+func sameInstances(a []*serviceInstance, b []*serviceInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hashOf hashes key onto the ring.
+func hashOf(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
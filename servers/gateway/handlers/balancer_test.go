@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInstances constructs instances with the given weights,
+// at addresses sorted in the same order.
+func newTestInstances(weights ...int) []*serviceInstance {
+	instances := []*serviceInstance{}
+	for i, weight := range weights {
+		instances = append(instances, newServiceInstance(fmt.Sprintf("10.0.0.%d:80", i), time.Now(), weight))
+	}
+	return instances
+}
+
+// countPicks counts how many of n requests go to each instance.
+func countPicks(b balancer, instances []*serviceInstance, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.order(instances, fmt.Sprintf("user%d", i))[0].address]++
+	}
+	return counts
+}
+
+func TestBalancers(t *testing.T) {
+	cases := []struct {
+		name        string
+		strategy    string
+		weights     []int
+		outstanding []int64
+		requests    int
+		expected    []int
+	}{
+		{
+			"Round Robin",
+			StrategyRoundRobin,
+			[]int{1, 1, 1},
+			[]int64{0, 0, 0},
+			6,
+			[]int{2, 2, 2},
+		},
+		{
+			"Round Robin Ignores Weights",
+			StrategyRoundRobin,
+			[]int{3, 1},
+			[]int64{0, 0},
+			8,
+			[]int{4, 4},
+		},
+		{
+			"Weighted",
+			StrategyWeighted,
+			[]int{3, 1},
+			[]int64{0, 0},
+			8,
+			[]int{6, 2},
+		},
+		{
+			"Least Outstanding",
+			StrategyLeastOutstanding,
+			[]int{1, 1, 1},
+			[]int64{5, 0, 2},
+			3,
+			[]int{0, 3, 0},
+		},
+		{
+			"Least Outstanding Takes Turns When Tied",
+			StrategyLeastOutstanding,
+			[]int{1, 1, 1},
+			[]int64{1, 0, 0},
+			4,
+			[]int{0, 2, 2},
+		},
+	}
+
+	for _, c := range cases {
+		b, found := newBalancer(c.strategy)
+		if !found {
+			t.Fatalf("case %s: no balancer for strategy %s", c.name, c.strategy)
+		}
+		instances := newTestInstances(c.weights...)
+		for i, outstanding := range c.outstanding {
+			instances[i].outstanding = outstanding
+		}
+		counts := countPicks(b, instances, c.requests)
+		for i, instance := range instances {
+			if counts[instance.address] != c.expected[i] {
+				t.Errorf("case %s: expected instance %d to get %d requests but got %d", c.name, i, c.expected[i], counts[instance.address])
+			}
+		}
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	b, _ := newBalancer(StrategyConsistentHash)
+	instances := newTestInstances(1, 1, 1, 1)
+
+	// Every user sticks to an instance.
+	picks := make(map[string]*serviceInstance)
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user%d", i)
+		picks[user] = b.order(instances, user)[0]
+		if again := b.order(instances, user)[0]; again != picks[user] {
+			t.Fatalf("expected %s to stick to %s but got %s", user, picks[user].address, again.address)
+		}
+	}
+
+	// Removing an instance only moves the users it had.
+	removed := instances[1]
+	remaining := append([]*serviceInstance{instances[0]}, instances[2:]...)
+	for user, instance := range picks {
+		got := b.order(remaining, user)[0]
+		if instance != removed && got != instance {
+			t.Errorf("expected %s to stay on %s but it moved to %s", user, instance.address, got.address)
+		}
+	}
+}
+
+func TestDSDHandlerUsesLiveInstances(t *testing.T) {
+	first := newTestService(http.StatusOK)
+	defer first.Close()
+	second := newTestService(http.StatusAccepted)
+	defer second.Close()
+
+	serviceList := NewServiceList()
+	register := func(srv *httptest.Server) {
+		serviceList.Register(&ReceivedService{
+			Name:        "test",
+			PathPattern: "^/v1/test",
+			Address:     strings.TrimPrefix(srv.URL, "http://"),
+			Heartbeat:   10,
+		})
+	}
+	register(first)
+	handler := newTestDSDHandler(serviceList)
+
+	// An instance registered after the service was first seen gets traffic too.
+	register(second)
+	codes := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/test", nil))
+		codes[resp.Code]++
+	}
+	if codes[http.StatusOK] != 2 || codes[http.StatusAccepted] != 2 {
+		t.Errorf("expected requests to be split between both instances but got %v", codes)
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a circuitBreaker.
+type breakerState int
+
+const (
+	// breakerClosed lets every request through.
+	breakerClosed breakerState = iota
+	// breakerOpen lets no request through until the cooldown is over.
+	breakerOpen
+	// breakerHalfOpen lets a single trial request through,
+	// whose outcome decides whether to close or open again.
+	breakerHalfOpen
+)
+
+// String returns the name of the breakerState, for logging.
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// failureThreshold is how many failures in a row open a circuitBreaker.
+const failureThreshold = 5
+
+// breakerCooldown is how long an open circuitBreaker
+// waits before letting a trial request through.
+const breakerCooldown = time.Second * 10
+
+// circuitBreaker stops traffic to a service instance
+// that keeps failing, and lets it back in gradually once it recovers.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// trial is true while the trial request of a half-open breaker is in flight,
+	// which it has been since trialAt.
+	trial    bool
+	trialAt  time.Time
+	cooldown time.Duration
+	mx       sync.Mutex
+}
+
+// newCircuitBreaker constructs a new closed circuitBreaker.
+func newCircuitBreaker(cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{cooldown: cooldown}
+}
+
+// allow reports whether a request may go through.
+// Once the cooldown of an open breaker is over,
+// it turns half-open and allows a single trial request.
+// A trial request whose outcome isn't recorded within another cooldown
+// is given up on, and another one is allowed.
+func (cb *circuitBreaker) allow() bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	switch cb.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.trial = true
+		cb.trialAt = time.Now()
+		return true
+	default:
+		if cb.trial && time.Since(cb.trialAt) < cb.cooldown {
+			return false
+		}
+		cb.trial = true
+		cb.trialAt = time.Now()
+		return true
+	}
+}
+
+// success records a successful request.
+// It closes a half-open breaker,
+// and reports whether the breaker has just closed.
+func (cb *circuitBreaker) success() bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	recovered := cb.state != breakerClosed
+	cb.failures = 0
+	cb.trial = false
+	cb.state = breakerClosed
+	return recovered
+}
+
+// abandon records a request that neither succeeded nor failed,
+// such as one canceled by the client,
+// so that a half-open breaker lets another trial request through.
+func (cb *circuitBreaker) abandon() {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.trial = false
+}
+
+// failure records a failed request.
+// It opens a closed breaker after failureThreshold failures in a row,
+// and opens a half-open one right away.
+// It reports whether the breaker has just opened.
+func (cb *circuitBreaker) failure() bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.failures++
+	cb.trial = false
+	if cb.state == breakerOpen {
+		return false
+	}
+	if cb.state == breakerHalfOpen || cb.failures >= failureThreshold {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// probed records the outcome of an active health probe.
+// A failed probe counts as a failed request.
+// A successful probe resets the failures of a closed breaker,
+// and ends the cooldown of an open one, so that a trial request
+// confirms the recovery with real traffic.
+// It also lets a half-open breaker whose trial request never
+// recorded an outcome let another one through.
+func (cb *circuitBreaker) probed(healthy bool) bool {
+	if !healthy {
+		return cb.failure()
+	}
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	switch cb.state {
+	case breakerClosed:
+		cb.failures = 0
+	case breakerOpen:
+		cb.openedAt = time.Time{}
+	case breakerHalfOpen:
+		cb.trial = false
+	}
+	return false
+}
+
+// currentState returns the state of the breaker.
+func (cb *circuitBreaker) currentState() breakerState {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	return cb.state
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(50 * time.Millisecond)
+
+	for i := 0; i < failureThreshold-1; i++ {
+		if cb.failure() {
+			t.Fatalf("expected breaker to stay closed after %d failures", i+1)
+		}
+	}
+	// A success in between starts the count over.
+	cb.success()
+	for i := 0; i < failureThreshold-1; i++ {
+		cb.failure()
+	}
+	if !cb.allow() {
+		t.Errorf("expected closed breaker to allow requests")
+	}
+	if !cb.failure() {
+		t.Errorf("expected breaker to open after %d failures in a row", failureThreshold)
+	}
+	if cb.allow() {
+		t.Errorf("expected open breaker to refuse requests")
+	}
+
+	// After the cooldown, a single trial request goes through.
+	time.Sleep(60 * time.Millisecond)
+	if !cb.allow() {
+		t.Errorf("expected breaker to allow a trial request after the cooldown")
+	}
+	if cb.currentState() != breakerHalfOpen {
+		t.Errorf("expected breaker to be half-open but got %s", cb.currentState())
+	}
+	if cb.allow() {
+		t.Errorf("expected half-open breaker to allow only one trial request")
+	}
+	// A failed trial opens it again.
+	if !cb.failure() {
+		t.Errorf("expected failed trial to open the breaker again")
+	}
+
+	// A successful health probe ends the cooldown early,
+	// and a successful trial closes it.
+	cb.probed(true)
+	if !cb.allow() {
+		t.Errorf("expected successful probe to end the cooldown")
+	}
+	if !cb.success() {
+		t.Errorf("expected successful trial to close the breaker")
+	}
+	if cb.currentState() != breakerClosed {
+		t.Errorf("expected breaker to be closed but got %s", cb.currentState())
+	}
+}
+
+func TestCircuitBreakerLostTrial(t *testing.T) {
+	cb := newCircuitBreaker(50 * time.Millisecond)
+	for i := 0; i < failureThreshold; i++ {
+		cb.failure()
+	}
+	time.Sleep(60 * time.Millisecond)
+	// A trial request that never records an outcome.
+	if !cb.allow() {
+		t.Fatalf("expected breaker to allow a trial request after the cooldown")
+	}
+	if cb.allow() {
+		t.Errorf("expected half-open breaker to wait for its trial request")
+	}
+
+	// A successful health probe lets another trial request through.
+	cb.probed(true)
+	if !cb.allow() {
+		t.Errorf("expected successful probe to allow another trial request")
+	}
+
+	// So does giving up on the trial request after another cooldown.
+	if cb.allow() {
+		t.Errorf("expected half-open breaker to wait for its new trial request")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !cb.allow() {
+		t.Errorf("expected breaker to give up on a trial request after the cooldown")
+	}
+}
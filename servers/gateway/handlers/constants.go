@@ -5,6 +5,16 @@ const headerAccessControlAllowHeaders = "Access-Control-Allow-Headers"
 const headerAccessControlExposeHeaders = "Access-Control-Expose-Headers"
 const headerAccessControlAllowMethods = "Access-Control-Allow-Methods"
 const headerAccessControlMaxAge = "Access-Control-Max-Age"
+const headerAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+const headerAccessControlRequestMethod = "Access-Control-Request-Method"
+const headerAccessControlRequestHeaders = "Access-Control-Request-Headers"
+const headerOrigin = "Origin"
+const headerVary = "Vary"
 
+const headerAuthorization = "Authorization"
+const headerRetryAfter = "Retry-After"
+const headerRateLimitLimit = "X-RateLimit-Limit"
+const headerRateLimitRemaining = "X-RateLimit-Remaining"
+const headerRateLimitReset = "X-RateLimit-Reset"
 const headerContentType = "Content-Type"
 const contentTypeJSON = "application/json"
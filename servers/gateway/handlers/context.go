@@ -6,6 +6,7 @@ import (
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/resetcodes"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"net/http"
 )
 
 // HandlerContext will be a receiver on any of your HTTP
@@ -22,6 +23,8 @@ type HandlerContext struct {
 	UserStore      users.Store
 	AttemptStore   attempts.Store
 	ResetCodeStore resetcodes.Store
+	// Metrics count sign-in failures and lockouts.
+	Metrics *Metrics
 }
 
 // NewHandlerContext constructs a new HanderContext,
@@ -32,7 +35,8 @@ func NewHandlerContext(
 	sessionStore sessions.Store,
 	userStore users.Store,
 	attemptStore attempts.Store,
-	resetCodeStore resetcodes.Store) *HandlerContext {
+	resetCodeStore resetcodes.Store,
+	metrics *Metrics) *HandlerContext {
 
 	if len(signingKey) == 0 {
 		panic("signing key has length of zero")
@@ -58,5 +62,15 @@ func NewHandlerContext(
 		panic("nil reset code store")
 	}
 
-	return &HandlerContext{signingKey, trie, sessionStore, userStore, attemptStore, resetCodeStore}
+	if metrics == nil {
+		panic("nil metrics")
+	}
+
+	return &HandlerContext{signingKey, trie, sessionStore, userStore, attemptStore, resetCodeStore, metrics}
+}
+
+// userStore returns the UserStore, tracing calls to it
+// as part of the request r.
+func (ctx *HandlerContext) userStore(r *http.Request) users.Store {
+	return users.NewTracedStore(ctx.UserStore, r.Context())
 }
@@ -1,34 +1,243 @@
 package handlers
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// CORSPolicy says which web origins may call the gateway, and how.
+// It is loaded from JSON, such as:
+//
+//	{
+//	  "allowedOrigins": ["https://info-344.zicodeng.me", "https://*.zicodeng.me"],
+//	  "allowCredentials": true,
+//	  "routes": {"/v1/admin/": {"allowedMethods": ["GET"]}}
+//	}
+//
+// Fields left out keep the values of DefaultCORSPolicy.
+type CORSPolicy struct {
+	// AllowedOrigins are the origins allowed to call the gateway.
+	// An origin may be "*" for any origin,
+	// or have a "*" in place of its subdomains, as in "https://*.example.com".
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowCredentials lets allowed origins send cookies and Authorization headers,
+	// and read the responses to them.
+	// It can't be combined with the "*" origin.
+	AllowCredentials bool `json:"allowCredentials"`
+	// AllowedMethods are the methods allowed origins may use.
+	AllowedMethods []string `json:"allowedMethods"`
+	// AllowedHeaders are the request headers allowed origins may send.
+	AllowedHeaders []string `json:"allowedHeaders"`
+	// ExposedHeaders are the response headers allowed origins may read.
+	ExposedHeaders []string `json:"exposedHeaders"`
+	// MaxAge is how long browsers may cache the answer to a preflight request, in seconds.
+	MaxAge int `json:"maxAge"`
+	// Routes override the allowed methods and headers
+	// of requests whose resource path begins with the key.
+	// The longest matching path wins.
+	Routes map[string]*CORSRoute `json:"routes"`
+}
+
+// CORSRoute overrides the allowed methods and headers of a route.
+// Fields left out keep the values of the CORSPolicy.
+type CORSRoute struct {
+	AllowedMethods []string `json:"allowedMethods"`
+	AllowedHeaders []string `json:"allowedHeaders"`
+}
+
+// DefaultCORSPolicy lets any origin call the gateway without credentials.
+// The Authorization header holding the session token
+// is sent explicitly by clients, so it needs no credentials.
+func DefaultCORSPolicy() *CORSPolicy {
+	return &CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "PUT", "POST", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", accesslog.HeaderRequestID},
+		ExposedHeaders: []string{"Authorization", accesslog.HeaderRequestID, headerRetryAfter, headerRateLimitLimit, headerRateLimitRemaining, headerRateLimitReset},
+		MaxAge:         600,
+	}
+}
+
+// ParseCORSPolicy parses a CORSPolicy from JSON,
+// and returns an error if it is invalid.
+func ParseCORSPolicy(data []byte) (*CORSPolicy, error) {
+	policy := DefaultCORSPolicy()
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("error unmarshalling CORS policy: %v", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate returns an error if the CORSPolicy is invalid.
+func (policy *CORSPolicy) Validate() error {
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return fmt.Errorf("credentials can't be allowed for any origin, list the allowed origins instead")
+			}
+			continue
+		}
+		if strings.Count(origin, "*") > 1 || !strings.Contains(origin, "://") || strings.HasSuffix(origin, "/") {
+			return fmt.Errorf("invalid origin %q: expect scheme://host[:port] with at most one *", origin)
+		}
+	}
+	for prefix := range policy.Routes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid route %q: must begin with /", prefix)
+		}
+	}
+	return nil
+}
+
+// AllowsOrigin reports whether origin may call the gateway.
+func (policy *CORSPolicy) AllowsOrigin(origin string) bool {
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// A "*" stands for one or more subdomains.
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:i]), strings.ToLower(allowed[i+1:])
+			lower := strings.ToLower(origin)
+			if len(lower) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) &&
+				!strings.ContainsAny(lower[len(prefix):len(lower)-len(suffix)], "/:@") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckOrigin reports whether the WebSocket handshake in r
+// comes from an allowed origin. It can be used as the CheckOrigin
+// of a websocket.Upgrader.
+// Handshakes without an Origin header don't come from browsers,
+// so they are allowed.
+func (policy *CORSPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get(headerOrigin)
+	return len(origin) == 0 || policy.AllowsOrigin(origin)
+}
+
+// route returns the methods and headers allowed for the given resource path.
+func (policy *CORSPolicy) route(path string) ([]string, []string) {
+	methods, headers := policy.AllowedMethods, policy.AllowedHeaders
+	longest := ""
+	for prefix := range policy.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if rt := policy.Routes[longest]; rt != nil {
+		if rt.AllowedMethods != nil {
+			methods = rt.AllowedMethods
+		}
+		if rt.AllowedHeaders != nil {
+			headers = rt.AllowedHeaders
+		}
+	}
+	return methods, headers
+}
+
 // CORSHandler is a middleware handler that wraps another http.Handler
 // to do some pre- and/or post-processing of the request.
 type CORSHandler struct {
 	Handler http.Handler
+	Policy  *CORSPolicy
 }
 
-// NewCORSHandler wraps another handler into CORSHandler.
-func NewCORSHandler(handlerToWrap http.Handler) *CORSHandler {
-	return &CORSHandler{handlerToWrap}
+// NewCORSHandler wraps another handler into CORSHandler,
+// which applies the given CORS policy.
+func NewCORSHandler(handlerToWrap http.Handler, policy *CORSPolicy) *CORSHandler {
+	if policy == nil {
+		panic("nil CORS policy")
+	}
+	return &CORSHandler{handlerToWrap, policy}
 }
 
 // ServeHTTP is a method of CORSHandler.
 // Now our CORSHandler is a http.Handler.
+// Requests from allowed origins get CORS headers,
+// and preflight requests are answered here.
+// WebSocket handshakes from other origins are refused,
+// since browsers don't apply CORS to them.
 func (ch *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Responses differ by origin, so caches must keep them apart.
+	w.Header().Add(headerVary, headerOrigin)
 
-	w.Header().Add(headerAccessControlAllowOrigin, "*")
-	w.Header().Add(headerAccessControlAllowMethods, "GET, PUT, POST, PATCH, DELETE")
-	w.Header().Add(headerAccessControlAllowHeaders, "Content-Type, Authorization")
-	w.Header().Add(headerAccessControlExposeHeaders, "Authorization")
-	w.Header().Add(headerAccessControlMaxAge, "600")
+	origin := r.Header.Get(headerOrigin)
+	// Requests without an Origin header are not cross-origin.
+	if len(origin) == 0 {
+		ch.Handler.ServeHTTP(w, r)
+		return
+	}
 
-	// If this is preflight request, the method will
-	// be OPTIONS, so call the real handler only if
-	// the method is something else.
-	if r.Method != "OPTIONS" {
+	allowed := ch.Policy.AllowsOrigin(origin)
+	preflight := r.Method == "OPTIONS" && len(r.Header.Get(headerAccessControlRequestMethod)) != 0
+	if !allowed {
+		if preflight || isWebSocketUpgrade(r) {
+			http.Error(w, fmt.Sprintf("origin %s is not allowed", origin), http.StatusForbidden)
+			return
+		}
+		// Without CORS headers, the browser won't let the page read the response.
 		ch.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if ch.Policy.AllowCredentials || !ch.hasAnyOrigin() {
+		w.Header().Set(headerAccessControlAllowOrigin, origin)
+	} else {
+		w.Header().Set(headerAccessControlAllowOrigin, "*")
+	}
+	if ch.Policy.AllowCredentials {
+		w.Header().Set(headerAccessControlAllowCredentials, "true")
+	}
+
+	// If this is preflight request, check the method and headers
+	// the real request is going to use, and answer it right away.
+	if preflight {
+		methods, headers := ch.Policy.route(r.URL.Path)
+		if method := r.Header.Get(headerAccessControlRequestMethod); !containsFold(methods, method) {
+			http.Error(w, fmt.Sprintf("method %s is not allowed", method), http.StatusForbidden)
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get(headerAccessControlRequestHeaders), ",") {
+			if header = strings.TrimSpace(header); len(header) != 0 && !containsFold(headers, header) {
+				http.Error(w, fmt.Sprintf("header %s is not allowed", header), http.StatusForbidden)
+				return
+			}
+		}
+		w.Header().Set(headerAccessControlAllowMethods, strings.Join(methods, ", "))
+		w.Header().Set(headerAccessControlAllowHeaders, strings.Join(headers, ", "))
+		w.Header().Set(headerAccessControlMaxAge, strconv.Itoa(ch.Policy.MaxAge))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(ch.Policy.ExposedHeaders) != 0 {
+		w.Header().Set(headerAccessControlExposeHeaders, strings.Join(ch.Policy.ExposedHeaders, ", "))
+	}
+	ch.Handler.ServeHTTP(w, r)
+}
+
+// hasAnyOrigin reports whether the policy allows any origin.
+func (ch *CORSHandler) hasAnyOrigin() bool {
+	return containsFold(ch.Policy.AllowedOrigins, "*")
+}
+
+// containsFold reports whether values contains value, ignoring case.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
 	}
+	return false
 }
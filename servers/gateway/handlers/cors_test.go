@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	policy := &CORSPolicy{AllowedOrigins: []string{"https://info-344.zicodeng.me", "https://*.example.com"}}
+
+	cases := []struct {
+		origin        string
+		expectAllowed bool
+	}{
+		{"https://info-344.zicodeng.me", true},
+		{"HTTPS://INFO-344.ZICODENG.ME", true},
+		{"http://info-344.zicodeng.me", false},
+		{"https://evil.me", false},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://evil.me/.example.com", false},
+		{"https://evilexample.com", false},
+	}
+
+	for _, c := range cases {
+		if allowed := policy.AllowsOrigin(c.origin); allowed != c.expectAllowed {
+			t.Errorf("case %s: expected allowed to be %t but got %t", c.origin, c.expectAllowed, allowed)
+		}
+	}
+}
+
+func TestParseCORSPolicy(t *testing.T) {
+	policy, err := ParseCORSPolicy([]byte(`{"allowedOrigins":["https://info-344.zicodeng.me"],"allowCredentials":true}`))
+	if err != nil {
+		t.Fatalf("error parsing CORS policy: %v", err)
+	}
+	if !policy.AllowCredentials || len(policy.AllowedMethods) == 0 {
+		t.Errorf("expected fields left out to keep their defaults but got %+v", policy)
+	}
+
+	for _, invalid := range []string{
+		`{"allowedOrigins":["*"],"allowCredentials":true}`,
+		`{"allowedOrigins":["info-344.zicodeng.me"]}`,
+		`{"allowedOrigins":["https://*.*.example.com"]}`,
+		`{"routes":{"v1/users":{}}}`,
+		`allowedOrigins`,
+	} {
+		if _, err := ParseCORSPolicy([]byte(invalid)); err == nil {
+			t.Errorf("expected error parsing %s", invalid)
+		}
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	policy, _ := ParseCORSPolicy([]byte(`{
+		"allowedOrigins": ["https://info-344.zicodeng.me"],
+		"allowCredentials": true,
+		"routes": {"/v1/admin/": {"allowedMethods": ["GET"]}}
+	}`))
+	handler := NewCORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), policy)
+	anyOrigin := NewCORSHandler(http.NotFoundHandler(), DefaultCORSPolicy())
+
+	cases := []struct {
+		name                string
+		handler             http.Handler
+		method              string
+		path                string
+		origin              string
+		requestMethod       string
+		requestHeaders      string
+		upgrade             bool
+		expectedStatus      int
+		expectedAllowOrigin string
+	}{
+		{
+			"Same Origin",
+			handler, "GET", "/v1/users", "", "", "", false,
+			http.StatusTeapot, "",
+		},
+		{
+			"Allowed Origin",
+			handler, "GET", "/v1/users", "https://info-344.zicodeng.me", "", "", false,
+			http.StatusTeapot, "https://info-344.zicodeng.me",
+		},
+		{
+			"Other Origin",
+			handler, "GET", "/v1/users", "https://evil.me", "", "", false,
+			http.StatusTeapot, "",
+		},
+		{
+			"Preflight",
+			handler, "OPTIONS", "/v1/users", "https://info-344.zicodeng.me", "PATCH", "Content-Type, authorization", false,
+			http.StatusNoContent, "https://info-344.zicodeng.me",
+		},
+		{
+			"Preflight From Other Origin",
+			handler, "OPTIONS", "/v1/users", "https://evil.me", "GET", "", false,
+			http.StatusForbidden, "",
+		},
+		{
+			"Preflight With Disallowed Header",
+			handler, "OPTIONS", "/v1/users", "https://info-344.zicodeng.me", "GET", "X-User", false,
+			http.StatusForbidden, "https://info-344.zicodeng.me",
+		},
+		{
+			"Preflight With Method Disallowed On Route",
+			handler, "OPTIONS", "/v1/admin/services", "https://info-344.zicodeng.me", "DELETE", "", false,
+			http.StatusForbidden, "https://info-344.zicodeng.me",
+		},
+		{
+			"WebSocket From Other Origin",
+			handler, "GET", "/v1/ws", "https://evil.me", "", "", true,
+			http.StatusForbidden, "",
+		},
+		{
+			"Any Origin Without Credentials",
+			anyOrigin, "GET", "/v1/users", "https://evil.me", "", "", false,
+			http.StatusNotFound, "*",
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if len(c.origin) != 0 {
+			r.Header.Set(headerOrigin, c.origin)
+		}
+		if len(c.requestMethod) != 0 {
+			r.Header.Set(headerAccessControlRequestMethod, c.requestMethod)
+		}
+		if len(c.requestHeaders) != 0 {
+			r.Header.Set(headerAccessControlRequestHeaders, c.requestHeaders)
+		}
+		if c.upgrade {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+		}
+		resp := httptest.NewRecorder()
+		c.handler.ServeHTTP(resp, r)
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+		}
+		if allowOrigin := resp.Header().Get(headerAccessControlAllowOrigin); allowOrigin != c.expectedAllowOrigin {
+			t.Errorf("case %s: incorrect allowed origin: expected %q but got %q", c.name, c.expectedAllowOrigin, allowOrigin)
+		}
+		credentials := resp.Header().Get(headerAccessControlAllowCredentials) == "true"
+		if credentials != (c.handler == handler && len(c.expectedAllowOrigin) != 0) {
+			t.Errorf("case %s: expected credentials to be allowed only for allowed origins", c.name)
+		}
+	}
+}
@@ -1,21 +1,36 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/identity"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
-	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ServiceList contains a list of services.
 type ServiceList struct {
 	services map[string]*service
-	mx       sync.RWMutex
+	// allowlist, if not nil, limits which microservices may register,
+	// and which paths they may claim.
+	allowlist Allowlist
+	// reserved are the path prefixes the gateway serves itself,
+	// which no microservice may claim.
+	reserved []string
+	// routes holds the same services in the order
+	// requests are matched against their routes.
+	routes []*service
+	mx     sync.RWMutex
 }
 
 // NewServiceList creates a new ServiceList.
@@ -28,26 +43,104 @@ func NewServiceList() *ServiceList {
 // service represents any microservice our gateway
 // will be received from Redis "microservice" channel.
 type service struct {
-	name              string
-	pathPatternRegexp *regexp.Regexp
-	heartbeat         int // The microservice's normal heartbeat.
+	name      string
+	route     *route
+	heartbeat int // The microservice's normal heartbeat.
+	// healthPath is the resource path active health probes request.
+	healthPath string
 	// The key of the instances map is this instance's unique address.
 	instances map[string]*serviceInstance
-	proxy     *httputil.ReverseProxy
+	// pinned services only send requests to their pinned instances.
+	// Other services only fall back to their static instances
+	// when no discovered instance is available.
+	pinned bool
+	// strategy is the load balancing strategy balancer implements.
+	strategy string
+	balancer balancer
+	// policy says how requests are sent to the instances.
+	policy callPolicy
+	proxy  *httputil.ReverseProxy
 }
 
 // newService creates a new microservice.
+// Unknown load balancing strategies fall back to round-robin.
 func newService(
 	name string,
-	pathPatternRegexp *regexp.Regexp,
+	route *route,
 	heartbeat int,
+	healthPath string,
+	strategy string,
 	instances map[string]*serviceInstance) *service {
-	addrs := []string{}
-	for addr := range instances {
-		addrs = append(addrs, addr)
+	if len(healthPath) == 0 {
+		healthPath = "/"
 	}
-	proxy := newServiceProxy(addrs)
-	return &service{name, pathPatternRegexp, heartbeat, instances, proxy}
+	svc := &service{
+		name:       name,
+		route:      route,
+		heartbeat:  heartbeat,
+		healthPath: healthPath,
+		instances:  instances,
+	}
+	svc.setStrategy(strategy)
+	svc.proxy = newServiceProxy(svc)
+	return svc
+}
+
+// setStrategy switches the service to the given load balancing strategy.
+// Callers must hold a write lock on the ServiceList.
+func (svc *service) setStrategy(strategy string) {
+	b, found := newBalancer(strategy)
+	if !found {
+		log.Printf("Microservice %s: unknown load balancing strategy %s, using %s instead", svc.name, strategy, StrategyRoundRobin)
+		b, _ = newBalancer(StrategyRoundRobin)
+	}
+	svc.strategy = strategy
+	svc.balancer = b
+}
+
+// pick picks the instance a request with the given key goes to,
+// skipping excluded and draining instances, and instances whose circuit breaker
+// does not let requests through.
+// Discovered instances are tried before static ones,
+// and pinned services only use their pinned instances.
+// It returns nil if no instance is available.
+// Callers must hold at least a read lock on the ServiceList.
+func (svc *service) pick(key string, exclude ...*serviceInstance) *serviceInstance {
+	// Pick from the instances we know about right now,
+	// sorted so that balancers see them in a stable order.
+	preferred := []*serviceInstance{}
+	fallback := []*serviceInstance{}
+instances:
+	for _, instance := range svc.instances {
+		if instance.draining {
+			continue
+		}
+		for _, excluded := range exclude {
+			if instance == excluded {
+				continue instances
+			}
+		}
+		if svc.pinned {
+			if instance.pinned {
+				preferred = append(preferred, instance)
+			}
+		} else if instance.static {
+			fallback = append(fallback, instance)
+		} else {
+			preferred = append(preferred, instance)
+		}
+	}
+	for _, instances := range [][]*serviceInstance{preferred, fallback} {
+		sort.Slice(instances, func(i, j int) bool {
+			return instances[i].address < instances[j].address
+		})
+		for _, instance := range svc.balancer.order(instances, key) {
+			if instance.breaker.allow() {
+				return instance
+			}
+		}
+	}
+	return nil
 }
 
 // serviceInstance is an instance of a given microservice.
@@ -55,25 +148,152 @@ func newService(
 type serviceInstance struct {
 	address       string
 	lastHeartbeat time.Time
+	// weight is the share of requests this instance gets
+	// relative to the others, with the weighted strategy.
+	weight int
+	// outstanding is the number of requests in flight to this instance.
+	// It must be accessed atomically.
+	outstanding int64
+	// static instances were configured rather than discovered,
+	// and never expire.
+	static bool
+	// pinned instances are the only ones a pinned service sends requests to.
+	// Like static instances, they never expire.
+	pinned bool
+	// pinAdded instances were added by pinning the service,
+	// and are removed again when it is unpinned.
+	pinAdded bool
+	// draining instances get no new requests.
+	draining bool
+	// breaker stops traffic to this instance while it keeps failing.
+	breaker *circuitBreaker
+}
+
+// configured reports whether the instance was configured by operators,
+// as a static or pinned instance, and so never expires.
+func (instance *serviceInstance) configured() bool {
+	return instance.static || instance.pinned
 }
 
 // newServiceInstance creates a new microservice instance.
-func newServiceInstance(addr string, lastHeartbeat time.Time) *serviceInstance {
-	return &serviceInstance{addr, lastHeartbeat}
+func newServiceInstance(addr string, lastHeartbeat time.Time, weight int) *serviceInstance {
+	return &serviceInstance{
+		address:       addr,
+		lastHeartbeat: lastHeartbeat,
+		weight:        weight,
+		breaker:       newCircuitBreaker(breakerCooldown),
+	}
 }
 
+// Types of microservice announcements.
+const (
+	// AnnouncementHeartbeat registers an instance,
+	// or tells the gateway it is still alive.
+	// Announcements without a type are heartbeats.
+	AnnouncementHeartbeat = "heartbeat"
+	// AnnouncementLeaving tells the gateway an instance is shutting down,
+	// so that it stops getting requests right away.
+	AnnouncementLeaving = "leaving"
+)
+
 // ReceivedService represents microservice information received from Redis Pub/Sub.
 type ReceivedService struct {
-	Name        string
+	// Type is the type of the announcement,
+	// AnnouncementHeartbeat or AnnouncementLeaving.
+	// Leaving announcements only need a Name and an Address.
+	Type string
+	Name string
+	// PathPattern is a regular expression
+	// the resource path of requests must match.
 	PathPattern string
-	Address     string
-	Heartbeat   int
+	// PathPrefix is a prefix the resource path of requests must begin with.
+	// A microservice may announce a PathPattern, a PathPrefix, or both.
+	PathPrefix string
+	// Priority decides between microservices whose routes match the same path:
+	// the highest priority wins, then the longest literal path prefix.
+	Priority int
+	// Methods are the HTTP methods the microservice accepts.
+	// It accepts any method if there are none.
+	Methods   []string
+	Address   string
+	Heartbeat int
+	// HealthPath is the resource path the gateway requests
+	// to check if an instance is healthy.
+	// Any response other than a 5xx counts as healthy.
+	// It defaults to "/".
+	HealthPath string
+	// LoadBalancing is the strategy used to balance requests
+	// between the instances of the microservice:
+	// "round-robin" (the default), "least-outstanding",
+	// "weighted", or "consistent-hash", which sends all requests
+	// of a user to the same instance.
+	LoadBalancing string
+	// Weight is the share of requests this instance gets
+	// with the weighted strategy. It defaults to 1.
+	Weight int
+	// TimeoutMillis is how long the gateway waits for the microservice
+	// to answer a request, in milliseconds, across all retries.
+	// It defaults to no timeout.
+	TimeoutMillis int
+	// Retries is how many other instances the gateway tries
+	// when a GET or HEAD request fails to connect or gets a 503.
+	// It defaults to 0.
+	Retries int
+	// HedgeAfterMillis is how long the gateway waits for an instance
+	// to answer a GET or HEAD request, in milliseconds,
+	// before it uses up a retry sending the request to another instance as well.
+	// The first answer wins. It defaults to no hedging.
+	HedgeAfterMillis int
+}
+
+// SetAllowlist limits which microservices may register,
+// and which paths they may claim, from now on.
+// A nil allowlist lets any microservice claim any path.
+func (serviceList *ServiceList) SetAllowlist(allowlist Allowlist) {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	serviceList.allowlist = allowlist
+}
+
+// Reserve keeps the given path prefixes, and everything below them,
+// for the gateway's own handlers,
+// so that no microservice can take requests for them.
+func (serviceList *ServiceList) Reserve(prefixes ...string) {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	serviceList.reserved = append(serviceList.reserved, prefixes...)
 }
 
 // Register either registers a new microservice if it doesn't exist,
 // or register a new microservice instance if that microservice already exists in the list.
-func (serviceList *ServiceList) Register(receivedSvc *ReceivedService) {
+// A leaving announcement removes the instance instead.
+// It returns an error without registering anything
+// if the announcement is invalid or not allowed.
+func (serviceList *ServiceList) Register(receivedSvc *ReceivedService) error {
+	if err := receivedSvc.Validate(); err != nil {
+		return fmt.Errorf("invalid announcement of microservice %s: %v", receivedSvc.Name, err)
+	}
+	if receivedSvc.Type == AnnouncementLeaving {
+		serviceList.leave(receivedSvc.Name, receivedSvc.Address)
+		return nil
+	}
+	weight := receivedSvc.Weight
+	if weight <= 0 {
+		weight = 1
+	}
 	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	claims, err := serviceList.allowlist.claims(receivedSvc)
+	if err != nil {
+		return err
+	}
+	if len(receivedSvc.PathPrefix) != 0 && hasAnyPrefix(receivedSvc.PathPrefix, serviceList.reserved) {
+		return fmt.Errorf("microservice %s is not allowed to claim path prefix %s, which the gateway serves", receivedSvc.Name, receivedSvc.PathPrefix)
+	}
+	rt, err := newRoute(receivedSvc, claims)
+	if err != nil {
+		return fmt.Errorf("invalid announcement of microservice %s: %v", receivedSvc.Name, err)
+	}
 	svc, hasSvc := serviceList.services[receivedSvc.Name]
 	// If this microservice is already in our list...
 	if hasSvc {
@@ -83,10 +303,30 @@ func (serviceList *ServiceList) Register(receivedSvc *ReceivedService) {
 			// If this microservice instance is in our list,
 			// update its lastHeartbeat time field.
 			instance.lastHeartbeat = time.Now()
+			instance.weight = weight
+			// It was discovered, so unpinning should keep it.
+			instance.pinAdded = false
 		} else {
 			// If not, add this instance to our list.
 			log.Printf("Microservice %s: new instance with address %s found\n", receivedSvc.Name, receivedSvc.Address)
-			svc.instances[receivedSvc.Address] = newServiceInstance(receivedSvc.Address, time.Now())
+			svc.instances[receivedSvc.Address] = newServiceInstance(receivedSvc.Address, time.Now(), weight)
+		}
+		// Follow the microservice if it changes its route.
+		if !rt.equal(svc.route) {
+			log.Printf("Microservice %s: route changed\n", receivedSvc.Name)
+			svc.route = rt
+			serviceList.sortRoutes()
+			serviceList.logConflicts(svc)
+		}
+		// Follow the microservice if it changes how it wants to be called.
+		if policy := newCallPolicy(receivedSvc); policy != svc.policy {
+			log.Printf("Microservice %s: call policy changed to %+v\n", receivedSvc.Name, policy)
+			svc.policy = policy
+		}
+		// Follow the microservice if it switches load balancing strategy.
+		if receivedSvc.LoadBalancing != svc.strategy {
+			log.Printf("Microservice %s: load balancing strategy changed to %s\n", receivedSvc.Name, receivedSvc.LoadBalancing)
+			svc.setStrategy(receivedSvc.LoadBalancing)
 		}
 	} else {
 		// If this microservice is not in our list,
@@ -95,15 +335,36 @@ func (serviceList *ServiceList) Register(receivedSvc *ReceivedService) {
 		log.Printf("New microservice %s found\n", receivedSvc.Name)
 		log.Printf("Microservice %s: new instance with address %s found\n", receivedSvc.Name, receivedSvc.Address)
 		instances := make(map[string]*serviceInstance)
-		instances[receivedSvc.Address] = newServiceInstance(receivedSvc.Address, time.Now())
-		serviceList.services[receivedSvc.Name] = newService(
+		instances[receivedSvc.Address] = newServiceInstance(receivedSvc.Address, time.Now(), weight)
+		svc := newService(
 			receivedSvc.Name,
-			regexp.MustCompile(receivedSvc.PathPattern),
+			rt,
 			receivedSvc.Heartbeat,
+			receivedSvc.HealthPath,
+			receivedSvc.LoadBalancing,
 			instances,
 		)
+		svc.policy = newCallPolicy(receivedSvc)
+		serviceList.services[receivedSvc.Name] = svc
+		serviceList.sortRoutes()
+		serviceList.logConflicts(svc)
+	}
+	return nil
+}
+
+// leave removes a discovered instance that is shutting down,
+// rather than waiting for its heartbeats to be missed.
+// Requests already in flight to the instance are not affected.
+// Static and pinned instances are left alone, since they were not discovered.
+func (serviceList *ServiceList) leave(name string, addr string) {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	instance, err := serviceList.instance(name, addr)
+	if err != nil || instance.configured() {
+		return
 	}
-	serviceList.mx.Unlock()
+	log.Printf("Microservice %s: leaving instance with address %s removed", name, addr)
+	serviceList.removeInstance(name, addr)
 }
 
 // Remove either removes a dangling microservice if it does not have any active instance running,
@@ -118,7 +379,7 @@ func (serviceList *ServiceList) Remove() {
 
 	for svcName, svc := range serviceList.services {
 		for addr, instance := range svc.instances {
-			if time.Now().Sub(instance.lastHeartbeat).Seconds() > float64(svc.heartbeat)+10 {
+			if !instance.configured() && time.Now().Sub(instance.lastHeartbeat).Seconds() > float64(svc.heartbeat)+10 {
 				log.Printf("Microservice %s: crashed instance with address %s removed", svcName, addr)
 				// Remove the crashed microservice instance from the service list.
 				delete(svc.instances, addr)
@@ -127,88 +388,286 @@ func (serviceList *ServiceList) Remove() {
 				if len(svc.instances) == 0 {
 					log.Printf("Dangling microservice %s removed\n", svcName)
 					delete(serviceList.services, svcName)
+					serviceList.sortRoutes()
 				}
 			}
 		}
 	}
 }
 
+// ProbeTimeout is how long an instance has to answer a health probe.
+const ProbeTimeout = time.Second * 2
+
+// Probe sends a health probe to every microservice instance,
+// and reports the outcome to the instance's circuit breaker.
+// Instances are probed concurrently, and Probe returns once all have answered.
+func (serviceList *ServiceList) Probe(client *http.Client) {
+	type probeTarget struct {
+		svcName  string
+		url      string
+		instance *serviceInstance
+	}
+	targets := []*probeTarget{}
+	serviceList.mx.RLock()
+	for svcName, svc := range serviceList.services {
+		for addr, instance := range svc.instances {
+			targets = append(targets, &probeTarget{svcName, "http://" + addr + svc.healthPath, instance})
+		}
+	}
+	serviceList.mx.RUnlock()
+
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *probeTarget) {
+			defer wg.Done()
+			healthy := false
+			resp, err := client.Get(target.url)
+			if err == nil {
+				resp.Body.Close()
+				healthy = resp.StatusCode < 500
+			}
+			if target.instance.breaker.probed(healthy) {
+				log.Printf("Microservice %s: instance with address %s ejected after failing health probe", target.svcName, target.instance.address)
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
 // DSDHandler is a dynamic service discovery middleware handler
 // that checks the requested resource path
-// against the pathPattern properties of the services field.
+// against the routes of the services field.
 type DSDHandler struct {
 	handler     http.Handler
 	serviceList *ServiceList
 	ctx         *HandlerContext
+	// identityKey signs the identity tokens forwarded to microservices.
+	identityKey string
+	// webSockets tracks the WebSocket connections proxied to microservices.
+	webSockets *wsSplices
 }
 
 // NewDSDHandler wraps another handler into DSDHandler.
-func NewDSDHandler(handlerToWrap http.Handler, serviceList *ServiceList, ctx *HandlerContext) *DSDHandler {
-	return &DSDHandler{handlerToWrap, serviceList, ctx}
+// Requests forwarded to microservices carry an identity token signed with identityKey.
+func NewDSDHandler(handlerToWrap http.Handler, serviceList *ServiceList, ctx *HandlerContext, identityKey string) *DSDHandler {
+	if len(identityKey) == 0 {
+		panic("identity key has length of zero")
+	}
+	return &DSDHandler{handlerToWrap, serviceList, ctx, identityKey, newWSSplices()}
+}
+
+// CloseWebSockets closes every WebSocket connection proxied to microservices
+// with a "going away" close frame, and refuses new ones from then on.
+// It waits for the connections to be closed, until ctx is done.
+func (dsdh *DSDHandler) CloseWebSockets(ctx context.Context) error {
+	return dsdh.webSockets.close(ctx)
+}
+
+// channelsPath is the path prefix of the channels
+// served by the messaging microservice.
+const channelsPath = "/v1/channels/"
+
+// CanSeeChannel implements the ChannelAuthorizer interface for the DSDHandler.
+// The microservice serving the channel decides,
+// by whether it lets the user read the channel.
+// It only asks for the headers, so that the messages are not sent along,
+// and passes on the request ID and trace of ctx.
+func (dsdh *DSDHandler) CanSeeChannel(ctx context.Context, userID bson.ObjectId, channelID string) (bool, error) {
+	req, err := http.NewRequest("HEAD", channelsPath+channelID, nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating channel request: %v", err)
+	}
+	dsdh.serviceList.mx.RLock()
+	svc, _ := dsdh.serviceList.match(req.Method, req.URL.Path)
+	var instance *serviceInstance
+	if svc != nil {
+		instance = svc.pick(userID.Hex())
+	}
+	dsdh.serviceList.mx.RUnlock()
+	if svc == nil {
+		return false, fmt.Errorf("no microservice serves %s", req.URL.Path)
+	}
+	if instance == nil {
+		return false, fmt.Errorf("no healthy instance of microservice %s available", svc.name)
+	}
+
+	token, err := identity.Sign(userID.Hex(), nil, dsdh.identityKey, identity.DefaultTTL)
+	if err != nil {
+		return false, fmt.Errorf("error signing identity token: %v", err)
+	}
+	req.Header.Set(identity.HeaderToken, token)
+	requestID := accesslog.FromContext(ctx).RequestID
+	if len(requestID) != 0 {
+		req.Header.Set(accesslog.HeaderRequestID, requestID)
+	}
+	// The proxy records the instance it reached in the access log entry,
+	// which belongs to the request ctx came from rather than to this one.
+	ctx = accesslog.WithEntry(ctx, &accesslog.Entry{RequestID: requestID})
+	// Send the request the way the proxy would,
+	// so that it gets the service's call policy and circuit breakers.
+	call := &proxyCall{
+		serviceList: dsdh.serviceList,
+		svc:         svc,
+		key:         userID.Hex(),
+		instance:    instance,
+	}
+	req = req.WithContext(context.WithValue(ctx, callKey, call))
+	req.URL.Scheme = "http"
+	req.URL.Host = instance.address
+	resp, err := svc.proxy.Transport.RoundTrip(req)
+	if err != nil {
+		return false, fmt.Errorf("error reaching microservice %s: %v", svc.name, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("microservice %s responded with status code %d", svc.name, resp.StatusCode)
+	}
 }
 
 // ServeHTTP is a method of DSDHandler.
 // Now our DSDHandler is a http.Handler.
 func (dsdh *DSDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Validate the user.
-	user := dsdh.getCurrentUser(r)
+	user := dsdh.ctx.currentUser(r)
+	entry := accesslog.FromContext(r.Context())
 	if user != nil {
-		userJSON, err := json.Marshal(user)
-		if err != nil {
-			log.Printf("error marshaling user: %v", err)
-		}
-		r.Header.Add("X-User", string(userJSON))
-	} else {
-		// If there is no user found,
-		// explicitly remove X-User header to
-		// prevent a hacker who tries to sneak in
-		// by setting a fake X-User header in the request.
-		r.Header.Del("X-User")
+		entry.UserID = user.ID.Hex()
+	}
+	// The key consistent hashing balances requests by:
+	// the user if there is one, or else the client's address.
+	balanceKey := clientIP(r)
+	if user != nil {
+		balanceKey = user.ID.Hex()
 	}
 
-	// Use the received microservice path pattern
+	// Use the received microservice routes
 	// to determine which microservice should this requset
 	// be forwarded to.
 	dsdh.serviceList.mx.RLock()
-	for _, svc := range dsdh.serviceList.services {
-		pattern := svc.pathPatternRegexp
-		if pattern.MatchString(r.URL.Path) {
-			dsdh.serviceList.mx.RUnlock()
-			svc.proxy.ServeHTTP(w, r)
-			// Return this function if we find a match,
-			// and request is routed to our microservice.
+	svc, allowed := dsdh.serviceList.match(r.Method, r.URL.Path)
+	if svc != nil {
+		instance := svc.pick(balanceKey)
+		dsdh.serviceList.mx.RUnlock()
+		entry.Service = svc.name
+		if instance == nil {
+			respondWithGatewayError(w, &GatewayError{
+				Status:  http.StatusServiceUnavailable,
+				Code:    GatewayErrorUnavailable,
+				Message: fmt.Sprintf("no healthy instance of microservice %s available", svc.name),
+				Service: svc.name,
+			})
+			return
+		}
+		// Tell the microservice who the user is with a signed token,
+		// so that it can trust the identity came from us.
+		// Anonymous requests get a token too,
+		// proving they came through the gateway.
+		if err := dsdh.setIdentity(r, user); err != nil {
+			// The instance was picked but never tried.
+			instance.breaker.abandon()
+			http.Error(w, fmt.Sprintf("error signing identity token: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if isWebSocketUpgrade(r) {
+			entry.Instance = instance.address
+			entry.Attempts = 1
+			// WebSocket connections count as outstanding for as long as they are open.
+			atomic.AddInt64(&instance.outstanding, 1)
+			svc.proxyWebSocket(w, r, instance, dsdh.webSockets)
+			atomic.AddInt64(&instance.outstanding, -1)
+		} else {
+			// Let the proxy know which instance it is forwarding to first,
+			// and how to pick another.
+			call := &proxyCall{
+				serviceList: dsdh.serviceList,
+				svc:         svc,
+				key:         balanceKey,
+				instance:    instance,
+			}
+			svc.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callKey, call)))
+		}
+		// Return this function if we find a match,
+		// and request is routed to our microservice.
+		return
 	}
 	dsdh.serviceList.mx.RUnlock()
 
+	// If microservices handle this path, but not with this method,
+	// tell the client which methods they do handle.
+	if len(allowed) != 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, fmt.Sprintf("expect %s method only", strings.Join(allowed, " or ")), http.StatusMethodNotAllowed)
+		return
+	}
+
 	// If no match is found,
 	// it means this request should not be forwarded to any microservices,
 	// just call our real handler to handle it.
 	dsdh.handler.ServeHTTP(w, r)
 }
 
+// contextKey is the type of keys of values
+// the gateway puts in request contexts.
+type contextKey string
+
 // newServiceProxy forwards relevant requests to microservices based on resource path.
 // The microservices should have corresponding handlers that can handle those requests.
-func newServiceProxy(addrs []string) *httputil.ReverseProxy {
-	i := 0
-	mutex := sync.Mutex{}
+// Requests are sent to the instances by a serviceTransport,
+// which retries and times them out according to the service's call policy.
+// Requests no instance answers get a GatewayError.
+func newServiceProxy(svc *service) *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
-			mutex.Lock()
-			r.URL.Host = addrs[i%len(addrs)]
-			i++
-			mutex.Unlock()
+			call := r.Context().Value(callKey).(*proxyCall)
+			r.URL.Host = call.instance.address
 			r.URL.Scheme = "http"
 		},
+		Transport: &serviceTransport{svc, http.DefaultTransport},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			call := r.Context().Value(callKey).(*proxyCall)
+			gatewayErr := &GatewayError{
+				Status:   http.StatusBadGateway,
+				Code:     GatewayErrorUnreachable,
+				Message:  fmt.Sprintf("error reaching microservice %s: %v", svc.name, err),
+				Service:  svc.name,
+				Attempts: call.attempts,
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				gatewayErr.Status = http.StatusGatewayTimeout
+				gatewayErr.Code = GatewayErrorTimeout
+				gatewayErr.Message = fmt.Sprintf("microservice %s did not respond in time", svc.name)
+			}
+			respondWithGatewayError(w, gatewayErr)
+		},
 	}
 }
 
-func (dsdh *DSDHandler) getCurrentUser(r *http.Request) *users.User {
-	sessionState := &SessionState{}
-	_, err := sessions.GetState(r, dsdh.ctx.SigningKey, dsdh.ctx.SessionStore, sessionState)
+// setIdentity replaces any identity headers the client set
+// with an identity token for user, which is nil for anonymous requests.
+func (dsdh *DSDHandler) setIdentity(r *http.Request, user *users.User) error {
+	// Explicitly remove the old X-User header as well,
+	// to prevent a hacker who tries to sneak in
+	// by setting a fake one in the request.
+	r.Header.Del("X-User")
+	r.Header.Del(identity.HeaderToken)
+	// Leave claimsUser nil rather than a nil *users.User,
+	// so that anonymous tokens carry no user.
+	userID := ""
+	var claimsUser interface{}
+	if user != nil {
+		userID = user.ID.Hex()
+		claimsUser = user
+	}
+	token, err := identity.Sign(userID, claimsUser, dsdh.identityKey, identity.DefaultTTL)
 	if err != nil {
-		return nil
+		return err
 	}
-	return sessionState.User
+	r.Header.Set(identity.HeaderToken, token)
+	return nil
 }
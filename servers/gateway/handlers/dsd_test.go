@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/identity"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testIdentityKey signs the identity tokens of test DSDHandlers.
+const testIdentityKey = "test identity key"
+
+// newTestDSDHandler constructs a DSDHandler over serviceList,
+// falling back to a handler that responds with 404.
+func newTestDSDHandler(serviceList *ServiceList) *DSDHandler {
+	ctx := &HandlerContext{
+		SigningKey:   "test key",
+		SessionStore: sessions.NewMemStore(time.Hour, time.Minute),
+	}
+	return NewDSDHandler(http.NotFoundHandler(), serviceList, ctx, testIdentityKey)
+}
+
+// newTestService starts a microservice instance responding with status.
+func newTestService(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+}
+
+func TestDSDHandlerEjectsFailingInstance(t *testing.T) {
+	healthy := newTestService(http.StatusOK)
+	defer healthy.Close()
+	failing := newTestService(http.StatusInternalServerError)
+	defer failing.Close()
+	// An instance whose address nothing listens on.
+	dead := newTestService(http.StatusOK)
+	dead.Close()
+
+	serviceList := NewServiceList()
+	for _, srv := range []*httptest.Server{healthy, failing, dead} {
+		serviceList.Register(&ReceivedService{
+			Name:        "test",
+			PathPattern: "^/v1/test",
+			Address:     strings.TrimPrefix(srv.URL, "http://"),
+			Heartbeat:   10,
+		})
+	}
+	handler := newTestDSDHandler(serviceList)
+
+	// Every instance gets its share of requests
+	// until the failing ones are ejected.
+	for i := 0; i < failureThreshold*3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/test", nil))
+	}
+	for i := 0; i < 10; i++ {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/test", nil))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected only the healthy instance to receive requests, but got status code %d", resp.Code)
+		}
+	}
+
+	// Once every instance is ejected, requests are refused right away.
+	healthy.Close()
+	for i := 0; i < failureThreshold; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/test", nil))
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/test", nil))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d without healthy instances but got %d", http.StatusServiceUnavailable, resp.Code)
+	}
+}
+
+func TestDSDHandlerForwardsIdentity(t *testing.T) {
+	// The microservice verifies the identity token of every request.
+	claimsQ := make(chan *identity.Claims, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("X-User")) != 0 {
+			t.Errorf("expected X-User header to be removed")
+		}
+		claims, err := identity.VerifyRequest(r, testIdentityKey)
+		if err != nil {
+			t.Errorf("error verifying identity token: %v", err)
+		}
+		claimsQ <- claims
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     strings.TrimPrefix(srv.URL, "http://"),
+		Heartbeat:   10,
+	})
+	handler := newTestDSDHandler(serviceList)
+
+	// Sign in a user.
+	user := &users.User{ID: bson.NewObjectId(), UserName: "alice"}
+	signIn := httptest.NewRecorder()
+	if _, err := sessions.BeginSession(handler.ctx.SigningKey, handler.ctx.SessionStore, &SessionState{time.Now(), user}, signIn); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		auth           string
+		expectedUserID string
+	}{
+		{
+			"Authenticated User",
+			signIn.Header().Get(headerAuthorization),
+			user.ID.Hex(),
+		},
+		{
+			"Anonymous User",
+			"",
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/v1/test", nil)
+		if len(c.auth) != 0 {
+			r.Header.Set(headerAuthorization, c.auth)
+		}
+		// Clients can't claim to be someone else.
+		r.Header.Set("X-User", `{"id":"`+bson.NewObjectId().Hex()+`"}`)
+		r.Header.Set(identity.HeaderToken, "forged")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		claims := <-claimsQ
+		if claims == nil {
+			continue
+		}
+		if claims.UserID != c.expectedUserID {
+			t.Errorf("case %s: incorrect user ID: expected %q but got %q", c.name, c.expectedUserID, claims.UserID)
+		}
+		if (len(claims.User) == 0) != (len(c.expectedUserID) == 0) {
+			t.Errorf("case %s: incorrect user in claims: %s", c.name, claims.User)
+		}
+	}
+}
+
+func TestDSDHandlerAccessLog(t *testing.T) {
+	// The microservice gets the request ID the gateway logs.
+	requestIDQ := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDQ <- r.Header.Get(accesslog.HeaderRequestID)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     addr,
+		Heartbeat:   10,
+	})
+	dsdh := newTestDSDHandler(serviceList)
+
+	// Sign in a user.
+	user := &users.User{ID: bson.NewObjectId(), UserName: "alice"}
+	signIn := httptest.NewRecorder()
+	if _, err := sessions.BeginSession(dsdh.ctx.SigningKey, dsdh.ctx.SessionStore, &SessionState{time.Now(), user}, signIn); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	handler := accesslog.NewHandler(dsdh, accesslog.NewLogger(buf))
+	r := httptest.NewRequest("GET", "/v1/test", nil)
+	r.Header.Set(headerAuthorization, signIn.Header().Get(headerAuthorization))
+	r.Header.Set(accesslog.HeaderRequestID, "test-request")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if requestID := <-requestIDQ; requestID != "test-request" {
+		t.Errorf("incorrect request ID forwarded: expected test-request but got %s", requestID)
+	}
+	entry := &accesslog.Entry{}
+	if err := json.Unmarshal(buf.Bytes(), entry); err != nil {
+		t.Fatalf("error unmarshalling log entry %q: %v", buf.String(), err)
+	}
+	if entry.RequestID != "test-request" || entry.Status != http.StatusAccepted ||
+		entry.UserID != user.ID.Hex() || entry.Service != "test" ||
+		entry.Instance != addr || entry.Attempts != 1 {
+		t.Errorf("incorrect log entry: %s", buf.String())
+	}
+}
+
+// recordingExporter keeps the spans exported to it.
+type recordingExporter struct {
+	spans []*tracing.SpanData
+	mx    sync.Mutex
+}
+
+func (re *recordingExporter) Export(span *tracing.SpanData) {
+	re.mx.Lock()
+	defer re.mx.Unlock()
+	re.spans = append(re.spans, span)
+}
+
+func TestDSDHandlerPropagatesTrace(t *testing.T) {
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+
+	// The microservice gets the trace context of the proxy span.
+	traceParentQ := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParentQ <- r.Header.Get(tracing.HeaderTraceParent)
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     addr,
+		Heartbeat:   10,
+	})
+	exporter := &recordingExporter{}
+	handler := tracing.NewHandler(newTestDSDHandler(serviceList), tracing.NewTracer("gateway", exporter))
+
+	r := httptest.NewRequest("GET", "/v1/test", nil)
+	r.Header.Set(tracing.HeaderTraceParent, "00-"+traceID+"-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	sc, err := tracing.ParseTraceParent(<-traceParentQ)
+	if err != nil {
+		t.Fatalf("error parsing forwarded traceparent: %v", err)
+	}
+
+	exporter.mx.Lock()
+	defer exporter.mx.Unlock()
+	spans := map[string]*tracing.SpanData{}
+	for _, span := range exporter.spans {
+		spans[span.Name] = span
+	}
+	request, proxy := spans["GET /v1/test"], spans["proxy test"]
+	if request == nil || proxy == nil {
+		t.Fatalf("expected request and proxy spans but got %v", spans)
+	}
+	if request.TraceID != traceID || proxy.TraceID != traceID || proxy.ParentID != request.SpanID {
+		t.Errorf("expected proxy span to be a child of the request span in trace %s", traceID)
+	}
+	if fmt.Sprintf("%x", sc.SpanID) != proxy.SpanID || fmt.Sprintf("%x", sc.TraceID) != traceID {
+		t.Errorf("expected forwarded traceparent to carry the proxy span %s", proxy.SpanID)
+	}
+	if proxy.Attributes["service.instance"] != addr || proxy.Attributes["http.status"] != "200" {
+		t.Errorf("incorrect proxy span attributes: %v", proxy.Attributes)
+	}
+}
+
+func TestDSDHandlerCanSeeChannel(t *testing.T) {
+	alice := bson.NewObjectId()
+	publicChannelID := bson.NewObjectId().Hex()
+	aliceChannelID := bson.NewObjectId().Hex()
+	brokenChannelID := bson.NewObjectId().Hex()
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+	// A messaging microservice letting everyone read the public channel,
+	// only alice read hers, and failing to read the broken one.
+	// It only expects to be asked for the headers,
+	// as part of the request and trace of the WebSocket connection.
+	messaging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			http.Error(w, "expect HEAD method", http.StatusMethodNotAllowed)
+			return
+		}
+		sc, err := tracing.ParseTraceParent(r.Header.Get(tracing.HeaderTraceParent))
+		if r.Header.Get(accesslog.HeaderRequestID) != "ws-request" || err != nil || fmt.Sprintf("%x", sc.TraceID) != traceID {
+			http.Error(w, "request ID or trace not passed on", http.StatusBadRequest)
+			return
+		}
+		claims, err := identity.VerifyRequest(r, testIdentityKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, channelsPath) {
+		case publicChannelID:
+			w.Write([]byte("[]"))
+		case aliceChannelID:
+			if claims.UserID != alice.Hex() {
+				http.Error(w, "not a member", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("[]"))
+		case brokenChannelID:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer messaging.Close()
+
+	serviceList := NewServiceList()
+	handler := newTestDSDHandler(serviceList)
+	if _, err := handler.CanSeeChannel(context.Background(), alice, publicChannelID); err == nil {
+		t.Errorf("expected error when no microservice serves channels")
+	}
+	serviceList.Register(&ReceivedService{
+		Name:        "messaging",
+		PathPattern: "^/v1/channels",
+		Address:     strings.TrimPrefix(messaging.URL, "http://"),
+		Heartbeat:   10,
+	})
+
+	cases := []struct {
+		name          string
+		userID        bson.ObjectId
+		channelID     string
+		expectedOK    bool
+		expectedError bool
+	}{
+		{
+			"Public Channel",
+			bson.NewObjectId(),
+			publicChannelID,
+			true,
+			false,
+		},
+		{
+			"Member Of Channel",
+			alice,
+			aliceChannelID,
+			true,
+			false,
+		},
+		{
+			"Not Member Of Channel",
+			bson.NewObjectId(),
+			aliceChannelID,
+			false,
+			false,
+		},
+		{
+			"No Such Channel",
+			alice,
+			bson.NewObjectId().Hex(),
+			false,
+			false,
+		},
+		{
+			"Failing Microservice",
+			alice,
+			brokenChannelID,
+			false,
+			true,
+		},
+	}
+
+	// The context of the WebSocket connection's request.
+	sc, _ := tracing.ParseTraceParent("00-" + traceID + "-b7ad6b7169203331-01")
+	ctx := tracing.WithRemoteParent(tracing.WithTracer(context.Background(), tracing.NewTracer("gateway", &recordingExporter{})), sc)
+	ctx, span := tracing.Start(ctx, "GET /v1/ws")
+	defer span.End()
+	wsEntry := &accesslog.Entry{RequestID: "ws-request"}
+	ctx = accesslog.WithEntry(ctx, wsEntry)
+
+	for _, c := range cases {
+		ok, err := handler.CanSeeChannel(ctx, c.userID, c.channelID)
+		if (err != nil) != c.expectedError {
+			t.Errorf("case %s: expected error: %t, but got %v", c.name, c.expectedError, err)
+		}
+		if ok != c.expectedOK {
+			t.Errorf("case %s: expected %t but got %t", c.name, c.expectedOK, ok)
+		}
+	}
+	if len(wsEntry.Instance) != 0 {
+		t.Errorf("expected the access log entry of the WebSocket connection to be left alone")
+	}
+}
+
+func TestServiceListProbe(t *testing.T) {
+	srv := newTestService(http.StatusOK)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     addr,
+		Heartbeat:   10,
+	})
+	breaker := serviceList.services["test"].instances[addr].breaker
+	client := &http.Client{Timeout: ProbeTimeout}
+
+	serviceList.Probe(client)
+	if state := breaker.currentState(); state != breakerClosed {
+		t.Errorf("expected breaker of a healthy instance to be closed but got %s", state)
+	}
+
+	srv.Close()
+	for i := 0; i < failureThreshold; i++ {
+		serviceList.Probe(client)
+	}
+	if state := breaker.currentState(); state != breakerOpen {
+		t.Errorf("expected breaker of an instance failing probes to be open but got %s", state)
+	}
+}
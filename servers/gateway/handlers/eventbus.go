@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// EventTopics names the topics the Notifier gets its events from.
+type EventTopics struct {
+	// Work is the topic microservices send their events to.
+	// Each of its events is taken by only one gateway instance,
+	// since they all subscribe to it as WorkGroup.
+	Work      string
+	WorkGroup string
+	// Fanout is the topic whichever instance took an event off Work
+	// publishes it to, so that every instance gets a copy
+	// to deliver to its local WebSocket clients.
+	// Events raised by the Notifier itself, such as typing indicators,
+	// go straight to it.
+	Fanout string
+}
+
+// minRelayBackoff and maxRelayBackoff bound how long the Notifier waits
+// before handing back an event it failed to relay to Fanout.
+const (
+	minRelayBackoff = 100 * time.Millisecond
+	maxRelayBackoff = 5 * time.Second
+)
+
+// ListenTo makes the Notifier get its events from bus.
+// It returns once it has subscribed to the topics,
+// and keeps listening in the background until bus is closed.
+func (n *Notifier) ListenTo(bus eventbus.Bus, topics *EventTopics) error {
+	work, err := bus.Subscribe(topics.Work, &eventbus.SubscribeOptions{
+		Group: topics.WorkGroup,
+		// Only acknowledge events once they have been
+		// relayed to Fanout, so that none is lost if that fails.
+		ManualAck: true,
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %v", topics.Work, err)
+	}
+	local, err := bus.Subscribe(topics.Fanout, nil)
+	if err != nil {
+		work.Close()
+		return fmt.Errorf("error subscribing to %s: %v", topics.Fanout, err)
+	}
+
+	n.SetRelay(func(event []byte) error {
+		return bus.Publish(topics.Fanout, event)
+	})
+
+	go func() {
+		backoff := minRelayBackoff
+		for {
+			select {
+			case msg := <-work.Messages():
+				if err := bus.Publish(topics.Fanout, msg.Body); err != nil {
+					log.Printf("error relaying event, retrying in %v: %v", backoff, err)
+					// The event is redelivered as soon as it is handed back,
+					// so wait before doing so, rather than spinning
+					// for as long as Fanout can't be published to.
+					// No other event is taken off Work in the meantime.
+					select {
+					case <-time.After(backoff):
+					case <-work.Done():
+					}
+					msg.Nack(true)
+					backoff *= 2
+					if backoff > maxRelayBackoff {
+						backoff = maxRelayBackoff
+					}
+					continue
+				}
+				backoff = minRelayBackoff
+				msg.Ack()
+				// Count each event once, rather than once per redelivery.
+				atomic.AddInt64(&n.consumed, 1)
+			case <-work.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case msg := <-local.Messages():
+				n.Notify(msg.Body)
+			case <-local.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNotifierListenTo(t *testing.T) {
+	// Two gateway instances sharing an in-process bus.
+	bus := eventbus.NewMemBus()
+	defer bus.Close()
+	topics := &EventTopics{Work: "events", WorkGroup: "gateway", Fanout: "notifications"}
+
+	notifiers := []*Notifier{}
+	conns := []*websocket.Conn{}
+	for i := 0; i < 2; i++ {
+		notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+		if err := notifier.ListenTo(bus, topics); err != nil {
+			t.Fatalf("error listening to bus: %v", err)
+		}
+		srv := newTestNotifierServer(notifier)
+		defer srv.Close()
+		conn := dialTestClient(t, srv, bson.NewObjectId())
+		defer conn.Close()
+		waitForClients(t, notifier, 1)
+		syncEvents(t, notifier, conn)
+		notifiers = append(notifiers, notifier)
+		conns = append(conns, conn)
+	}
+
+	// An event sent by a microservice is taken by one instance,
+	// but delivered to the clients of both, exactly once.
+	if err := bus.Publish(topics.Work, []byte(`{"type":"channel-new"}`)); err != nil {
+		t.Fatalf("error publishing event: %v", err)
+	}
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("expected client %d to receive the event: %v", i, err)
+			}
+			if strings.Contains(string(msg), "channel-new") {
+				break
+			}
+		}
+		for _, evt := range syncEvents(t, notifiers[i], conn)[0] {
+			if strings.Contains(evt, "channel-new") {
+				t.Errorf("expected client %d to receive the event only once", i)
+			}
+		}
+	}
+}
+
+// failingBus is a MemBus that fails to publish to a topic
+// for as long as failing is not zero.
+type failingBus struct {
+	*eventbus.MemBus
+	topic    string
+	failing  int32
+	failures int32
+}
+
+// Publish publishes body to topic, unless it should fail.
+func (b *failingBus) Publish(topic string, body []byte) error {
+	if topic == b.topic && atomic.LoadInt32(&b.failing) != 0 {
+		atomic.AddInt32(&b.failures, 1)
+		return errors.New("MQ server unreachable")
+	}
+	return b.MemBus.Publish(topic, body)
+}
+
+func TestNotifierListenToBacksOff(t *testing.T) {
+	topics := &EventTopics{Work: "events", WorkGroup: "gateway", Fanout: "notifications"}
+	bus := &failingBus{MemBus: eventbus.NewMemBus(), topic: topics.Fanout, failing: 1}
+	defer bus.Close()
+
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	if err := notifier.ListenTo(bus, topics); err != nil {
+		t.Fatalf("error listening to bus: %v", err)
+	}
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+	conn := dialTestClient(t, srv, bson.NewObjectId())
+	defer conn.Close()
+	waitForClients(t, notifier, 1)
+
+	// The event is handed back and redelivered while Fanout fails,
+	// but not in a tight loop.
+	if err := bus.MemBus.Publish(topics.Work, []byte(`{"type":"channel-new"}`)); err != nil {
+		t.Fatalf("error publishing event: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if failures := atomic.LoadInt32(&bus.failures); failures < 1 || failures > 5 {
+		t.Errorf("expected a few attempts to relay the event but got %d", failures)
+	}
+
+	// Once Fanout is back, the event gets through.
+	atomic.StoreInt32(&bus.failing, 0)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected client to receive the event: %v", err)
+		}
+		if strings.Contains(string(msg), "channel-new") {
+			break
+		}
+	}
+	// The redeliveries are not counted as events consumed.
+	deadline := time.Now().Add(time.Second)
+	for notifier.Stats().Consumed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if consumed := notifier.Stats().Consumed; consumed != 1 {
+		t.Errorf("expected 1 event consumed but got %d", consumed)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+)
+
+// eventLogSize is the number of recent events the Notifier keeps
+// so that they can be replayed to reconnecting clients.
+const eventLogSize = 512
+
+// loggedEvent is an event that has been dispatched by the Notifier.
+type loggedEvent struct {
+	seq int64
+	// msg is the event as sent to clients, including its sequence number.
+	msg        []byte
+	evt        *event
+	recipients map[bson.ObjectId]bool
+}
+
+// isFor reports whether the event should be delivered to the client.
+// The caller must hold the Notifier's mutex.
+func (le *loggedEvent) isFor(c *client) bool {
+	if le.recipients != nil && !le.recipients[c.userID] {
+		return false
+	}
+	if len(le.evt.SubscribedTo) != 0 && !c.channels[le.evt.SubscribedTo] {
+		return false
+	}
+	return true
+}
+
+// eventLog is a bounded ring buffer of the most recent events,
+// ordered by sequence number.
+type eventLog struct {
+	events []*loggedEvent
+	// next is the index the next event will be written to.
+	next int
+	// full is true once the buffer has wrapped around.
+	full bool
+}
+
+// newEventLog constructs a new eventLog that holds up to size events.
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		events: make([]*loggedEvent, size),
+	}
+}
+
+// add adds an event to the log, overwriting the oldest one if the log is full.
+func (l *eventLog) add(le *loggedEvent) {
+	l.events[l.next] = le
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// since returns the logged events with a sequence number greater than seq,
+// in order. It also reports whether those are all the events
+// after seq, or some of them have already been overwritten.
+func (l *eventLog) since(seq int64) ([]*loggedEvent, bool) {
+	ordered := l.events[:l.next]
+	if l.full {
+		ordered = append(l.events[l.next:len(l.events):len(l.events)], l.events[:l.next]...)
+	}
+	if len(ordered) == 0 {
+		return nil, true
+	}
+
+	// Sequence numbers are consecutive, so the first event
+	// we need sits at a known offset from the oldest one.
+	oldest := ordered[0].seq
+	if seq < oldest-1 {
+		return ordered, false
+	}
+	offset := int(seq - oldest + 1)
+	if offset >= len(ordered) {
+		return nil, true
+	}
+	return ordered[offset:], true
+}
+
+// withSeq returns a copy of the JSON object msg
+// with its "seq" property set to seq.
+func withSeq(msg []byte, seq int64) ([]byte, error) {
+	obj := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(msg, &obj); err != nil {
+		return nil, fmt.Errorf("error unmarshalling event JSON: %v", err)
+	}
+	seqJSON, err := json.Marshal(seq)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling sequence number: %v", err)
+	}
+	obj["seq"] = seqJSON
+	return json.Marshal(obj)
+}
+
+// eventConnected is the type of the event sent to
+// a client as soon as it connects.
+const eventConnected = "connected"
+
+// connectedEvent tells a newly connected client where the Notifier is at,
+// and how many missed events are replayed right after it.
+type connectedEvent struct {
+	Type  string `json:"type"`
+	Epoch string `json:"epoch"`
+	Seq   int64  `json:"seq"`
+	// Replayed is the number of events replayed to the client.
+	Replayed int `json:"replayed"`
+	// Complete is false if some of the events the client missed
+	// could not be replayed, and the client should reload its data instead.
+	Complete bool `json:"complete"`
+}
+
+// replay returns the logged events dispatched after since
+// by the Notifier identified by epoch, and whether those
+// are all the events the client missed.
+// The caller must hold n.mx.
+func (n *Notifier) replay(since int64, epoch string) ([]*loggedEvent, bool) {
+	if since == NoReplay {
+		return nil, true
+	}
+	// Sequence numbers of another Notifier, such as the one
+	// that ran before the gateway restarted, mean nothing to us.
+	if epoch != n.epoch || since > n.seq {
+		return nil, false
+	}
+	return n.log.since(since)
+}
+
+// connectedEvent returns the connected event for a new client.
+// The caller must hold n.mx.
+func (n *Notifier) connectedEvent(replayed int, complete bool) []byte {
+	j, err := json.Marshal(&connectedEvent{eventConnected, n.epoch, n.seq, replayed, complete})
+	if err != nil {
+		log.Printf("error marshalling connected event: %v", err)
+	}
+	return j
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventLogSince(t *testing.T) {
+	cases := []struct {
+		name             string
+		size             int
+		added            int64
+		since            int64
+		expectedSeqs     []int64
+		expectedComplete bool
+	}{
+		{
+			"Empty Log",
+			3,
+			0,
+			0,
+			[]int64{},
+			true,
+		},
+		{
+			"Partially Filled Log",
+			3,
+			2,
+			0,
+			[]int64{1, 2},
+			true,
+		},
+		{
+			"Up To Date",
+			3,
+			2,
+			2,
+			[]int64{},
+			true,
+		},
+		{
+			"Wrapped Log",
+			3,
+			5,
+			2,
+			[]int64{3, 4, 5},
+			true,
+		},
+		{
+			"Wrapped Log Partial Replay",
+			3,
+			5,
+			3,
+			[]int64{4, 5},
+			true,
+		},
+		{
+			"Events Overwritten",
+			3,
+			5,
+			1,
+			[]int64{3, 4, 5},
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		log := newEventLog(c.size)
+		for seq := int64(1); seq <= c.added; seq++ {
+			log.add(&loggedEvent{seq: seq})
+		}
+		events, complete := log.since(c.since)
+		seqs := []int64{}
+		for _, le := range events {
+			seqs = append(seqs, le.seq)
+		}
+		if !reflect.DeepEqual(seqs, c.expectedSeqs) {
+			t.Errorf("case %s: expected events %v but got %v", c.name, c.expectedSeqs, seqs)
+		}
+		if complete != c.expectedComplete {
+			t.Errorf("case %s: expected complete to be %t but got %t", c.name, c.expectedComplete, complete)
+		}
+	}
+}
+
+func TestWithSeq(t *testing.T) {
+	msg, err := withSeq([]byte(`{"type":"message-new","seq":1}`), 42)
+	if err != nil {
+		t.Fatalf("unexpected error adding sequence number: %v", err)
+	}
+	evt := &struct {
+		Type string
+		Seq  int64
+	}{}
+	if err := json.Unmarshal(msg, evt); err != nil {
+		t.Fatalf("error unmarshalling event: %v", err)
+	}
+	if evt.Type != "message-new" || evt.Seq != 42 {
+		t.Errorf("incorrect event with sequence number: %s", msg)
+	}
+
+	if _, err := withSeq([]byte(`["not","an","object"]`), 1); err == nil {
+		t.Errorf("expected error adding sequence number to a JSON array")
+	}
+}
+
+func TestNotifierReplay(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	alice := bson.NewObjectId()
+	conn := dialTestClient(t, srv, alice)
+	waitForClients(t, notifier, 1)
+
+	// Alice first learns where the Notifier is at.
+	connected := &connectedEvent{}
+	if err := conn.ReadJSON(connected); err != nil {
+		t.Fatalf("error reading connected event: %v", err)
+	}
+	if connected.Type != eventConnected || len(connected.Epoch) == 0 {
+		t.Fatalf("expected a connected event but got %+v", connected)
+	}
+	conn.Close()
+	waitForClients(t, notifier, 0)
+
+	// While alice is away, an event for her,
+	// and one for someone else, are sent.
+	notifier.Notify([]byte(`{"type":"message-new","userIDs":["` + alice.Hex() + `"]}`))
+	notifier.Notify([]byte(`{"type":"message-new","userIDs":["` + bson.NewObjectId().Hex() + `"]}`))
+
+	cases := []struct {
+		name             string
+		query            string
+		expectedMessages int
+		expectedComplete bool
+	}{
+		{
+			"No Replay",
+			"",
+			0,
+			true,
+		},
+		{
+			"Replay",
+			fmt.Sprintf("&since=%d&epoch=%s", connected.Seq, connected.Epoch),
+			1,
+			true,
+		},
+		{
+			"Replay From Another Epoch",
+			fmt.Sprintf("&since=%d&epoch=%s", connected.Seq, bson.NewObjectId().Hex()),
+			0,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		conn := dialTestClientWithQuery(t, srv, alice, c.query)
+		reconnected := &connectedEvent{}
+		if err := conn.ReadJSON(reconnected); err != nil {
+			t.Fatalf("case %s: error reading connected event: %v", c.name, err)
+		}
+		if reconnected.Complete != c.expectedComplete {
+			t.Errorf("case %s: expected complete to be %t but got %+v", c.name, c.expectedComplete, reconnected)
+		}
+		if reconnected.Replayed < c.expectedMessages {
+			t.Errorf("case %s: expected at least %d replayed events but got %+v", c.name, c.expectedMessages, reconnected)
+		}
+
+		// Only the message for alice must be replayed,
+		// and it must come before any live event.
+		// Presence changes are ignored since they depend on timing.
+		messages := []string{}
+		for _, e := range syncEvents(t, notifier, conn)[0] {
+			evt := &struct{ Type string }{}
+			json.Unmarshal([]byte(e), evt)
+			if evt.Type == "message-new" {
+				messages = append(messages, e)
+			}
+		}
+		if len(messages) != c.expectedMessages {
+			t.Errorf("case %s: expected %d replayed messages but got %v", c.name, c.expectedMessages, messages)
+		}
+		conn.Close()
+		waitForClients(t, notifier, 0)
+	}
+}
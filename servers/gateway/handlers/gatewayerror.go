@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"net/http"
+)
+
+// Codes of the errors the gateway responds with
+// on behalf of microservices.
+const (
+	// GatewayErrorUnavailable means no instance of the microservice was available.
+	GatewayErrorUnavailable = "unavailable"
+	// GatewayErrorUnreachable means no instance of the microservice could be reached.
+	GatewayErrorUnreachable = "unreachable"
+	// GatewayErrorTimeout means the microservice did not answer in time.
+	GatewayErrorTimeout = "timeout"
+)
+
+// GatewayError is the body of the responses the gateway sends
+// when it could not get an answer from a microservice,
+// so that clients can tell them apart from the microservice's own errors.
+type GatewayError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Service string `json:"service"`
+	// Attempts is the number of instances the request was sent to.
+	Attempts int `json:"attempts"`
+	// RequestID identifies the request in the gateway's
+	// and the microservices' logs.
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// respondWithGatewayError writes gatewayErr to w as JSON, with its status code.
+// The error carries the request ID set on the response, if any.
+func respondWithGatewayError(w http.ResponseWriter, gatewayErr *GatewayError) {
+	gatewayErr.RequestID = w.Header().Get(accesslog.HeaderRequestID)
+	w.Header().Set(headerContentType, contentTypeJSON)
+	w.WriteHeader(gatewayErr.Status)
+	json.NewEncoder(w).Encode(gatewayErr)
+}
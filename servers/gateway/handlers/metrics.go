@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/indexes"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/metrics"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsPath is the resource path Prometheus scrapes the gateway's metrics from.
+const MetricsPath = "/metrics"
+
+// schemeBearer is the Authorization scheme Prometheus sends its bearer token with.
+const schemeBearer = "Bearer "
+
+// Metrics are the measurements the gateway exposes at MetricsPath.
+// Request metrics are labelled by route and microservice,
+// and everything else is read from its source when it is scraped.
+type Metrics struct {
+	Registry *metrics.Registry
+
+	requests       *metrics.Counter
+	latency        *metrics.Histogram
+	signInFailures *metrics.Counter
+	signInLockouts *metrics.Counter
+}
+
+// NewMetrics constructs the Metrics of the gateway.
+func NewMetrics() *Metrics {
+	reg := metrics.NewRegistry()
+	return &Metrics{
+		Registry: reg,
+		requests: reg.NewCounter("gateway_http_requests_total",
+			"Requests handled, by route, microservice and status code.",
+			"route", "service", "code"),
+		latency: reg.NewHistogram("gateway_http_request_duration_seconds",
+			"Time taken to answer requests, by route and microservice. WebSocket connections are left out.",
+			metrics.DefaultBuckets, "route", "service"),
+		signInFailures: reg.NewCounter("gateway_signin_failures_total",
+			"Sign-in attempts with invalid credentials."),
+		signInLockouts: reg.NewCounter("gateway_signin_lockouts_total",
+			"Accounts locked after repeated failed sign-ins."),
+	}
+}
+
+// RegisterNotifier exposes the WebSocket connections of notifier,
+// its event queue depth, the events it dropped because the queue was full,
+// and the events it consumed from the work queue.
+func (m *Metrics) RegisterNotifier(notifier *Notifier) {
+	m.Registry.NewGaugeFunc("gateway_websocket_connections",
+		"WebSocket clients currently connected.",
+		func() float64 { return float64(notifier.Stats().Connections) })
+	m.Registry.NewGaugeFunc("gateway_notifier_queue_depth",
+		"Events waiting to be dispatched to WebSocket clients.",
+		func() float64 { return float64(notifier.Stats().QueueDepth) })
+	m.Registry.NewCounterFunc("gateway_notifier_events_dropped_total",
+		"Events dropped because too many were waiting to be dispatched.",
+		func() float64 { return float64(notifier.Stats().DroppedEvents) })
+	m.Registry.NewCounterFunc("gateway_mq_messages_consumed_total",
+		"Events consumed from the work queue.",
+		func() float64 { return float64(notifier.Stats().Consumed) })
+}
+
+// RegisterTrie exposes the number of entries in trie.
+func (m *Metrics) RegisterTrie(trie *indexes.Trie) {
+	m.Registry.NewGaugeFunc("gateway_trie_entries",
+		"Entries in the user search trie.",
+		func() float64 { return float64(trie.Len()) })
+}
+
+// RegisterServiceList exposes the number of instances of every microservice
+// in serviceList, by state: "draining", or else the state of their circuit breaker.
+func (m *Metrics) RegisterServiceList(serviceList *ServiceList) {
+	m.Registry.NewGaugeVecFunc("gateway_service_instances",
+		"Instances of each microservice, by state.",
+		[]string{"service", "state"},
+		func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, info := range serviceList.Services() {
+				counts := map[string]int{}
+				for _, instance := range info.Instances {
+					state := instance.Circuit
+					if instance.Draining {
+						state = "draining"
+					}
+					counts[state]++
+				}
+				for _, state := range []string{breakerClosed.String(), breakerHalfOpen.String(), breakerOpen.String(), "draining"} {
+					samples = append(samples, metrics.Sample{
+						LabelValues: []string{info.Name, state},
+						Value:       float64(counts[state]),
+					})
+				}
+			}
+			return samples
+		})
+}
+
+// MetricsHandler is a middleware handler that counts and times
+// every request it passes on to the wrapped handler.
+type MetricsHandler struct {
+	handler     http.Handler
+	mux         *http.ServeMux
+	serviceList *ServiceList
+	metrics     *Metrics
+}
+
+// NewMetricsHandler wraps another handler into MetricsHandler.
+// Requests are labelled by the microservice in serviceList they go to,
+// or else by the pattern they match in mux,
+// so that the number of label values stays bounded.
+func NewMetricsHandler(handlerToWrap http.Handler, mux *http.ServeMux, serviceList *ServiceList, m *Metrics) *MetricsHandler {
+	if m == nil {
+		panic("nil metrics")
+	}
+	return &MetricsHandler{handlerToWrap, mux, serviceList, m}
+}
+
+// ServeHTTP implements the http.Handler interface for the MetricsHandler.
+func (mh *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := mh.serviceList.serviceName(r.Method, r.URL.Path)
+	route := ""
+	if len(service) == 0 {
+		if _, route = mh.mux.Handler(r); len(route) == 0 {
+			route = "unmatched"
+		}
+	}
+
+	start := time.Now()
+	recorder := accesslog.NewResponseRecorder(w)
+	mh.handler.ServeHTTP(recorder, r)
+
+	mh.metrics.requests.Inc(route, service, strconv.Itoa(recorder.Status()))
+	if recorder.Status() != http.StatusSwitchingProtocols {
+		mh.metrics.latency.Observe(time.Since(start).Seconds(), route, service)
+	}
+}
+
+// MetricsEndpointHandler serves the metrics to Prometheus.
+// Requests must carry its key as a bearer token,
+// since the metrics tell which microservices run where.
+type MetricsEndpointHandler struct {
+	key     string
+	metrics *Metrics
+}
+
+// NewMetricsEndpointHandler constructs a new MetricsEndpointHandler.
+func NewMetricsEndpointHandler(m *Metrics, key string) *MetricsEndpointHandler {
+	if m == nil {
+		panic("nil metrics")
+	}
+	if len(key) == 0 {
+		panic("metrics key has length of zero")
+	}
+	return &MetricsEndpointHandler{key, m}
+}
+
+// ServeHTTP implements the http.Handler interface for the MetricsEndpointHandler.
+func (meh *MetricsEndpointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !meh.authorized(r) {
+		http.Error(w, "invalid or missing metrics credential", http.StatusUnauthorized)
+		return
+	}
+	meh.metrics.Registry.ServeHTTP(w, r)
+}
+
+// authorized reports whether r carries the metrics key.
+func (meh *MetricsEndpointHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get(headerAuthorization)
+	if !strings.HasPrefix(auth, schemeBearer) {
+		return false
+	}
+	key := strings.TrimPrefix(auth, schemeBearer)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(meh.key)) == 1
+}
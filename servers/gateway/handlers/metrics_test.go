@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	srv := newTestService(http.StatusOK)
+	defer srv.Close()
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     strings.TrimPrefix(srv.URL, "http://"),
+		Heartbeat:   10,
+	})
+
+	m := NewMetrics()
+	m.RegisterServiceList(serviceList)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not here", http.StatusNotFound)
+	})
+	mux.Handle(MetricsPath, NewMetricsEndpointHandler(m, "metrics key"))
+	dsdh := newTestDSDHandler(serviceList)
+	dsdh.handler = mux
+	handler := NewMetricsHandler(dsdh, mux, serviceList, m)
+
+	for _, path := range []string{"/v1/test", "/v1/users/1234", "/v1/users/5678", "/nowhere"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	cases := []struct {
+		name           string
+		auth           string
+		expectedStatus int
+		expectedLines  []string
+	}{
+		{
+			"Valid Metrics Key",
+			"Bearer metrics key",
+			http.StatusOK,
+			[]string{
+				`gateway_http_requests_total{route="",service="test",code="200"} 1`,
+				`gateway_http_requests_total{route="/v1/users/",service="",code="404"} 2`,
+				`gateway_http_requests_total{route="unmatched",service="",code="404"} 1`,
+				`gateway_http_request_duration_seconds_count{route="/v1/users/",service=""} 2`,
+				`gateway_service_instances{service="test",state="closed"} 1`,
+				`gateway_service_instances{service="test",state="draining"} 0`,
+			},
+		},
+		{
+			"Invalid Metrics Key",
+			"Bearer wrong key",
+			http.StatusUnauthorized,
+			nil,
+		},
+		{
+			"No Metrics Key",
+			"",
+			http.StatusUnauthorized,
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", MetricsPath, nil)
+		if len(c.auth) != 0 {
+			r.Header.Set(headerAuthorization, c.auth)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, r)
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+		}
+		for _, line := range c.expectedLines {
+			if !strings.Contains(resp.Body.String(), line+"\n") {
+				t.Errorf("case %s: expected line %q in:\n%s", c.name, line, resp.Body.String())
+			}
+		}
+	}
+}
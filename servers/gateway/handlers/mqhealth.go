@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+	"net/http"
+)
+
+// MQHealthHandler reports whether the gateway is connected to the MQ server.
+type MQHealthHandler struct {
+	reporter eventbus.StatusReporter
+}
+
+// NewMQHealthHandler constructs a new MQHealthHandler.
+func NewMQHealthHandler(reporter eventbus.StatusReporter) *MQHealthHandler {
+	if reporter == nil {
+		panic("nil MQ status reporter")
+	}
+	return &MQHealthHandler{reporter}
+}
+
+// ServeHTTP responds with the status of the connection to the MQ server,
+// using 503 Service Unavailable while it is disconnected
+// so that load balancers and monitors can tell without parsing the body.
+func (h *MQHealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "expect GET method only", http.StatusMethodNotAllowed)
+		return
+	}
+	status := h.reporter.Status()
+	w.Header().Add(headerContentType, contentTypeJSON)
+	if !status.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
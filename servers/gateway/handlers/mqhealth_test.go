@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
+)
+
+type fakeMQStatusReporter struct {
+	status *eventbus.Status
+}
+
+func (f *fakeMQStatusReporter) Status() *eventbus.Status {
+	return f.status
+}
+
+func TestMQHealthHandler(t *testing.T) {
+	cases := []struct {
+		name           string
+		method         string
+		connected      bool
+		expectedStatus int
+	}{
+		{
+			"Connected",
+			"GET",
+			true,
+			http.StatusOK,
+		},
+		{
+			"Disconnected",
+			"GET",
+			false,
+			http.StatusServiceUnavailable,
+		},
+		{
+			"Wrong Method",
+			"POST",
+			true,
+			http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, c := range cases {
+		handler := NewMQHealthHandler(&fakeMQStatusReporter{&eventbus.Status{Connected: c.connected}})
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(c.method, "/v1/health/mq", nil))
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+			continue
+		}
+		if c.expectedStatus == http.StatusMethodNotAllowed {
+			continue
+		}
+		status := &eventbus.Status{}
+		if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+			t.Errorf("case %s: error decoding status: %v", c.name, err)
+			continue
+		}
+		if status.Connected != c.connected {
+			t.Errorf("case %s: expected connected to be %t", c.name, c.connected)
+		}
+	}
+}
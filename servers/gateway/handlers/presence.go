@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxPresenceIDs is the max number of users
+// whose presence can be requested at once.
+const maxPresenceIDs = 100
+
+// eventPresenceChange is the type of the event sent to
+// all clients when the presence of a user changes.
+const eventPresenceChange = "presence-change"
+
+// presenceChangeEvent tells clients that the presence of a user has changed.
+type presenceChangeEvent struct {
+	Type   string        `json:"type"`
+	UserID bson.ObjectId `json:"userID"`
+	Status string        `json:"status"`
+}
+
+// setPresence sets the presence status of the client's connection,
+// and notifies all clients if that changes the status of the user.
+func (n *Notifier) setPresence(c *client, status string) {
+	n.mx.Lock()
+	c.status = status
+	n.mx.Unlock()
+
+	n.updatePresence(c.userID, func() error {
+		return n.presenceStore.Set(c.userID, c.connID, status)
+	})
+}
+
+// refreshPresence keeps the presence of the client's connection
+// from expiring, without changing its status.
+func (n *Notifier) refreshPresence(c *client) {
+	n.mx.Lock()
+	status := c.status
+	n.mx.Unlock()
+
+	if err := n.presenceStore.Set(c.userID, c.connID, status); err != nil {
+		log.Printf("error refreshing presence: %v", err)
+	}
+}
+
+// removePresence removes the client's connection from the presence store,
+// and notifies all clients if the user is now offline or away.
+func (n *Notifier) removePresence(c *client) {
+	n.updatePresence(c.userID, func() error {
+		return n.presenceStore.Remove(c.userID, c.connID)
+	})
+}
+
+// updatePresence applies update to the presence of the user,
+// and sends a presence-change event if the status of the user changed.
+func (n *Notifier) updatePresence(userID bson.ObjectId, update func() error) {
+	before, err := n.presenceStore.Get(userID)
+	if err != nil {
+		log.Printf("error getting presence: %v", err)
+		return
+	}
+	if err := update(); err != nil {
+		log.Printf("error updating presence: %v", err)
+		return
+	}
+	after, err := n.presenceStore.Get(userID)
+	if err != nil {
+		log.Printf("error getting presence: %v", err)
+		return
+	}
+	if before == after {
+		return
+	}
+
+	evt, err := json.Marshal(&presenceChangeEvent{eventPresenceChange, userID, after})
+	if err != nil {
+		log.Printf("error marshalling presence change event: %v", err)
+		return
+	}
+	n.publish(evt)
+}
+
+// PresenceHandler handles requests for the "presence" resource,
+// and responds with the presence status of the requested users.
+type PresenceHandler struct {
+	presenceStore presence.Store
+	ctx           *HandlerContext
+}
+
+// NewPresenceHandler constructs a new PresenceHandler.
+func (ctx *HandlerContext) NewPresenceHandler(presenceStore presence.Store) *PresenceHandler {
+	return &PresenceHandler{presenceStore, ctx}
+}
+
+// ServeHTTP implements the http.Handler interface for the PresenceHandler.
+// It expects a comma-separated list of user IDs in the `ids` query string parameter,
+// and responds with a JSON object mapping each user ID to its status.
+func (ph *PresenceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "expect GET method only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionState := &SessionState{}
+	_, err := ph.ctx.getSessionState(r, sessionState)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	ids := r.URL.Query().Get("ids")
+	if len(ids) == 0 {
+		http.Error(w, "no ids found in the requested URL", http.StatusBadRequest)
+		return
+	}
+
+	userIDs := strings.Split(ids, ",")
+	if len(userIDs) > maxPresenceIDs {
+		http.Error(w, fmt.Sprintf("no more than %d ids can be requested at once", maxPresenceIDs), http.StatusBadRequest)
+		return
+	}
+
+	results := make(map[string]string, len(userIDs))
+	for _, id := range userIDs {
+		if !bson.IsObjectIdHex(id) {
+			http.Error(w, fmt.Sprintf("invalid user id: %s", id), http.StatusBadRequest)
+			return
+		}
+		status, err := ph.presenceStore.Get(bson.ObjectIdHex(id))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error getting presence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		results[id] = status
+	}
+
+	w.Header().Add(headerContentType, contentTypeJSON)
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		http.Error(w, "error encoding presence to JSON", http.StatusInternalServerError)
+		return
+	}
+}
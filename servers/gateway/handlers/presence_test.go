@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// expectPresenceChanges fails unless conn has received exactly
+// the given presence changes of the user since the last sync.
+func expectPresenceChanges(t *testing.T, notifier *Notifier, conn *websocket.Conn, userID bson.ObjectId, statuses ...string) {
+	events := syncEvents(t, notifier, conn)[0]
+	if len(events) != len(statuses) {
+		t.Fatalf("expected presence changes to %v but got %v", statuses, events)
+	}
+	for i, status := range statuses {
+		evt := &presenceChangeEvent{}
+		if err := json.Unmarshal([]byte(events[i]), evt); err != nil {
+			t.Fatalf("error unmarshalling presence change event: %v", err)
+		}
+		if evt.Type != eventPresenceChange || evt.UserID != userID || evt.Status != status {
+			t.Errorf("expected presence change of user %s to %s but got %s", userID.Hex(), status, events[i])
+		}
+	}
+}
+
+func TestNotifierPresence(t *testing.T) {
+	presenceStore := presence.NewMemStore(presence.DefaultTTL)
+	notifier := NewNotifier(DefaultIdleTimeout, presenceStore)
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	alice := bson.NewObjectId()
+	bob := bson.NewObjectId()
+	aliceConn := dialTestClient(t, srv, alice)
+	defer aliceConn.Close()
+	waitForClients(t, notifier, 1)
+	syncEvents(t, notifier, aliceConn)
+
+	// Bob opens a first tab.
+	bobTab1 := dialTestClient(t, srv, bob)
+	waitForClients(t, notifier, 2)
+	expectPresenceChanges(t, notifier, aliceConn, bob, presence.StatusOnline)
+
+	// Opening a second tab doesn't change anything.
+	bobTab2 := dialTestClient(t, srv, bob)
+	waitForClients(t, notifier, 3)
+	expectPresenceChanges(t, notifier, aliceConn, bob)
+
+	// Bob is only away once both tabs are away.
+	syncEvents(t, notifier, bobTab1, bobTab2)
+	sendCommand(t, bobTab1, `{"type":"presence","status":"away"}`)
+	expectPresenceChanges(t, notifier, aliceConn, bob)
+
+	syncEvents(t, notifier, bobTab1, bobTab2)
+	if reply := sendCommand(t, bobTab2, `{"type":"presence","status":"sleeping"}`); reply.Code != errCodeInvalidCommand {
+		t.Errorf("expected invalid status to be rejected but got %v", reply)
+	}
+	sendCommand(t, bobTab2, `{"type":"presence","status":"away"}`)
+	expectPresenceChanges(t, notifier, aliceConn, bob, presence.StatusAway)
+
+	// Bob is offline once both tabs are closed.
+	bobTab1.Close()
+	bobTab2.Close()
+	waitForClients(t, notifier, 1)
+	expectPresenceChanges(t, notifier, aliceConn, bob, presence.StatusOffline)
+
+	if status, _ := presenceStore.Get(alice); status != presence.StatusOnline {
+		t.Errorf("expected alice to be online but got %s", status)
+	}
+}
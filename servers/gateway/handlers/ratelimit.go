@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/ratelimits"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// servicePrefix marks rate limits on discovered microservices
+// rather than resource paths.
+const servicePrefix = "service:"
+
+// RateLimits says how many requests each client may send to which resources.
+type RateLimits struct {
+	// Default limits requests no other limit applies to.
+	// If it is nil, those requests are not limited.
+	Default *ratelimits.Limit
+	// Routes limit requests for the resource path in the key,
+	// and every path below it. The longest matching path wins.
+	// Paths match on "/" boundaries, so /v1/users does not cover /v1/usersx.
+	Routes map[string]*ratelimits.Limit
+	// Services limit requests to the discovered microservice named by the key.
+	// They take precedence over Routes.
+	Services map[string]*ratelimits.Limit
+}
+
+// ParseRateLimits parses RateLimits in the form
+// "default=100/m;/v1/users=30/m;/v1/resetcodes=5/m,2;service:summary=60/m".
+// See ratelimits.ParseLimit for the form of each limit.
+func ParseRateLimits(s string) (*RateLimits, error) {
+	limits := &RateLimits{
+		Routes:   make(map[string]*ratelimits.Limit),
+		Services: make(map[string]*ratelimits.Limit),
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit entry %s: expect target=limit", entry)
+		}
+		limit, err := ratelimits.ParseLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		switch target := parts[0]; {
+		case target == "default":
+			limits.Default = limit
+		case strings.HasPrefix(target, servicePrefix):
+			limits.Services[strings.TrimPrefix(target, servicePrefix)] = limit
+		case strings.HasPrefix(target, "/"):
+			limits.Routes[target] = limit
+		default:
+			return nil, fmt.Errorf("invalid rate limit target %s: expect default, a path or service:name", target)
+		}
+	}
+	return limits, nil
+}
+
+// rule returns the name and the Limit of the rule that applies
+// to requests for the given microservice, if any, and resource path.
+// It returns a nil Limit if no rule applies.
+func (limits *RateLimits) rule(svcName string, path string) (string, *ratelimits.Limit) {
+	if limit, found := limits.Services[svcName]; found {
+		return servicePrefix + svcName, limit
+	}
+	longest := ""
+	for prefix := range limits.Routes {
+		if hasAnyPrefix(path, []string{prefix}) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if len(longest) != 0 {
+		return longest, limits.Routes[longest]
+	}
+	return "default", limits.Default
+}
+
+// RateLimitHandler is a middleware handler that limits
+// how many requests each client may send,
+// with a token bucket per client and rule.
+// Clients are told apart by their session user if they are signed in,
+// or else by their IP address.
+type RateLimitHandler struct {
+	handler     http.Handler
+	store       ratelimits.Store
+	limits      *RateLimits
+	serviceList *ServiceList
+	ctx         *HandlerContext
+}
+
+// NewRateLimitHandler wraps another handler into RateLimitHandler.
+func NewRateLimitHandler(
+	handlerToWrap http.Handler,
+	store ratelimits.Store,
+	limits *RateLimits,
+	serviceList *ServiceList,
+	ctx *HandlerContext) *RateLimitHandler {
+
+	if store == nil {
+		panic("nil rate limit store")
+	}
+
+	if limits == nil {
+		panic("nil rate limits")
+	}
+
+	return &RateLimitHandler{handlerToWrap, store, limits, serviceList, ctx}
+}
+
+// ServeHTTP is a method of RateLimitHandler.
+// Requests over their limit get a 429 response with a Retry-After header.
+// Every limited request gets headers saying how much of the limit is left.
+func (rlh *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, limit := rlh.limits.rule(rlh.serviceList.serviceName(r.Method, r.URL.Path), r.URL.Path)
+	if limit == nil {
+		rlh.handler.ServeHTTP(w, r)
+		return
+	}
+
+	client := "ip:" + clientIP(r)
+	if user := rlh.ctx.currentUser(r); user != nil {
+		client = "user:" + user.ID.Hex()
+	}
+	result, err := rlh.store.Take(name+":"+client, limit)
+	if err != nil {
+		// Don't turn away every client just because the store is down.
+		log.Printf("error taking rate limit token: %v", err)
+		rlh.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set(headerRateLimitLimit, strconv.Itoa(limit.Burst))
+	w.Header().Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+	w.Header().Set(headerRateLimitReset, strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		retryAfter := ceilSeconds(result.RetryAfter)
+		w.Header().Set(headerRetryAfter, strconv.Itoa(retryAfter))
+		http.Error(w, fmt.Sprintf("too many requests, please retry in %d seconds", retryAfter), http.StatusTooManyRequests)
+		return
+	}
+	rlh.handler.ServeHTTP(w, r)
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP returns the IP address of the client that sent r.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
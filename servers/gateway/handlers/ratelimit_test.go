@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/ratelimits"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failingRateLimitStore is a ratelimits.Store that is always down.
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(key string, limit *ratelimits.Limit) (*ratelimits.Result, error) {
+	return nil, errors.New("store is down")
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("default=100/m; /v1/users=30/m,5; /v1/users/me=10/s; service:summary=60/m")
+	if err != nil {
+		t.Fatalf("error parsing rate limits: %v", err)
+	}
+
+	cases := []struct {
+		name         string
+		svcName      string
+		path         string
+		expectedRule string
+	}{
+		{
+			"Default",
+			"",
+			"/v1/sessions",
+			"default",
+		},
+		{
+			"Route",
+			"",
+			"/v1/users/5a1b2c3d",
+			"/v1/users",
+		},
+		{
+			"Route Prefix Of Another Path",
+			"",
+			"/v1/usersx",
+			"default",
+		},
+		{
+			"Longest Route",
+			"",
+			"/v1/users/me",
+			"/v1/users/me",
+		},
+		{
+			"Service",
+			"summary",
+			"/v1/users",
+			"service:summary",
+		},
+		{
+			"Unlimited Service",
+			"messaging",
+			"/v1/channels",
+			"default",
+		},
+	}
+
+	for _, c := range cases {
+		if rule, _ := limits.rule(c.svcName, c.path); rule != c.expectedRule {
+			t.Errorf("case %s: expected rule %s but got %s", c.name, c.expectedRule, rule)
+		}
+	}
+
+	for _, invalid := range []string{"default", "users=10/s", "/v1/users=10/d"} {
+		if _, err := ParseRateLimits(invalid); err == nil {
+			t.Errorf("expected error parsing %s", invalid)
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	serviceList := NewServiceList()
+	serviceList.Register(validTestService())
+	ctx := &HandlerContext{
+		SigningKey:   "test key",
+		SessionStore: sessions.NewMemStore(time.Hour, time.Minute),
+	}
+	limits, _ := ParseRateLimits("/v1/users=2/m;service:messaging=1/m")
+	handler := NewRateLimitHandler(http.NotFoundHandler(), ratelimits.NewMemStore(), limits, serviceList, ctx)
+
+	// Sign in a user behind the same IP address as everyone else.
+	user := &users.User{ID: bson.NewObjectId()}
+	signIn := httptest.NewRecorder()
+	if _, err := sessions.BeginSession(ctx.SigningKey, ctx.SessionStore, &SessionState{time.Now(), user}, signIn); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		path           string
+		auth           string
+		expectedStatus int
+	}{
+		{"First Request", "/v1/users", "", http.StatusNotFound},
+		{"Burst", "/v1/users", "", http.StatusNotFound},
+		{"Over Limit", "/v1/users", "", http.StatusTooManyRequests},
+		{"Signed-In User", "/v1/users", signIn.Header().Get(headerAuthorization), http.StatusNotFound},
+		{"Discovered Service", "/v1/channels", "", http.StatusNotFound},
+		{"Discovered Service Over Limit", "/v1/channels", "", http.StatusTooManyRequests},
+		{"Unlimited Path", "/v1/sessions", "", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if len(c.auth) != 0 {
+			r.Header.Set(headerAuthorization, c.auth)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+		}
+		// At a few requests per minute, a token takes tens of seconds to come back.
+		if retryAfter := resp.Header().Get(headerRetryAfter); resp.Code == http.StatusTooManyRequests && len(retryAfter) != 2 {
+			t.Errorf("case %s: expected to retry after tens of seconds but got %q", c.name, retryAfter)
+		}
+		if c.path != "/v1/sessions" && len(resp.Header().Get(headerRateLimitRemaining)) == 0 {
+			t.Errorf("case %s: expected rate limit headers", c.name)
+		}
+	}
+
+	// Requests are let through if the store is down.
+	handler = NewRateLimitHandler(http.NotFoundHandler(), failingRateLimitStore{}, limits, serviceList, ctx)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/users", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected request to be let through while the store is down but got status code %d", resp.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxHeartbeat is the longest heartbeat a microservice may announce, in seconds.
+const maxHeartbeat = 3600
+
+// validServiceName matches the names microservices may announce.
+var validServiceName = regexp.MustCompile("^[a-z][a-z0-9-]{0,63}$")
+
+// validMethod matches HTTP methods.
+var validMethod = regexp.MustCompile("^[A-Za-z]+$")
+
+// Allowlist says which microservices may register,
+// and which resource paths they may claim.
+// The key is the name of a microservice,
+// and the value the path prefixes its routes are confined to.
+type Allowlist map[string][]string
+
+// ParseAllowlist parses an Allowlist in the form
+// "messaging=/v1/channels,/v1/messages;summary=/v1/summary".
+func ParseAllowlist(s string) (Allowlist, error) {
+	allowlist := Allowlist{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid allowlist entry %s: expect name=prefix,prefix", entry)
+		}
+		for _, prefix := range strings.Split(parts[1], ",") {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("invalid path prefix %s of %s: must begin with /", prefix, parts[0])
+			}
+			allowlist[parts[0]] = append(allowlist[parts[0]], prefix)
+		}
+	}
+	return allowlist, nil
+}
+
+// Validate validates the ReceivedService
+// and returns an error if it is not a valid announcement.
+func (receivedSvc *ReceivedService) Validate() error {
+	if !validServiceName.MatchString(receivedSvc.Name) {
+		return fmt.Errorf("invalid name %q: must be lowercase letters, digits and dashes", receivedSvc.Name)
+	}
+
+	host, port, err := net.SplitHostPort(receivedSvc.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", receivedSvc.Address, err)
+	}
+	if portNum, err := strconv.Atoi(port); len(host) == 0 || err != nil || portNum < 1 || portNum > 65535 {
+		return fmt.Errorf("invalid address %q: expect host:port", receivedSvc.Address)
+	}
+
+	switch receivedSvc.Type {
+	case "", AnnouncementHeartbeat:
+	case AnnouncementLeaving:
+		// Nothing else is needed to remove an instance.
+		return nil
+	default:
+		return fmt.Errorf("unknown announcement type %q", receivedSvc.Type)
+	}
+
+	if receivedSvc.Heartbeat < 1 || receivedSvc.Heartbeat > maxHeartbeat {
+		return fmt.Errorf("invalid heartbeat %d: must be between 1 and %d seconds", receivedSvc.Heartbeat, maxHeartbeat)
+	}
+
+	if len(receivedSvc.PathPattern) == 0 && len(receivedSvc.PathPrefix) == 0 {
+		return fmt.Errorf("no path pattern or path prefix found")
+	}
+	if len(receivedSvc.PathPrefix) != 0 && !strings.HasPrefix(receivedSvc.PathPrefix, "/") {
+		return fmt.Errorf("invalid path prefix %q: must begin with /", receivedSvc.PathPrefix)
+	}
+	if len(receivedSvc.PathPattern) != 0 {
+		if _, err := regexp.Compile(receivedSvc.PathPattern); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %v", receivedSvc.PathPattern, err)
+		}
+	}
+	for _, method := range receivedSvc.Methods {
+		if !validMethod.MatchString(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+
+	if len(receivedSvc.HealthPath) != 0 && !strings.HasPrefix(receivedSvc.HealthPath, "/") {
+		return fmt.Errorf("invalid health path %q: must begin with /", receivedSvc.HealthPath)
+	}
+	if _, found := newBalancer(receivedSvc.LoadBalancing); !found {
+		return fmt.Errorf("unknown load balancing strategy %q", receivedSvc.LoadBalancing)
+	}
+	if receivedSvc.Weight < 0 {
+		return fmt.Errorf("invalid weight %d: must not be negative", receivedSvc.Weight)
+	}
+	if receivedSvc.TimeoutMillis < 0 || receivedSvc.TimeoutMillis > maxTimeoutMillis {
+		return fmt.Errorf("invalid timeout %d: must be between 0 and %d milliseconds", receivedSvc.TimeoutMillis, maxTimeoutMillis)
+	}
+	if receivedSvc.Retries < 0 || receivedSvc.Retries > maxRetries {
+		return fmt.Errorf("invalid retries %d: must be between 0 and %d", receivedSvc.Retries, maxRetries)
+	}
+	if receivedSvc.HedgeAfterMillis < 0 || receivedSvc.HedgeAfterMillis > maxTimeoutMillis {
+		return fmt.Errorf("invalid hedge delay %d: must be between 0 and %d milliseconds", receivedSvc.HedgeAfterMillis, maxTimeoutMillis)
+	}
+	return nil
+}
+
+// claims returns the path prefixes the routes of the microservice
+// named name are confined to, or nil if they may claim any path.
+// It returns an error if the microservice may not register at all,
+// or announces a path prefix outside of its claims.
+func (allowlist Allowlist) claims(receivedSvc *ReceivedService) ([]string, error) {
+	if allowlist == nil {
+		return nil, nil
+	}
+	claims, found := allowlist[receivedSvc.Name]
+	if !found {
+		return nil, fmt.Errorf("microservice %s is not allowed to register", receivedSvc.Name)
+	}
+	if len(receivedSvc.PathPrefix) != 0 && !hasAnyPrefix(receivedSvc.PathPrefix, claims) {
+		return nil, fmt.Errorf("microservice %s is not allowed to claim path prefix %s", receivedSvc.Name, receivedSvc.PathPrefix)
+	}
+	return claims, nil
+}
+
+// hasAnyPrefix reports whether path is any of prefixes,
+// or below one of them. Prefixes end on a "/" boundary,
+// so that /v1/summary covers /v1/summary/x but not /v1/summaryx.
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"testing"
+)
+
+// validTestService returns a valid announcement to break in test cases.
+func validTestService() *ReceivedService {
+	return &ReceivedService{
+		Name:        "messaging",
+		PathPattern: "/v1/(channels|messages)/?",
+		Address:     "messaging:80",
+		Heartbeat:   10,
+	}
+}
+
+func TestReceivedServiceValidate(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(svc *ReceivedService)
+		expectError bool
+	}{
+		{
+			"Valid Service",
+			func(svc *ReceivedService) {},
+			false,
+		},
+		{
+			"Invalid Name",
+			func(svc *ReceivedService) { svc.Name = "Messaging Service" },
+			true,
+		},
+		{
+			"Missing Port",
+			func(svc *ReceivedService) { svc.Address = "messaging" },
+			true,
+		},
+		{
+			"Missing Host",
+			func(svc *ReceivedService) { svc.Address = ":80" },
+			true,
+		},
+		{
+			"Zero Heartbeat",
+			func(svc *ReceivedService) { svc.Heartbeat = 0 },
+			true,
+		},
+		{
+			"Invalid Path Pattern",
+			func(svc *ReceivedService) { svc.PathPattern = "/v1/(channels" },
+			true,
+		},
+		{
+			"No Path",
+			func(svc *ReceivedService) { svc.PathPattern = "" },
+			true,
+		},
+		{
+			"Relative Path Prefix",
+			func(svc *ReceivedService) { svc.PathPrefix = "v1/channels" },
+			true,
+		},
+		{
+			"Invalid Method",
+			func(svc *ReceivedService) { svc.Methods = []string{"GET /"} },
+			true,
+		},
+		{
+			"Unknown Strategy",
+			func(svc *ReceivedService) { svc.LoadBalancing = "random" },
+			true,
+		},
+		{
+			"Negative Weight",
+			func(svc *ReceivedService) { svc.Weight = -1 },
+			true,
+		},
+		{
+			"Negative Timeout",
+			func(svc *ReceivedService) { svc.TimeoutMillis = -1 },
+			true,
+		},
+		{
+			"Too Many Retries",
+			func(svc *ReceivedService) { svc.Retries = maxRetries + 1 },
+			true,
+		},
+		{
+			"Unknown Type",
+			func(svc *ReceivedService) { svc.Type = "crashed" },
+			true,
+		},
+		{
+			"Leaving Without Route",
+			func(svc *ReceivedService) {
+				*svc = ReceivedService{Type: AnnouncementLeaving, Name: svc.Name, Address: svc.Address}
+			},
+			false,
+		},
+		{
+			"Leaving Without Address",
+			func(svc *ReceivedService) { svc.Type, svc.Address = AnnouncementLeaving, "" },
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		svc := validTestService()
+		c.modify(svc)
+		err := svc.Validate()
+		if c.expectError && err == nil {
+			t.Errorf("case %s: expected validation error but didn't get one", c.name)
+		}
+		if !c.expectError && err != nil {
+			t.Errorf("case %s: unexpected validation error: %v", c.name, err)
+		}
+	}
+
+	// An invalid pattern must be rejected, not crash the gateway.
+	svc := validTestService()
+	svc.PathPattern = "("
+	if err := NewServiceList().Register(svc); err == nil {
+		t.Errorf("expected error registering an invalid path pattern")
+	}
+}
+
+func TestServiceListAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist("messaging=/v1/channels,/v1/messages; summary=/v1/summary")
+	if err != nil {
+		t.Fatalf("error parsing allowlist: %v", err)
+	}
+	if len(allowlist["messaging"]) != 2 || allowlist["summary"][0] != "/v1/summary" {
+		t.Fatalf("incorrect allowlist: %v", allowlist)
+	}
+	if _, err := ParseAllowlist("messaging=v1/channels"); err == nil {
+		t.Errorf("expected error parsing a relative path prefix")
+	}
+
+	serviceList := NewServiceList()
+	serviceList.SetAllowlist(allowlist)
+
+	unknown := validTestService()
+	unknown.Name = "evil"
+	if err := serviceList.Register(unknown); err == nil {
+		t.Errorf("expected error registering a service missing from the allowlist")
+	}
+
+	hijack := validTestService()
+	hijack.Name = "summary"
+	hijack.PathPrefix = "/v1/users"
+	if err := serviceList.Register(hijack); err == nil {
+		t.Errorf("expected error claiming a path prefix outside the allowlist")
+	}
+
+	// A pattern matching more than the service may claim
+	// is confined to its claims.
+	greedy := validTestService()
+	greedy.Name = "summary"
+	greedy.PathPattern = ".*"
+	if err := serviceList.Register(greedy); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+	if svc, _ := serviceList.match("GET", "/v1/summary"); svc == nil {
+		t.Errorf("expected the service to match its claimed path")
+	}
+	if svc, _ := serviceList.match("GET", "/v1/users"); svc != nil {
+		t.Errorf("expected the service not to match a path outside its claims")
+	}
+
+	// Claims end on "/" boundaries.
+	if svc, _ := serviceList.match("GET", "/v1/summary/preview"); svc == nil {
+		t.Errorf("expected the service to match a path below its claimed path")
+	}
+	if svc, _ := serviceList.match("GET", "/v1/summaryx"); svc != nil {
+		t.Errorf("expected the service not to match a path merely beginning with its claimed path")
+	}
+	sibling := validTestService()
+	sibling.Name = "summary"
+	sibling.PathPrefix = "/v1/summaryx"
+	if err := serviceList.Register(sibling); err == nil {
+		t.Errorf("expected error claiming a path prefix merely beginning with a claimed path")
+	}
+}
+
+func TestServiceListReserve(t *testing.T) {
+	serviceList := NewServiceList()
+	serviceList.Reserve("/v1/sessions", AdminServicesPath)
+
+	// Even a service that may claim any path
+	// doesn't get the gateway's own paths.
+	greedy := validTestService()
+	greedy.PathPattern = ".*"
+	if err := serviceList.Register(greedy); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+	cases := []struct {
+		name          string
+		path          string
+		expectedMatch bool
+	}{
+		{"Reserved Path", "/v1/sessions", false},
+		{"Below Reserved Path", "/v1/sessions/mine", false},
+		{"Admin Path", AdminServicesPath + "/messaging", false},
+		{"Sibling Of Reserved Path", "/v1/sessionsx", true},
+		{"Other Path", "/v1/channels", true},
+	}
+	for _, c := range cases {
+		if svc, _ := serviceList.match("GET", c.path); (svc != nil) != c.expectedMatch {
+			t.Errorf("case %s: expected match: %t, but got %v", c.name, c.expectedMatch, svc)
+		}
+	}
+
+	hijack := validTestService()
+	hijack.Name = "hijack"
+	hijack.PathPrefix = "/v1/sessions/mine"
+	if err := serviceList.Register(hijack); err == nil {
+		t.Errorf("expected error claiming a path prefix the gateway serves")
+	}
+}
+
+func TestServiceListLeaving(t *testing.T) {
+	serviceList := NewServiceList()
+	for _, addr := range []string{"messaging1:80", "messaging2:80"} {
+		svc := validTestService()
+		svc.Address = addr
+		serviceList.Register(svc)
+	}
+	if err := serviceList.AddFallback(validTestService(), []string{"static:80"}); err != nil {
+		t.Fatalf("error adding fallback: %v", err)
+	}
+
+	leave := func(addr string) {
+		if err := serviceList.Register(&ReceivedService{Type: AnnouncementLeaving, Name: "messaging", Address: addr}); err != nil {
+			t.Fatalf("error announcing leaving instance: %v", err)
+		}
+	}
+
+	// The leaving instance gets no more requests,
+	// without waiting for its heartbeats to be missed.
+	leave("messaging1:80")
+	svc := serviceList.services["messaging"]
+	for i := 0; i < 4; i++ {
+		if instance := svc.pick(""); instance.address != "messaging2:80" {
+			t.Errorf("expected leaving instance to get no requests but got %s", instance.address)
+		}
+	}
+
+	// Instances that already left, and static instances, are ignored.
+	leave("messaging1:80")
+	leave("static:80")
+	if _, found := svc.instances["static:80"]; !found {
+		t.Errorf("expected static instance to be kept")
+	}
+
+	leave("messaging2:80")
+	if instance := svc.pick(""); instance == nil || instance.address != "static:80" {
+		t.Errorf("expected to fall back to the static address once all discovered instances left")
+	}
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServiceNotFound is returned when there is no microservice with a given name.
+var ErrServiceNotFound = errors.New("microservice not found")
+
+// ErrInstanceNotFound is returned when a microservice has no instance at a given address.
+var ErrInstanceNotFound = errors.New("microservice instance not found")
+
+// defaultStaticHeartbeat is the heartbeat given to microservices
+// that are only known from static addresses.
+const defaultStaticHeartbeat = 10
+
+// ServiceInfo describes a registered microservice.
+type ServiceInfo struct {
+	Name          string          `json:"name"`
+	PathPattern   string          `json:"pathPattern,omitempty"`
+	PathPrefix    string          `json:"pathPrefix,omitempty"`
+	Priority      int             `json:"priority"`
+	Methods       []string        `json:"methods,omitempty"`
+	LoadBalancing string          `json:"loadBalancing,omitempty"`
+	Pinned        bool            `json:"pinned"`
+	Instances     []*InstanceInfo `json:"instances"`
+}
+
+// InstanceInfo describes an instance of a registered microservice.
+type InstanceInfo struct {
+	Address       string    `json:"address"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	Static        bool      `json:"static"`
+	Pinned        bool      `json:"pinned"`
+	Draining      bool      `json:"draining"`
+	// Circuit is the state of the instance's circuit breaker.
+	Circuit     string `json:"circuit"`
+	Outstanding int64  `json:"outstanding"`
+	Weight      int    `json:"weight"`
+}
+
+// Services describes every registered microservice, sorted by name.
+func (serviceList *ServiceList) Services() []*ServiceInfo {
+	serviceList.mx.RLock()
+	defer serviceList.mx.RUnlock()
+	infos := []*ServiceInfo{}
+	for _, svc := range serviceList.services {
+		infos = append(infos, svc.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Service describes the microservice with the given name.
+func (serviceList *ServiceList) Service(name string) (*ServiceInfo, error) {
+	serviceList.mx.RLock()
+	defer serviceList.mx.RUnlock()
+	svc, found := serviceList.services[name]
+	if !found {
+		return nil, ErrServiceNotFound
+	}
+	return svc.info(), nil
+}
+
+// info describes the service.
+// Callers must hold at least a read lock on the ServiceList.
+func (svc *service) info() *ServiceInfo {
+	info := &ServiceInfo{
+		Name:          svc.name,
+		PathPrefix:    svc.route.pathPrefix,
+		Priority:      svc.route.priority,
+		Methods:       svc.route.allowed(),
+		LoadBalancing: svc.strategy,
+		Pinned:        svc.pinned,
+		Instances:     []*InstanceInfo{},
+	}
+	if svc.route.pathPatternRegexp != nil {
+		info.PathPattern = svc.route.pathPatternRegexp.String()
+	}
+	for _, instance := range svc.instances {
+		info.Instances = append(info.Instances, &InstanceInfo{
+			Address:       instance.address,
+			LastHeartbeat: instance.lastHeartbeat,
+			Static:        instance.static,
+			Pinned:        instance.pinned,
+			Draining:      instance.draining,
+			Circuit:       instance.breaker.currentState().String(),
+			Outstanding:   atomic.LoadInt64(&instance.outstanding),
+			Weight:        instance.weight,
+		})
+	}
+	sort.Slice(info.Instances, func(i, j int) bool {
+		return info.Instances[i].Address < info.Instances[j].Address
+	})
+	return info
+}
+
+// Drain stops sending new requests to an instance if draining is true,
+// or lets it have requests again if it is false.
+func (serviceList *ServiceList) Drain(name string, addr string, draining bool) error {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	instance, err := serviceList.instance(name, addr)
+	if err != nil {
+		return err
+	}
+	instance.draining = draining
+	log.Printf("Microservice %s: instance with address %s draining: %t", name, addr, draining)
+	return nil
+}
+
+// Deregister removes an instance right away,
+// instead of waiting for its heartbeats to stop.
+// A discovered instance that is still running comes back with its next heartbeat,
+// so drain it first to keep it from getting requests.
+func (serviceList *ServiceList) Deregister(name string, addr string) error {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	if _, err := serviceList.instance(name, addr); err != nil {
+		return err
+	}
+	log.Printf("Microservice %s: instance with address %s deregistered", name, addr)
+	serviceList.removeInstance(name, addr)
+	return nil
+}
+
+// Pin sends every request of a microservice to static addresses,
+// ignoring discovered and fallback instances until it is unpinned.
+// If the microservice is not registered yet,
+// receivedSvc must describe its route.
+func (serviceList *ServiceList) Pin(receivedSvc *ReceivedService, addrs []string) error {
+	return serviceList.addStatic(receivedSvc, addrs, true)
+}
+
+// AddFallback adds static addresses a microservice falls back to
+// whenever none of its discovered instances is available.
+func (serviceList *ServiceList) AddFallback(receivedSvc *ReceivedService, addrs []string) error {
+	return serviceList.addStatic(receivedSvc, addrs, false)
+}
+
+// Unpin lets a pinned microservice use its discovered instances again,
+// and removes the instances that pinning it added.
+// Fallbacks and discovered instances it was pinned to are kept.
+func (serviceList *ServiceList) Unpin(name string) error {
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	svc, found := serviceList.services[name]
+	if !found {
+		return ErrServiceNotFound
+	}
+	if !svc.pinned {
+		return fmt.Errorf("microservice %s is not pinned", name)
+	}
+	svc.pinned = false
+	for addr, instance := range svc.instances {
+		if !instance.pinned {
+			continue
+		}
+		instance.pinned = false
+		if instance.pinAdded && !instance.static {
+			serviceList.removeInstance(name, addr)
+		}
+		instance.pinAdded = false
+	}
+	log.Printf("Microservice %s: unpinned", name)
+	return nil
+}
+
+// addStatic adds static instances at addrs to a microservice,
+// either as the instances it is pinned to or as fallbacks.
+// Static addresses are configured by operators,
+// so unlike announcements they are not held to the allowlist.
+func (serviceList *ServiceList) addStatic(receivedSvc *ReceivedService, addrs []string, pinned bool) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses found")
+	}
+
+	serviceList.mx.Lock()
+	defer serviceList.mx.Unlock()
+	svc, hasSvc := serviceList.services[receivedSvc.Name]
+
+	hasRoute := len(receivedSvc.PathPattern) != 0 || len(receivedSvc.PathPrefix) != 0
+	if !hasSvc && !hasRoute {
+		return fmt.Errorf("microservice %s is not registered, so a path pattern or path prefix is required", receivedSvc.Name)
+	}
+
+	// Validate every address along with the route,
+	// standing in for the route of the registered service if none is given.
+	for _, addr := range addrs {
+		candidate := *receivedSvc
+		candidate.Address = addr
+		if candidate.Heartbeat == 0 {
+			candidate.Heartbeat = defaultStaticHeartbeat
+		}
+		if !hasRoute && hasSvc {
+			candidate.PathPrefix = "/"
+		}
+		if err := candidate.Validate(); err != nil {
+			return fmt.Errorf("invalid static microservice %s: %v", receivedSvc.Name, err)
+		}
+	}
+
+	if !hasSvc {
+		rt, err := newRoute(receivedSvc, nil)
+		if err != nil {
+			return err
+		}
+		svc = newService(
+			receivedSvc.Name,
+			rt,
+			defaultStaticHeartbeat,
+			receivedSvc.HealthPath,
+			receivedSvc.LoadBalancing,
+			make(map[string]*serviceInstance),
+		)
+		svc.policy = newCallPolicy(receivedSvc)
+		serviceList.services[receivedSvc.Name] = svc
+		serviceList.sortRoutes()
+		serviceList.logConflicts(svc)
+	} else if hasRoute {
+		rt, err := newRoute(receivedSvc, svc.route.claims)
+		if err != nil {
+			return err
+		}
+		if !rt.equal(svc.route) {
+			svc.route = rt
+			serviceList.sortRoutes()
+			serviceList.logConflicts(svc)
+		}
+	}
+
+	svc.pinned = svc.pinned || pinned
+	for _, addr := range addrs {
+		instance, found := svc.instances[addr]
+		if !found {
+			instance = newServiceInstance(addr, time.Now(), 1)
+			instance.pinAdded = pinned
+			svc.instances[addr] = instance
+		}
+		if pinned {
+			instance.pinned = true
+		} else {
+			instance.static = true
+		}
+	}
+	log.Printf("Microservice %s: static addresses %v added, pinned: %t", receivedSvc.Name, addrs, svc.pinned)
+	return nil
+}
+
+// instance returns the instance of a microservice at addr.
+// Callers must hold at least a read lock on the ServiceList.
+func (serviceList *ServiceList) instance(name string, addr string) (*serviceInstance, error) {
+	svc, found := serviceList.services[name]
+	if !found {
+		return nil, ErrServiceNotFound
+	}
+	instance, found := svc.instances[addr]
+	if !found {
+		return nil, ErrInstanceNotFound
+	}
+	return instance, nil
+}
+
+// removeInstance removes the instance of a microservice at addr,
+// and the microservice itself if it has no instance left.
+// Callers must hold a write lock on the ServiceList.
+func (serviceList *ServiceList) removeInstance(name string, addr string) {
+	svc, found := serviceList.services[name]
+	if !found {
+		return
+	}
+	delete(svc.instances, addr)
+	if len(svc.instances) == 0 {
+		log.Printf("Dangling microservice %s removed\n", name)
+		delete(serviceList.services, name)
+		serviceList.sortRoutes()
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// route decides which requests are forwarded to a microservice.
+type route struct {
+	// pathPatternRegexp, if not nil, must match the resource path.
+	pathPatternRegexp *regexp.Regexp
+	// pathPrefix, if not empty, must begin the resource path.
+	pathPrefix string
+	// priority puts routes with higher priorities first.
+	priority int
+	// methods are the HTTP methods the route accepts.
+	// A nil map accepts any method.
+	methods map[string]bool
+	// prefix is the literal path prefix every path the route matches begins with.
+	// Among routes of equal priority, the one with the longest prefix comes first.
+	prefix string
+	// claims, if not nil, are the path prefixes the allowlist confines the route to.
+	claims []string
+}
+
+// newRoute constructs the route announced by a microservice,
+// confined to claims.
+func newRoute(receivedSvc *ReceivedService, claims []string) (*route, error) {
+	rt := &route{
+		pathPrefix: receivedSvc.PathPrefix,
+		priority:   receivedSvc.Priority,
+		prefix:     receivedSvc.PathPrefix,
+		claims:     claims,
+	}
+	if len(receivedSvc.PathPattern) != 0 {
+		pathPatternRegexp, err := regexp.Compile(receivedSvc.PathPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling path pattern: %v", err)
+		}
+		rt.pathPatternRegexp = pathPatternRegexp
+		if len(rt.prefix) == 0 {
+			// Anchors don't change the literal prefix,
+			// but they stop the regexp package from finding it.
+			if unanchored, err := regexp.Compile(strings.TrimPrefix(receivedSvc.PathPattern, "^")); err == nil {
+				rt.prefix, _ = unanchored.LiteralPrefix()
+			}
+		}
+	}
+	if len(receivedSvc.Methods) != 0 {
+		rt.methods = make(map[string]bool)
+		for _, method := range receivedSvc.Methods {
+			rt.methods[strings.ToUpper(method)] = true
+		}
+	}
+	return rt, nil
+}
+
+// matchesPath reports whether path goes to the route.
+func (rt *route) matchesPath(path string) bool {
+	if !strings.HasPrefix(path, rt.pathPrefix) {
+		return false
+	}
+	// A pattern can match far more than it seems to,
+	// so never let it reach beyond what the microservice may claim.
+	if rt.claims != nil && !hasAnyPrefix(path, rt.claims) {
+		return false
+	}
+	return rt.pathPatternRegexp == nil || rt.pathPatternRegexp.MatchString(path)
+}
+
+// allows reports whether the route accepts method.
+func (rt *route) allows(method string) bool {
+	return rt.methods == nil || rt.methods[method]
+}
+
+// allowed returns the methods the route accepts, sorted.
+func (rt *route) allowed() []string {
+	methods := []string{}
+	for method := range rt.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// equal reports whether rt and other match the same requests in the same order.
+func (rt *route) equal(other *route) bool {
+	if rt.pathPrefix != other.pathPrefix || rt.priority != other.priority {
+		return false
+	}
+	if (rt.pathPatternRegexp == nil) != (other.pathPatternRegexp == nil) {
+		return false
+	}
+	if rt.pathPatternRegexp != nil && rt.pathPatternRegexp.String() != other.pathPatternRegexp.String() {
+		return false
+	}
+	if strings.Join(rt.claims, ",") != strings.Join(other.claims, ",") {
+		return false
+	}
+	return strings.Join(rt.allowed(), ",") == strings.Join(other.allowed(), ",")
+}
+
+// conflicts reports whether rt and other may both match a request,
+// with nothing but the names of their microservices to decide between them.
+func (rt *route) conflicts(other *route) bool {
+	if rt.priority != other.priority || rt.prefix != other.prefix {
+		return false
+	}
+	if rt.methods == nil || other.methods == nil {
+		return true
+	}
+	for method := range rt.methods {
+		if other.methods[method] {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRoutes orders the services by route,
+// from the highest priority and longest prefix down,
+// with the name of the service breaking ties,
+// so that a path matched by several routes always goes to the same service.
+// Callers must hold a write lock on the ServiceList.
+func (serviceList *ServiceList) sortRoutes() {
+	routes := make([]*service, 0, len(serviceList.services))
+	for _, svc := range serviceList.services {
+		routes = append(routes, svc)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.route.priority != b.route.priority {
+			return a.route.priority > b.route.priority
+		}
+		if len(a.route.prefix) != len(b.route.prefix) {
+			return len(a.route.prefix) > len(b.route.prefix)
+		}
+		return a.name < b.name
+	})
+	serviceList.routes = routes
+}
+
+// logConflicts logs every service whose route conflicts with the route of svc.
+// Callers must hold at least a read lock on the ServiceList.
+func (serviceList *ServiceList) logConflicts(svc *service) {
+	for _, other := range serviceList.routes {
+		if other == svc || !svc.route.conflicts(other.route) {
+			continue
+		}
+		winner := svc.name
+		if other.name < winner {
+			winner = other.name
+		}
+		log.Printf("Microservice %s: route conflicts with microservice %s, requests matching both go to %s; "+
+			"announce a Priority, PathPrefix or Methods to tell them apart", svc.name, other.name, winner)
+	}
+}
+
+// match returns the service the request with the given method and path goes to.
+// If routes match the path but none accepts the method,
+// it returns nil along with the methods they accept.
+// Callers must hold at least a read lock on the ServiceList.
+func (serviceList *ServiceList) match(method string, path string) (*service, []string) {
+	// Whatever their patterns say, microservices never get
+	// the requests for the gateway's own paths.
+	if hasAnyPrefix(path, serviceList.reserved) {
+		return nil, nil
+	}
+	allowed := make(map[string]bool)
+	for _, svc := range serviceList.routes {
+		if !svc.route.matchesPath(path) {
+			continue
+		}
+		if svc.route.allows(method) {
+			return svc, nil
+		}
+		for _, m := range svc.route.allowed() {
+			allowed[m] = true
+		}
+	}
+	methods := []string{}
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return nil, methods
+}
+
+// serviceName returns the name of the microservice
+// the request with the given method and path goes to,
+// or an empty string if it goes to none.
+func (serviceList *ServiceList) serviceName(method string, path string) string {
+	serviceList.mx.RLock()
+	defer serviceList.mx.RUnlock()
+	if svc, _ := serviceList.match(method, path); svc != nil {
+		return svc.name
+	}
+	return ""
+}
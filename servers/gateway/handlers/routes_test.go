@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceListMatch(t *testing.T) {
+	serviceList := NewServiceList()
+	for _, svc := range []*ReceivedService{
+		{Name: "messaging", PathPattern: "/v1/(channels|messages)/?"},
+		{Name: "channels-admin", PathPrefix: "/v1/channels/admin"},
+		{Name: "summary", PathPattern: "^/v1/summary$", Methods: []string{"get"}},
+		{Name: "catch-all", PathPattern: ".*", Priority: -1},
+		{Name: "override", PathPrefix: "/v1/messages/pinned", Priority: 1, Methods: []string{"GET"}},
+		// Conflicts with messaging, and loses since its name comes later.
+		{Name: "shadow", PathPattern: "/v1/(channels|messages)/?"},
+	} {
+		svc.Address = svc.Name + ":80"
+		svc.Heartbeat = 10
+		if err := serviceList.Register(svc); err != nil {
+			t.Fatalf("error registering %s: %v", svc.Name, err)
+		}
+	}
+
+	cases := []struct {
+		name            string
+		method          string
+		path            string
+		expectedService string
+	}{
+		{
+			"Pattern",
+			"GET",
+			"/v1/channels",
+			"messaging",
+		},
+		{
+			"Longest Prefix Wins",
+			"POST",
+			"/v1/channels/admin/settings",
+			"channels-admin",
+		},
+		{
+			"Higher Priority Wins",
+			"GET",
+			"/v1/messages/pinned",
+			"override",
+		},
+		{
+			"Method Constraint Falls Through",
+			"DELETE",
+			"/v1/messages/pinned",
+			"messaging",
+		},
+		{
+			"Lowest Priority Catches The Rest",
+			"GET",
+			"/v1/unknown",
+			"catch-all",
+		},
+	}
+
+	for _, c := range cases {
+		svc, allowed := serviceList.match(c.method, c.path)
+		if svc == nil {
+			t.Errorf("case %s: expected %s to match but got allowed methods %v", c.name, c.expectedService, allowed)
+			continue
+		}
+		if svc.name != c.expectedService {
+			t.Errorf("case %s: expected %s to match but got %s", c.name, c.expectedService, svc.name)
+		}
+	}
+}
+
+func TestDSDHandlerMethodNotAllowed(t *testing.T) {
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "summary",
+		PathPattern: "^/v1/summary$",
+		Methods:     []string{"GET", "HEAD"},
+		Address:     "summary:80",
+		Heartbeat:   10,
+	})
+	handler := newTestDSDHandler(serviceList)
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/v1/summary", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("incorrect status code: expected %d but got %d", http.StatusMethodNotAllowed, resp.Code)
+	}
+	if allow := resp.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("incorrect Allow header: %s", allow)
+	}
+
+	// Paths no route matches still go to the gateway's own handlers.
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/v1/users", nil))
+	if resp.Code != http.StatusNotFound || strings.Contains(resp.Body.String(), "method") {
+		t.Errorf("expected unrouted path to reach the wrapped handler but got %d", resp.Code)
+	}
+}
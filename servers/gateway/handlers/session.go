@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"net/http"
+)
+
+// resolvedSession is the outcome of looking up
+// the session a request belongs to.
+type resolvedSession struct {
+	id    sessions.SessionID
+	state SessionState
+	err   error
+}
+
+// sessionKey is the context key of the resolvedSession of a request.
+const sessionKey = contextKey("session")
+
+// SessionHandler is a middleware handler that looks up
+// the session of every request once, so that the rate limiter,
+// the DSDHandler and the final handler don't each
+// make their own round-trip to the session store.
+type SessionHandler struct {
+	handler http.Handler
+	ctx     *HandlerContext
+}
+
+// NewSessionHandler wraps another handler into SessionHandler.
+func NewSessionHandler(handlerToWrap http.Handler, ctx *HandlerContext) *SessionHandler {
+	if ctx == nil {
+		panic("nil handler context")
+	}
+	return &SessionHandler{handlerToWrap, ctx}
+}
+
+// ServeHTTP implements the http.Handler interface for the SessionHandler.
+// Requests without a valid session are passed on too,
+// and left for the handlers after it to turn away.
+func (sh *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resolved := &resolvedSession{}
+	resolved.id, resolved.err = sessions.GetState(r, sh.ctx.SigningKey, sh.ctx.SessionStore, &resolved.state)
+	sh.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey, resolved)))
+}
+
+// getSessionState gets the state of the session r belongs to,
+// like sessions.GetState, but reuses the session
+// the SessionHandler looked up, if there is one.
+func (ctx *HandlerContext) getSessionState(r *http.Request, sessionState *SessionState) (sessions.SessionID, error) {
+	resolved, ok := r.Context().Value(sessionKey).(*resolvedSession)
+	if !ok {
+		return sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
+	}
+	if resolved.err != nil {
+		return resolved.id, resolved.err
+	}
+	*sessionState = resolved.state
+	// Handlers may change the user they get, such as when updating it,
+	// so give each one its own copy.
+	if resolved.state.User != nil {
+		user := *resolved.state.User
+		sessionState.User = &user
+	}
+	return resolved.id, nil
+}
+
+// currentUser returns the user of the session r belongs to,
+// or nil if there is none.
+func (ctx *HandlerContext) currentUser(r *http.Request) *users.User {
+	sessionState := &SessionState{}
+	_, err := ctx.getSessionState(r, sessionState)
+	if err != nil {
+		return nil
+	}
+	return sessionState.User
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// countingStore is a session Store counting the sessions it gets.
+type countingStore struct {
+	sessions.Store
+	gets int64
+}
+
+// Get gets the session state, and counts it.
+func (s *countingStore) Get(sid sessions.SessionID, sessionState interface{}) error {
+	atomic.AddInt64(&s.gets, 1)
+	return s.Store.Get(sid, sessionState)
+}
+
+func TestSessionHandler(t *testing.T) {
+	store := &countingStore{Store: sessions.NewMemStore(time.Hour, time.Minute)}
+	ctx := &HandlerContext{SigningKey: "test key", SessionStore: store}
+	user := &users.User{ID: bson.NewObjectId(), FirstName: "Alice"}
+	signIn := httptest.NewRecorder()
+	if _, err := sessions.BeginSession(ctx.SigningKey, ctx.SessionStore, &SessionState{time.Now(), user}, signIn); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+
+	forged, err := sessions.NewSessionID("another key")
+	if err != nil {
+		t.Fatalf("error creating session ID: %v", err)
+	}
+
+	// Handlers asking for the session several times,
+	// and changing the user they get.
+	var got []*users.User
+	var names []string
+	handler := NewSessionHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			sessionState := &SessionState{}
+			if _, err := ctx.getSessionState(r, sessionState); err != nil {
+				got = append(got, nil)
+				continue
+			}
+			got = append(got, sessionState.User)
+			names = append(names, sessionState.User.FirstName)
+			sessionState.User.FirstName = "Mallory"
+		}
+	}), ctx)
+
+	cases := []struct {
+		name         string
+		auth         string
+		expectedUser bool
+	}{
+		{"Signed-In User", signIn.Header().Get(headerAuthorization), true},
+		{"Forged Session", "Bearer " + string(forged), false},
+	}
+
+	for _, c := range cases {
+		got = nil
+		names = nil
+		atomic.StoreInt64(&store.gets, 0)
+		r := httptest.NewRequest("GET", "/v1/users/me", nil)
+		if len(c.auth) != 0 {
+			r.Header.Set(headerAuthorization, c.auth)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if gets := atomic.LoadInt64(&store.gets); gets > 1 {
+			t.Errorf("case %s: expected the session to be looked up at most once but got %d lookups", c.name, gets)
+		}
+		for _, u := range got {
+			if (u != nil) != c.expectedUser {
+				t.Errorf("case %s: expected user: %t, but got %v", c.name, c.expectedUser, u)
+			}
+			if u != nil && u.ID != user.ID {
+				t.Errorf("case %s: expected user %s but got %s", c.name, user.ID.Hex(), u.ID.Hex())
+			}
+		}
+		for _, name := range names {
+			if name != user.FirstName {
+				t.Errorf("case %s: expected each lookup to get its own copy of the user but got first name %s", c.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on the call policies microservices may announce.
+const (
+	maxTimeoutMillis = 5 * 60 * 1000
+	maxRetries       = 3
+)
+
+// callPolicy says how the gateway calls a microservice.
+type callPolicy struct {
+	// timeout is the budget of a request, across all of its attempts,
+	// including reading the response. Zero means no timeout.
+	timeout time.Duration
+	// retries is how many other instances an idempotent request
+	// is sent to after a connection failure or a 503.
+	retries int
+	// hedgeAfter is how long an idempotent request waits for an instance
+	// before it is also sent to another one, if it has retries left.
+	// Zero means no hedging.
+	hedgeAfter time.Duration
+}
+
+// newCallPolicy returns the call policy announced in receivedSvc.
+func newCallPolicy(receivedSvc *ReceivedService) callPolicy {
+	return callPolicy{
+		timeout:    time.Duration(receivedSvc.TimeoutMillis) * time.Millisecond,
+		retries:    receivedSvc.Retries,
+		hedgeAfter: time.Duration(receivedSvc.HedgeAfterMillis) * time.Millisecond,
+	}
+}
+
+// proxyCall is a request the DSDHandler forwards to a microservice.
+type proxyCall struct {
+	serviceList *ServiceList
+	svc         *service
+	// key is the key the request is balanced by.
+	key string
+	// instance is the instance the first attempt goes to.
+	instance *serviceInstance
+	// attempts is the number of instances the request was sent to.
+	attempts int
+}
+
+// callKey is the context key of the proxyCall of a request.
+const callKey = contextKey("call")
+
+// next picks an instance the call has not tried yet,
+// or returns nil if there is none available.
+func (call *proxyCall) next(tried []*serviceInstance) *serviceInstance {
+	call.serviceList.mx.RLock()
+	defer call.serviceList.mx.RUnlock()
+	return call.svc.pick(call.key, tried...)
+}
+
+// attempt is the outcome of sending a request to one instance.
+type attempt struct {
+	instance *serviceInstance
+	resp     *http.Response
+	err      error
+	// cancel cancels the request to the instance.
+	cancel context.CancelFunc
+}
+
+// retryable reports whether another instance might answer
+// the request of a failed attempt.
+func (a *attempt) retryable() bool {
+	return a.err != nil || a.resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// discard releases everything the attempt holds.
+func (a *attempt) discard() {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+}
+
+// serviceTransport sends the requests of a microservice
+// to its instances according to its call policy,
+// and reports every outcome to the instance's circuit breaker.
+type serviceTransport struct {
+	svc       *service
+	transport http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface for the serviceTransport.
+// Idempotent requests are retried on other instances
+// after a connection failure or a 503, and hedged if they take too long,
+// until one of the attempts answers or the retries run out.
+func (t *serviceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := req.Context().Value(callKey).(*proxyCall)
+	call.serviceList.mx.RLock()
+	policy := t.svc.policy
+	call.serviceList.mx.RUnlock()
+
+	// Only idempotent requests without a body may be sent more than once.
+	maxAttempts := 1
+	if (req.Method == "GET" || req.Method == "HEAD") && (req.Body == nil || req.Body == http.NoBody) {
+		maxAttempts += policy.retries
+	}
+
+	var budget context.Context
+	var cancelBudget context.CancelFunc
+	if policy.timeout > 0 {
+		budget, cancelBudget = context.WithTimeout(req.Context(), policy.timeout)
+	} else {
+		budget, cancelBudget = context.WithCancel(req.Context())
+	}
+
+	attempts := make(chan *attempt, maxAttempts)
+	tried := []*serviceInstance{}
+	pending := []*attempt{}
+	launch := func(instance *serviceInstance) {
+		ctx, cancel := context.WithCancel(budget)
+		a := &attempt{instance: instance, cancel: cancel}
+		tried = append(tried, instance)
+		pending = append(pending, a)
+		go func() {
+			a.resp, a.err = t.try(ctx, req, instance)
+			attempts <- a
+		}()
+	}
+	// hedge returns a channel that fires when the latest attempt
+	// has taken too long, or nil if no more attempts may be hedged.
+	hedge := func() <-chan time.Time {
+		if policy.hedgeAfter <= 0 || len(tried) >= maxAttempts {
+			return nil
+		}
+		return time.After(policy.hedgeAfter)
+	}
+
+	launch(call.instance)
+	hedgeC := hedge()
+	var last *attempt
+	done := false
+	for !done && len(pending) != 0 {
+		select {
+		case a := <-attempts:
+			pending = removeAttempt(pending, a)
+			if last != nil {
+				last.discard()
+			}
+			last = a
+			// Stop at the first answer, or once the budget is spent
+			// or the client is gone.
+			if !a.retryable() || budget.Err() != nil {
+				done = true
+			} else if len(tried) < maxAttempts {
+				if instance := call.next(tried); instance != nil {
+					launch(instance)
+					hedgeC = hedge()
+				}
+			}
+		case <-hedgeC:
+			hedgeC = nil
+			if instance := call.next(tried); instance != nil {
+				launch(instance)
+				hedgeC = hedge()
+			}
+		}
+	}
+	call.attempts = len(tried)
+	// Log which instance the answer, or the last error, came from.
+	entry := accesslog.FromContext(req.Context())
+	entry.Instance = last.instance.address
+	entry.Attempts = call.attempts
+
+	// Cancel the attempts still in flight, and release their responses.
+	if len(pending) != 0 {
+		for _, a := range pending {
+			a.cancel()
+		}
+		go func(n int) {
+			for i := 0; i < n; i++ {
+				(<-attempts).discard()
+			}
+		}(len(pending))
+	}
+
+	if last.err != nil {
+		last.cancel()
+		cancelBudget()
+		return nil, last.err
+	}
+	// The budget covers reading the response too,
+	// so it is only released once the proxy is done with it.
+	last.resp.Body = &releasingBody{ReadCloser: last.resp.Body, release: func() {
+		last.cancel()
+		cancelBudget()
+	}}
+	return last.resp, nil
+}
+
+// removeAttempt removes a from attempts.
+func removeAttempt(attempts []*attempt, a *attempt) []*attempt {
+	for i, pending := range attempts {
+		if pending == a {
+			return append(attempts[:i], attempts[i+1:]...)
+		}
+	}
+	return attempts
+}
+
+// try sends req to instance, and reports the outcome to its circuit breaker.
+// The instance counts the request as outstanding until its response is closed.
+// Each attempt is traced, and the instance gets the attempt's trace context.
+func (t *serviceTransport) try(ctx context.Context, req *http.Request, instance *serviceInstance) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "proxy "+t.svc.name)
+	span.SetAttribute("service.instance", instance.address)
+
+	outReq := req.WithContext(ctx)
+	target := *req.URL
+	target.Host = instance.address
+	outReq.URL = &target
+	if span != nil {
+		// Attempts may run at the same time, so each needs its own headers.
+		outReq.Header = cloneHeader(req.Header)
+		tracing.Inject(ctx, outReq.Header)
+	}
+
+	atomic.AddInt64(&instance.outstanding, 1)
+	resp, err := t.transport.RoundTrip(outReq)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		atomic.AddInt64(&instance.outstanding, -1)
+		// A request canceled by the client,
+		// or by the gateway because another instance answered first,
+		// says nothing about the instance.
+		// Running out of time does.
+		if ctx.Err() == context.Canceled {
+			instance.breaker.abandon()
+		} else if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after error: %v", t.svc.name, instance.address, err)
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode >= 500 {
+		if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after failing with status code %d", t.svc.name, instance.address, resp.StatusCode)
+		}
+	} else if instance.breaker.success() {
+		log.Printf("Microservice %s: instance with address %s recovered", t.svc.name, instance.address)
+	}
+	span.SetAttribute("http.status", resp.StatusCode)
+	// The span covers reading the response too.
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+		atomic.AddInt64(&instance.outstanding, -1)
+		span.End()
+	}}
+	return resp, nil
+}
+
+// releasingBody is a response body that calls release once it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+// Close closes the body and calls release, once.
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
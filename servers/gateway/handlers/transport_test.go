@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerTestInstances registers every server as an instance
+// of a microservice with the given call policy.
+func registerTestInstances(serviceList *ServiceList, timeoutMillis int, retries int, hedgeAfterMillis int, servers ...*httptest.Server) {
+	for _, srv := range servers {
+		serviceList.Register(&ReceivedService{
+			Name:             "test",
+			PathPattern:      "^/v1/test",
+			Address:          strings.TrimPrefix(srv.URL, "http://"),
+			Heartbeat:        10,
+			TimeoutMillis:    timeoutMillis,
+			Retries:          retries,
+			HedgeAfterMillis: hedgeAfterMillis,
+		})
+	}
+}
+
+// newSlowTestService starts a microservice instance
+// responding with status after delay.
+func newSlowTestService(status int, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.WriteHeader(status)
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestServiceTransportRetries(t *testing.T) {
+	healthy := newTestService(http.StatusOK)
+	defer healthy.Close()
+	unavailable := newTestService(http.StatusServiceUnavailable)
+	defer unavailable.Close()
+	// An instance whose address nothing listens on.
+	dead := newTestService(http.StatusOK)
+	dead.Close()
+
+	cases := []struct {
+		name           string
+		method         string
+		retries        int
+		failing        *httptest.Server
+		expectAllOK    bool
+		expectedStatus int
+	}{
+		{
+			"Retry GET After 503",
+			"GET",
+			1,
+			unavailable,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Retry HEAD After Connection Failure",
+			"HEAD",
+			1,
+			dead,
+			true,
+			http.StatusOK,
+		},
+		{
+			"No Retries Declared",
+			"GET",
+			0,
+			unavailable,
+			false,
+			http.StatusServiceUnavailable,
+		},
+		{
+			"Never Retry POST",
+			"POST",
+			1,
+			dead,
+			false,
+			http.StatusBadGateway,
+		},
+	}
+
+	for _, c := range cases {
+		serviceList := NewServiceList()
+		registerTestInstances(serviceList, 0, c.retries, 0, c.failing, healthy)
+		handler := newTestDSDHandler(serviceList)
+
+		// Stay below the failure threshold,
+		// so that the failing instance is not ejected.
+		statuses := map[int]int{}
+		for i := 0; i < failureThreshold-1; i++ {
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, httptest.NewRequest(c.method, "/v1/test", nil))
+			statuses[resp.Code]++
+		}
+		if c.expectAllOK && len(statuses) != 1 {
+			t.Errorf("case %s: expected every request to succeed but got status codes %v", c.name, statuses)
+		}
+		if !c.expectAllOK && statuses[c.expectedStatus] == 0 {
+			t.Errorf("case %s: expected some requests to get status code %d but got %v", c.name, c.expectedStatus, statuses)
+		}
+	}
+}
+
+func TestServiceTransportTimeout(t *testing.T) {
+	slow := newSlowTestService(http.StatusOK, time.Second)
+	defer slow.Close()
+	serviceList := NewServiceList()
+	registerTestInstances(serviceList, 100, 0, 0, slow)
+	handler := newTestDSDHandler(serviceList)
+
+	start := time.Now()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/test", nil))
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected request to time out after 100ms but it took %v", elapsed)
+	}
+	if resp.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status code %d but got %d", http.StatusGatewayTimeout, resp.Code)
+	}
+	gatewayErr := &GatewayError{}
+	if err := json.NewDecoder(resp.Body).Decode(gatewayErr); err != nil {
+		t.Fatalf("error decoding gateway error: %v", err)
+	}
+	if gatewayErr.Code != GatewayErrorTimeout || gatewayErr.Service != "test" || gatewayErr.Attempts != 1 {
+		t.Errorf("incorrect gateway error: %+v", gatewayErr)
+	}
+}
+
+func TestServiceTransportHedging(t *testing.T) {
+	slow := newSlowTestService(http.StatusOK, time.Second)
+	defer slow.Close()
+	fast := newTestService(http.StatusOK)
+	defer fast.Close()
+	serviceList := NewServiceList()
+	registerTestInstances(serviceList, 0, 1, 50, slow, fast)
+	handler := newTestDSDHandler(serviceList)
+
+	// Whichever instance a request goes to first,
+	// the fast one answers it well before the slow one would.
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/v1/test", nil))
+		if resp.Code != http.StatusOK {
+			t.Errorf("expected status code %d but got %d", http.StatusOK, resp.Code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+			t.Errorf("expected hedged request to be answered by the fast instance but it took %v", elapsed)
+		}
+	}
+
+	// Requests that lost the race say nothing about the slow instance.
+	addr := strings.TrimPrefix(slow.URL, "http://")
+	if state := serviceList.services["test"].instances[addr].breaker.currentState(); state != breakerClosed {
+		t.Errorf("expected breaker of the slow instance to stay closed but got %s", state)
+	}
+}
@@ -1,11 +1,18 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -17,14 +24,18 @@ type WebSocketsHandler struct {
 	ctx      *HandlerContext
 }
 
-// NewWebSocketsHandler constructs a new WebSocketsHandler.
-func (ctx *HandlerContext) NewWebSocketsHandler(notifier *Notifier) *WebSocketsHandler {
+// NewWebSocketsHandler constructs a new WebSocketsHandler,
+// which only accepts connections from the origins corsPolicy allows.
+func (ctx *HandlerContext) NewWebSocketsHandler(notifier *Notifier, corsPolicy *CORSPolicy) *WebSocketsHandler {
+	if corsPolicy == nil {
+		panic("nil CORS policy")
+	}
 	return &WebSocketsHandler{
 		notifier: notifier,
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			CheckOrigin:     corsPolicy.CheckOrigin,
 		},
 		ctx: ctx,
 	}
@@ -36,12 +47,25 @@ func (wsh *WebSocketsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	// if we get an error when retrieving the session state,
 	// respond with an http.StatusUnauthorized.
 	sessionState := &SessionState{}
-	_, err := sessions.GetState(r, wsh.ctx.SigningKey, wsh.ctx.SessionStore, sessionState)
+	_, err := wsh.ctx.getSessionState(r, sessionState)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
 		return
 	}
 
+	// A reconnecting client can ask for the events it missed
+	// by passing the sequence number of the last event it received,
+	// along with the epoch of the Notifier it received it from.
+	since := NoReplay
+	if sinceParam := r.URL.Query().Get("since"); len(sinceParam) != 0 {
+		since, err = strconv.ParseInt(sinceParam, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "since must be a non-negative sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	epoch := r.URL.Query().Get("epoch")
+
 	// Upgrade the connection to a WebSocket, and add the
 	// new websock.Conn to the Notifier.
 	conn, err := wsh.upgrader.Upgrade(w, r, nil)
@@ -56,96 +80,538 @@ func (wsh *WebSocketsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	// Note that we don't want to spawn a new goroutine here
 	// because the expectation is that this upgrade request never ends,
 	// as the connection is upgraded into a persistent Websocket connection.
-	wsh.notifier.AddClient(conn)
+	wsh.notifier.AddClient(r.Context(), conn, sessionState.User.ID, since, epoch)
+}
+
+// writeWait is the time allowed to write a message to a client.
+const writeWait = 10 * time.Second
+
+// clientQueueSize is the number of outbound messages that
+// can be queued for a single client. A client that falls this far
+// behind is considered a slow consumer and is dropped.
+const clientQueueSize = 256
+
+// NoReplay is passed to AddClient when the client
+// does not want any missed event to be replayed.
+const NoReplay int64 = -1
+
+// DefaultIdleTimeout is how long a client may stay silent,
+// including not answering our pings, before it is reaped.
+const DefaultIdleTimeout = 60 * time.Second
+
+// eventQueueSize is the number of events that can be waiting
+// to be dispatched to clients before Notify starts dropping them.
+const eventQueueSize = 1024
+
+// client is a WebSocket connection
+// owned by an authenticated user.
+type client struct {
+	conn   *websocket.Conn
+	userID bson.ObjectId
+	// ctx is the context of the request the connection was upgraded from,
+	// which lasts as long as the connection.
+	// Requests made on behalf of the client carry on its request ID and trace.
+	ctx context.Context
+	// connID identifies this connection among
+	// all the connections of the same user.
+	connID string
+	// send is the bounded outbound queue of this client.
+	// It is only ever written to by the Notifier,
+	// and drained by the client's own writePump goroutine.
+	send chan []byte
+	// channels is the set of channel IDs the client has subscribed to.
+	// It is protected by the Notifier's mutex.
+	channels map[string]bool
+	// status is the presence status of this connection.
+	// It is protected by the Notifier's mutex.
+	status string
+	// goodbye is the payload of the close frame
+	// sent to the client once its send queue is closed.
+	// It is set by the Notifier before it closes the queue.
+	goodbye []byte
+}
+
+// newClient creates a new client for the given connection.
+func newClient(ctx context.Context, conn *websocket.Conn, userID bson.ObjectId) *client {
+	return &client{
+		conn:     conn,
+		userID:   userID,
+		ctx:      ctx,
+		connID:   bson.NewObjectId().Hex(),
+		send:     make(chan []byte, clientQueueSize),
+		channels: make(map[string]bool),
+		status:   presence.StatusOnline,
+	}
+}
+
+// writePump writes messages from the send queue to the connection,
+// and pings the client every pingPeriod to keep the connection alive.
+// It runs on its own goroutine so that a slow client
+// never holds up delivery to other clients.
+func (c *client) writePump(pingPeriod time.Duration) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The Notifier closed the send queue,
+				// so say goodbye to the client before closing the connection.
+				if c.goodbye == nil {
+					c.goodbye = []byte{}
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, c.goodbye)
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Printf("error writing message to client: %v", err)
+				return
+			}
+		case <-ticker.C:
+			// If the ping can't be written, the connection is gone,
+			// and closing it will stop the read loop in AddClient.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// event is the part of a MQ message the Notifier
+// uses to decide who should receive it.
+type event struct {
+	// UserIDs contains the IDs of users that are allowed
+	// to receive this event, such as members of a private channel.
+	// If it is empty, the event is public and sent to every client.
+	UserIDs []bson.ObjectId `json:"userIDs,omitempty"`
+	// SubscribedTo contains a channel ID if the event is only
+	// meant for clients subscribed to that channel, such as a typing indicator.
+	SubscribedTo string `json:"subscribedTo,omitempty"`
+}
+
+// recipients returns the set of user IDs the event is addressed to,
+// or nil if the event should be broadcasted to every client.
+func (e *event) recipients() map[bson.ObjectId]bool {
+	if len(e.UserIDs) == 0 {
+		return nil
+	}
+	ids := make(map[bson.ObjectId]bool, len(e.UserIDs))
+	for _, id := range e.UserIDs {
+		ids[id] = true
+	}
+	return ids
 }
 
 // Notifier is an object that handles WebSocket notifications.
 type Notifier struct {
-	// slice and channels are reference type.
+	// maps and channels are reference type.
 	// We need to initialize it somehow
 	// otherwise their zero value is nil,
 	// and we might get nil pointer reference error.
-	clients []*websocket.Conn
+	// A set is used rather than a slice so that clients
+	// can be safely removed while looping through them.
+	clients map[*client]bool
 	eventQ  chan []byte
+	// idleTimeout is how long a client may go without
+	// sending us anything, pongs included, before it is reaped.
+	idleTimeout time.Duration
+	// presenceStore tracks which users are connected,
+	// across all gateway instances.
+	presenceStore presence.Store
+	// seq is the sequence number of the last dispatched event,
+	// and log holds the most recent events for replay.
+	// Both are protected by mx.
+	seq int64
+	log *eventLog
+	// epoch identifies this Notifier, since sequence numbers
+	// start over whenever the gateway restarts.
+	epoch string
+	// relay holds the Relay events raised by the Notifier itself
+	// are published through, if any. It is an atomic.Value
+	// so that it can be read while holding mx.
+	relay atomic.Value
+	// reaped and dropped count the clients that were removed
+	// for being idle or too slow, respectively.
+	// They must be accessed atomically.
+	reaped  int64
+	dropped int64
+	// droppedEvents counts the events dropped because the eventQ was full.
+	// It must be accessed atomically.
+	droppedEvents int64
+	// consumed counts the events taken off the work queue
+	// and relayed to every gateway.
+	// It must be accessed atomically.
+	consumed int64
+	// closing is set once the Notifier is shutting down,
+	// after which it accepts no more clients.
+	// It is protected by mx.
+	closing bool
+	// channelAuth decides which channels users may subscribe to.
+	// It is protected by mx.
+	channelAuth ChannelAuthorizer
+	// conns counts the goroutines serving clients,
+	// so that shutting down can wait for them to say goodbye.
+	conns sync.WaitGroup
 	// Add a mutex or other channels to
-	// protect the `clients` slice from concurrent use.
+	// protect the `clients` set from concurrent use.
 	// Our NewNotifier() doesn't need to initialize mx field
 	// and we are still able to use it,
 	// because we are just using zero values for whatever in the Mutex struct fields.
 	mx sync.Mutex
 }
 
-// NewNotifier constructs a new Notifier.
-func NewNotifier() *Notifier {
+// NewNotifier constructs a new Notifier that reaps
+// clients that have been idle for longer than idleTimeout,
+// and records the presence of connected users in presenceStore.
+func NewNotifier(idleTimeout time.Duration, presenceStore presence.Store) *Notifier {
+	if presenceStore == nil {
+		panic("nil presence store")
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
 	// Construct a new Notifier
 	// and call the .start() method on
 	// a new goroutine to start the
 	// event notification loop.
 	notifier := &Notifier{
-		eventQ: make(chan []byte),
+		clients:       make(map[*client]bool),
+		eventQ:        make(chan []byte, eventQueueSize),
+		idleTimeout:   idleTimeout,
+		presenceStore: presenceStore,
+		log:           newEventLog(eventLogSize),
+		epoch:         bson.NewObjectId().Hex(),
 	}
 	go notifier.start()
 	return notifier
 }
 
-// AddClient adds a new client to the Notifier.
-func (n *Notifier) AddClient(client *websocket.Conn) {
-	// Add the client to the `clients` slice
+// ChannelAuthorizer decides whether users may see channels,
+// and so receive the events sent to their subscribers.
+// The context passed to it carries the request ID and trace
+// of the client's WebSocket connection.
+type ChannelAuthorizer interface {
+	// CanSeeChannel reports whether the user with the given ID may see the channel.
+	// It returns an error if it can't tell.
+	CanSeeChannel(ctx context.Context, userID bson.ObjectId, channelID string) (bool, error)
+}
+
+// SetChannelAuthorizer sets what decides which channels users may subscribe to.
+// Until it is set, clients can't subscribe to any channel.
+func (n *Notifier) SetChannelAuthorizer(channelAuth ChannelAuthorizer) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	n.channelAuth = channelAuth
+}
+
+// AddClient adds a new client owned by the given user to the Notifier.
+// The client is first sent a connected event telling it the current
+// sequence number. Then, unless since is NoReplay, it is sent the events
+// dispatched after since by the Notifier identified by epoch,
+// before any live event.
+// ctx is the context of the request the connection was upgraded from.
+func (n *Notifier) AddClient(ctx context.Context, conn *websocket.Conn, userID bson.ObjectId, since int64, epoch string) {
+	n.mx.Lock()
+	if n.closing {
+		n.mx.Unlock()
+		conn.WriteControl(websocket.CloseMessage, goingAwayPayload, time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
+	n.conns.Add(1)
+	n.mx.Unlock()
+	defer n.conns.Done()
+
+	c := newClient(ctx, conn, userID)
+
+	// Record the presence of the user as soon as it connects.
+	n.setPresence(c, presence.StatusOnline)
+
+	// Add the client to the `clients` set
 	// but since this can be called from multiple
 	// goroutines, make sure you protect the `clients`
-	// slice while you add a new connection to it!
+	// set while you add a new connection to it!
+	// Holding the lock while queueing the replayed events
+	// also makes sure no live event gets in between them.
 	n.mx.Lock()
-	n.clients = append(n.clients, client)
+	missed, complete := n.replay(since, epoch)
+	replay := [][]byte{}
+	for _, le := range missed {
+		if le.isFor(c) {
+			replay = append(replay, le.msg)
+		}
+	}
+	// Make room for the connected event and the replayed events
+	// on top of the usual queue size, so that a long replay
+	// doesn't get the client dropped as a slow consumer.
+	c.send = make(chan []byte, clientQueueSize+len(replay)+1)
+	c.send <- n.connectedEvent(len(replay), complete)
+	for _, msg := range replay {
+		c.send <- msg
+	}
+	if n.closing {
+		// The Notifier started shutting down since we checked,
+		// so say goodbye as soon as the queue is written.
+		c.goodbye = goingAwayPayload
+		close(c.send)
+	} else {
+		n.clients[c] = true
+	}
 	n.mx.Unlock()
 
-	// Process incoming control messages from the client.
+	// Ping a bit more often than the idle timeout,
+	// so that a healthy client always has time to answer.
+	n.conns.Add(1)
+	go func() {
+		defer n.conns.Done()
+		c.writePump(n.idleTimeout * 9 / 10)
+	}()
+
+	// Every pong, like every other message, proves the client is still there
+	// and pushes its read deadline further.
+	// Pongs also keep the presence of the connection fresh.
+	conn.SetReadDeadline(time.Now().Add(n.idleTimeout))
+	conn.SetPongHandler(func(string) error {
+		n.refreshPresence(c)
+		return conn.SetReadDeadline(time.Now().Add(n.idleTimeout))
+	})
+
+	// Process incoming commands and control messages from the client.
 	// Once this client is added to the list, it will constantly
 	// send control messages to our server. If at one point,
 	// we get an error when reading those control messages,
 	// it informs us that connection is lost, and we need to
 	// remove it from the list.
+	// A half-open connection never errors on its own,
+	// so the read deadline makes sure we find out about it too.
+	conn.SetReadLimit(maxCommandSize)
 	for {
-		if _, _, err := client.NextReader(); err != nil {
-			client.Close()
-			// Remove it from the list
-			n.mx.Lock()
-			for i, c := range n.clients {
-				if c == client {
-					n.clients = append(n.clients[:i], n.clients[i+1:]...)
-				}
+		msgType, msg, err := conn.ReadMessage()
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(n.idleTimeout))
+			if msgType == websocket.TextMessage {
+				n.handleCommand(c, msg)
 			}
-			n.mx.Unlock()
-			break
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Printf("reaping idle WebSocket client of user %s", userID.Hex())
+			atomic.AddInt64(&n.reaped, 1)
 		}
+		n.mx.Lock()
+		n.removeClient(c)
+		n.mx.Unlock()
+		n.removePresence(c)
+		return
 	}
 }
 
-// Notify broadcasts the event to all WebSocket clients
+// removeClient removes the client from the Notifier
+// and stops its writePump, which then closes the connection.
+// The caller must hold n.mx.
+func (n *Notifier) removeClient(c *client) {
+	// The client might have already been dropped
+	// as a slow consumer, in which case its send queue
+	// is already closed.
+	if n.clients[c] {
+		delete(n.clients, c)
+		close(c.send)
+	}
+}
+
+// goingAwayPayload is the payload of the close frame
+// sent to clients when the gateway shuts down.
+var goingAwayPayload = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+// Shutdown closes every client connection with a "going away" close frame,
+// so that clients know to reconnect to another gateway instance,
+// and refuses new clients from then on.
+// It waits for the connections to be closed, until ctx is done.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.mx.Lock()
+	n.closing = true
+	for c := range n.clients {
+		c.goodbye = goingAwayPayload
+		n.removeClient(c)
+	}
+	n.mx.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		n.conns.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error closing WebSocket clients: %v", ctx.Err())
+	}
+}
+
+// Notify sends the event to the WebSocket clients it is addressed to
 // by sending an event to the eventQ.
+// An event carrying a "userIDs" list is only delivered to connections
+// owned by those users; any other event is broadcasted to all clients.
+// Notify never blocks; if the eventQ is full, the event is dropped.
 func (n *Notifier) Notify(event []byte) {
 	// Add `event` to the `n.eventQ`
-	n.eventQ <- event
+	select {
+	case n.eventQ <- event:
+	default:
+		atomic.AddInt64(&n.droppedEvents, 1)
+		log.Println("notifier event queue is full, dropping event")
+	}
+}
+
+// Relay publishes an event to every gateway instance,
+// each of which then calls Notify on its own Notifier.
+type Relay func(event []byte) error
+
+// SetRelay makes the Notifier publish the events it raises itself,
+// such as typing indicators and presence changes, through relay,
+// so that clients connected to other gateway instances receive them too.
+func (n *Notifier) SetRelay(relay Relay) {
+	n.relay.Store(relay)
+}
+
+// publish sends an event raised by the Notifier itself
+// to clients on every gateway instance if a Relay is set,
+// or only to the local clients otherwise.
+func (n *Notifier) publish(event []byte) {
+	if relay, ok := n.relay.Load().(Relay); ok {
+		err := relay(event)
+		if err == nil {
+			return
+		}
+		// Local clients should still get the event.
+		log.Printf("error relaying event: %v", err)
+	}
+	n.Notify(event)
 }
 
 // Start starts the notification loop.
 func (n *Notifier) start() {
 	// Start a never-ending loop that reads
-	// new events out of the `n.eventQ` and broadcasts
-	// them to all WebSocket clients.
+	// new events out of the `n.eventQ` and queues
+	// them for the WebSocket clients they are addressed to.
 	for msg := range n.eventQ {
+		evt := &event{}
+		if err := json.Unmarshal(msg, evt); err != nil {
+			// Never broadcast an event we can't read the recipients of,
+			// otherwise a private event might leak to everyone.
+			log.Printf("error unmarshalling event JSON to struct: %v", err)
+			continue
+		}
+
 		n.mx.Lock()
+		// Give the event the next sequence number,
+		// and keep it around for clients that reconnect.
+		seqMsg, err := withSeq(msg, n.seq+1)
+		if err != nil {
+			n.mx.Unlock()
+			log.Printf("error adding sequence number to event: %v", err)
+			continue
+		}
+		n.seq++
+		le := &loggedEvent{n.seq, seqMsg, evt, evt.recipients()}
+		n.log.add(le)
+
 		// Loop through all the existing clients,
-		// and send messages to all of them.
-		for i, c := range n.clients {
-			// If we encounter an error writing messages out,
-			// it means this connection is lost,
-			// and we need to remove it from the list.
-			if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
-				c.Close()
-				n.clients = append(n.clients[:i], n.clients[i+1:]...)
-				log.Println(err)
+		// and queue messages for those the event is addressed to.
+		for c := range n.clients {
+			if le.isFor(c) {
+				n.queue(c, le.msg)
 			}
 		}
 		n.mx.Unlock()
 	}
 }
+
+// queue adds msg to the client's outbound queue.
+// The caller must hold n.mx.
+func (n *Notifier) queue(c *client, msg []byte) {
+	// Never queue for a client that has already been removed,
+	// since its send queue is closed.
+	if !n.clients[c] {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		// If the client's queue is full,
+		// it is not keeping up with us,
+		// so drop it rather than letting it hold everyone else up.
+		log.Printf("dropping slow WebSocket client of user %s", c.userID.Hex())
+		atomic.AddInt64(&n.dropped, 1)
+		n.removeClient(c)
+	}
+}
+
+// NotifierStats reports how many WebSocket clients the Notifier
+// currently holds, and how many it has removed since start-up.
+// It also reports how many events are waiting to be dispatched,
+// how many it dropped because too many were waiting,
+// and how many it has consumed from the work queue.
+type NotifierStats struct {
+	Connections   int   `json:"connections"`
+	Reaped        int64 `json:"reaped"`
+	Dropped       int64 `json:"dropped"`
+	QueueDepth    int   `json:"queueDepth"`
+	DroppedEvents int64 `json:"droppedEvents"`
+	Consumed      int64 `json:"consumed"`
+}
+
+// Stats returns the current NotifierStats.
+func (n *Notifier) Stats() *NotifierStats {
+	n.mx.Lock()
+	connections := len(n.clients)
+	n.mx.Unlock()
+	return &NotifierStats{
+		Connections:   connections,
+		Reaped:        atomic.LoadInt64(&n.reaped),
+		Dropped:       atomic.LoadInt64(&n.dropped),
+		QueueDepth:    len(n.eventQ),
+		DroppedEvents: atomic.LoadInt64(&n.droppedEvents),
+		Consumed:      atomic.LoadInt64(&n.consumed),
+	}
+}
+
+// WebSocketStatsHandler responds with the NotifierStats,
+// so that we can check the gateway is not leaking sockets.
+type WebSocketStatsHandler struct {
+	notifier *Notifier
+	ctx      *HandlerContext
+}
+
+// NewWebSocketStatsHandler constructs a new WebSocketStatsHandler.
+func (ctx *HandlerContext) NewWebSocketStatsHandler(notifier *Notifier) *WebSocketStatsHandler {
+	return &WebSocketStatsHandler{notifier, ctx}
+}
+
+// ServeHTTP implements the http.Handler interface for the WebSocketStatsHandler.
+func (wssh *WebSocketStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "expect GET method only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionState := &SessionState{}
+	_, err := wssh.ctx.getSessionState(r, sessionState)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting session state: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Add(headerContentType, contentTypeJSON)
+	err = json.NewEncoder(w).Encode(wssh.notifier.Stats())
+	if err != nil {
+		http.Error(w, "error encoding NotifierStats struct to JSON", http.StatusInternalServerError)
+		return
+	}
+}
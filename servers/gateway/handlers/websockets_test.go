@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestNotifierServer starts a server that upgrades every request
+// to a WebSocket owned by the user whose ID is in the `id` query string parameter.
+// Missed events are replayed if the `since` and `epoch` parameters are present.
+func newTestNotifierServer(n *Notifier) *httptest.Server {
+	upgrader := &websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := NoReplay
+		if sinceParam := r.URL.Query().Get("since"); len(sinceParam) != 0 {
+			since, _ = strconv.ParseInt(sinceParam, 10, 64)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		n.AddClient(r.Context(), conn, bson.ObjectIdHex(r.URL.Query().Get("id")), since, r.URL.Query().Get("epoch"))
+	}))
+}
+
+// dialTestClient connects to the test server as the given user.
+func dialTestClient(t *testing.T, srv *httptest.Server, userID bson.ObjectId) *websocket.Conn {
+	return dialTestClientWithQuery(t, srv, userID, "")
+}
+
+// dialTestClientWithQuery connects to the test server as the given user,
+// adding query to the query string.
+func dialTestClientWithQuery(t *testing.T, srv *httptest.Server, userID bson.ObjectId, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?id=" + userID.Hex() + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("error dialing test server: %v", err)
+	}
+	return conn
+}
+
+// waitForClients waits until the Notifier has registered n clients.
+func waitForClients(t *testing.T, notifier *Notifier, n int) {
+	for i := 0; i < 100; i++ {
+		notifier.mx.Lock()
+		count := len(notifier.clients)
+		notifier.mx.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d clients to be added", n)
+}
+
+// syncEvent is a public event that is never read by the test clients.
+const syncEvent = `{"type":"sync"}`
+
+// syncCount numbers the sync events sent by syncEvents.
+var syncCount int64
+
+// syncEvents sends a public sync event with a unique ID,
+// and returns the events each of conns received before it,
+// skipping earlier sync events.
+func syncEvents(t *testing.T, notifier *Notifier, conns ...*websocket.Conn) [][]string {
+	id := atomic.AddInt64(&syncCount, 1)
+	notifier.Notify([]byte(fmt.Sprintf(`{"type":"sync","id":%d}`, id)))
+
+	results := [][]string{}
+	for _, conn := range conns {
+		events := []string{}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("error reading message: %v", err)
+			}
+			sync := &struct {
+				Type string
+				ID   int64
+			}{}
+			json.Unmarshal(msg, sync)
+			if sync.Type != "sync" {
+				events = append(events, string(msg))
+			} else if sync.ID == id {
+				break
+			}
+		}
+		results = append(results, events)
+	}
+	return results
+}
+
+func TestNotifierTargetedDelivery(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	alice := bson.NewObjectId()
+	bob := bson.NewObjectId()
+	aliceConn := dialTestClient(t, srv, alice)
+	defer aliceConn.Close()
+	bobConn := dialTestClient(t, srv, bob)
+	defer bobConn.Close()
+	waitForClients(t, notifier, 2)
+	syncEvents(t, notifier, aliceConn, bobConn)
+
+	cases := []struct {
+		name      string
+		event     string
+		aliceGets bool
+		bobGets   bool
+	}{
+		{
+			"Public Event",
+			`{"type":"channel-new"}`,
+			true,
+			true,
+		},
+		{
+			"Private Event",
+			`{"type":"message-new","userIDs":["` + alice.Hex() + `"]}`,
+			true,
+			false,
+		},
+		{
+			"Multiple Recipients",
+			`{"type":"message-new","userIDs":["` + alice.Hex() + `","` + bob.Hex() + `"]}`,
+			true,
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		notifier.Notify([]byte(c.event))
+		events := syncEvents(t, notifier, aliceConn, bobConn)
+		if got := events[0]; (len(got) == 1) != c.aliceGets {
+			t.Errorf("case %s: expected alice to receive event: %t, but got %v", c.name, c.aliceGets, got)
+		}
+		if got := events[1]; (len(got) == 1) != c.bobGets {
+			t.Errorf("case %s: expected bob to receive event: %t, but got %v", c.name, c.bobGets, got)
+		}
+	}
+}
+
+func TestNotifierDropsSlowConsumer(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+
+	// A client whose queue is already full and never drained.
+	slow := &client{userID: bson.NewObjectId(), send: make(chan []byte, 1)}
+	slow.send <- []byte(syncEvent)
+	notifier.mx.Lock()
+	notifier.clients[slow] = true
+	notifier.mx.Unlock()
+
+	notifier.Notify([]byte(syncEvent))
+	waitForClients(t, notifier, 0)
+	if dropped := notifier.Stats().Dropped; dropped != 1 {
+		t.Errorf("expected 1 dropped client but got %d", dropped)
+	}
+
+	// The queue of the dropped client must be closed
+	// so that its writePump exits.
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Errorf("expected send queue of a dropped client to be closed")
+	}
+}
+
+func TestNotifyDoesNotBlock(t *testing.T) {
+	// A Notifier without a running notification loop.
+	notifier := &Notifier{
+		clients: make(map[*client]bool),
+		eventQ:  make(chan []byte, 1),
+	}
+
+	done := make(chan bool)
+	go func() {
+		notifier.Notify([]byte(syncEvent))
+		notifier.Notify([]byte(syncEvent))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Notify to drop events instead of blocking when the event queue is full")
+	}
+	if dropped := notifier.Stats().DroppedEvents; dropped != 1 {
+		t.Errorf("expected 1 dropped event but got %d", dropped)
+	}
+}
+
+func TestNotifierReapsIdleClients(t *testing.T) {
+	notifier := NewNotifier(200*time.Millisecond, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	// A client that keeps reading answers our pings,
+	// while one that never reads never sends a pong back.
+	alive := dialTestClient(t, srv, bson.NewObjectId())
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	idle := dialTestClient(t, srv, bson.NewObjectId())
+	defer idle.Close()
+	waitForClients(t, notifier, 2)
+
+	time.Sleep(time.Second)
+	waitForClients(t, notifier, 1)
+
+	stats := notifier.Stats()
+	if stats.Reaped != 1 {
+		t.Errorf("expected 1 reaped client but got %d", stats.Reaped)
+	}
+	if stats.Connections != 1 {
+		t.Errorf("expected 1 connection left but got %d", stats.Connections)
+	}
+}
+
+func TestNotifierRelay(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	// Until a Relay is set, events raised by the Notifier are delivered locally.
+	idle := &Notifier{
+		clients: make(map[*client]bool),
+		eventQ:  make(chan []byte, 1),
+	}
+	idle.publish([]byte(`{"type":"local"}`))
+	if len(idle.eventQ) != 1 {
+		t.Errorf("expected event to be delivered locally without a relay")
+	}
+
+	relayed := make(chan []byte, 1)
+	notifier.SetRelay(func(event []byte) error {
+		relayed <- event
+		return nil
+	})
+	notifier.publish([]byte(`{"type":"relayed"}`))
+	select {
+	case evt := <-relayed:
+		if string(evt) != `{"type":"relayed"}` {
+			t.Errorf("incorrect relayed event: %s", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected event to be relayed")
+	}
+
+	// If relaying fails, local clients still get the event.
+	notifier.SetRelay(func(event []byte) error {
+		return fmt.Errorf("broker unavailable")
+	})
+	conn := dialTestClient(t, srv, bson.NewObjectId())
+	defer conn.Close()
+	waitForClients(t, notifier, 1)
+	syncEvents(t, notifier, conn)
+	notifier.publish([]byte(`{"type":"fallback"}`))
+	if events := syncEvents(t, notifier, conn)[0]; len(events) != 1 {
+		t.Errorf("expected event to be delivered locally when relaying fails but got %v", events)
+	}
+}
+
+func TestNotifierShutdown(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	conn := dialTestClient(t, srv, bson.NewObjectId())
+	defer conn.Close()
+	waitForClients(t, notifier, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- notifier.Shutdown(ctx)
+	}()
+
+	// Connected clients are told the gateway is going away.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expected close code %d but got %v", websocket.CloseGoingAway, err)
+		}
+		break
+	}
+	// Answer the close frame, as browsers do.
+	conn.Close()
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+
+	// New clients are turned away the same way.
+	late := dialTestClient(t, srv, bson.NewObjectId())
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := late.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected new client to be closed with code %d but got %v", websocket.CloseGoingAway, err)
+	}
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxCommandSize is the largest command, in bytes,
+// a client is allowed to send over its WebSocket.
+const maxCommandSize = 4096
+
+// Command types clients can send over the WebSocket.
+const (
+	commandSubscribe   = "subscribe"
+	commandUnsubscribe = "unsubscribe"
+	commandTyping      = "typing"
+	commandAck         = "ack"
+	commandPresence    = "presence"
+)
+
+// Reply types the gateway sends back in response to a command.
+const (
+	replyOK    = "command-ok"
+	replyError = "command-error"
+)
+
+// Error codes of a command-error reply.
+const (
+	errCodeInvalidCommand = "invalid-command"
+	errCodeUnknownCommand = "unknown-command"
+	errCodeForbidden      = "forbidden"
+	errCodeNotSubscribed  = "not-subscribed"
+	errCodeUnavailable    = "unavailable"
+)
+
+// eventTyping is the type of the event sent to
+// channel subscribers when someone is typing.
+const eventTyping = "typing"
+
+// command is a command sent by a client over its WebSocket.
+type command struct {
+	Type string `json:"type"`
+	// ID is chosen by the client and echoed in the reply,
+	// so the client can tell which command a reply belongs to.
+	ID        string `json:"id,omitempty"`
+	ChannelID string `json:"channelID,omitempty"`
+	// UserID is optional, but if present
+	// it must be the ID of the session user.
+	UserID string `json:"userID,omitempty"`
+	// Seq is the sequence number of the last event being acknowledged.
+	// The gateway only checks that it was sent;
+	// it doesn't change what is delivered or replayed.
+	Seq int64 `json:"seq,omitempty"`
+	// Status is the presence status the client is setting.
+	Status string `json:"status,omitempty"`
+}
+
+// commandReply is sent back to the client for every command it sends.
+type commandReply struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// commandError is an error that is reported back to the client
+// as a command-error reply.
+type commandError struct {
+	code    string
+	message string
+}
+
+// typingEvent tells channel subscribers that a user is typing.
+type typingEvent struct {
+	Type         string        `json:"type"`
+	ChannelID    string        `json:"channelID"`
+	UserID       bson.ObjectId `json:"userID"`
+	SubscribedTo string        `json:"subscribedTo"`
+}
+
+// handleCommand validates and executes a command sent by the client,
+// and replies to the client with the outcome.
+func (n *Notifier) handleCommand(c *client, msg []byte) {
+	cmd := &command{}
+	if err := json.Unmarshal(msg, cmd); err != nil {
+		n.reply(c, cmd, &commandError{errCodeInvalidCommand, "invalid JSON in command"})
+		return
+	}
+	n.reply(c, cmd, n.execCommand(c, cmd))
+}
+
+// execCommand executes a command on behalf of the client's session user.
+func (n *Notifier) execCommand(c *client, cmd *command) *commandError {
+	// A client can only act as the user it authenticated as.
+	if len(cmd.UserID) != 0 && cmd.UserID != c.userID.Hex() {
+		return &commandError{errCodeForbidden, "command user does not match session user"}
+	}
+
+	switch cmd.Type {
+	case commandSubscribe, commandUnsubscribe, commandTyping:
+		if !bson.IsObjectIdHex(cmd.ChannelID) {
+			return &commandError{errCodeInvalidCommand, "command requires a valid channelID"}
+		}
+		// Subscribers get the channel's events,
+		// so only users who may see the channel can subscribe.
+		// Asking may take a round-trip to a microservice,
+		// so don't hold the Notifier's mutex while doing so.
+		if cmd.Type == commandSubscribe {
+			if cmdErr := n.authorizeChannel(c, cmd.ChannelID); cmdErr != nil {
+				return cmdErr
+			}
+		}
+	case commandAck:
+		if cmd.Seq <= 0 {
+			return &commandError{errCodeInvalidCommand, "command requires a seq"}
+		}
+	case commandPresence:
+		if !presence.ValidStatus(cmd.Status) {
+			return &commandError{errCodeInvalidCommand, "command requires a status of online or away"}
+		}
+		// Presence is stored in Redis,
+		// so don't hold the Notifier's mutex while setting it.
+		n.setPresence(c, cmd.Status)
+		return nil
+	case "":
+		return &commandError{errCodeInvalidCommand, "command requires a type"}
+	default:
+		return &commandError{errCodeUnknownCommand, fmt.Sprintf("unknown command type %q", cmd.Type)}
+	}
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	switch cmd.Type {
+	case commandSubscribe:
+		c.channels[cmd.ChannelID] = true
+
+	case commandUnsubscribe:
+		delete(c.channels, cmd.ChannelID)
+
+	case commandTyping:
+		// Only subscribers can tell other subscribers they are typing.
+		if !c.channels[cmd.ChannelID] {
+			return &commandError{errCodeNotSubscribed, "must subscribe to the channel before typing in it"}
+		}
+		evt, err := json.Marshal(&typingEvent{
+			Type:         eventTyping,
+			ChannelID:    cmd.ChannelID,
+			UserID:       c.userID,
+			SubscribedTo: cmd.ChannelID,
+		})
+		if err != nil {
+			log.Printf("error marshalling typing event: %v", err)
+			return nil
+		}
+		n.publish(evt)
+
+	case commandAck:
+		// Acknowledging is only checked, not recorded:
+		// a client that reconnects passes the seq of the last event it got
+		// as `since`, which is what decides what is replayed to it.
+		// A client can't acknowledge an event we haven't sent yet.
+		if cmd.Seq > n.seq {
+			return &commandError{errCodeInvalidCommand, "command seq is ahead of the last event"}
+		}
+	}
+	return nil
+}
+
+// channelAuthTimeout is how long deciding whether
+// a user may see a channel may take.
+const channelAuthTimeout = 5 * time.Second
+
+// authorizeChannel returns a command error
+// unless the client's user may see the channel.
+func (n *Notifier) authorizeChannel(c *client, channelID string) *commandError {
+	n.mx.Lock()
+	channelAuth := n.channelAuth
+	n.mx.Unlock()
+	if channelAuth == nil {
+		return &commandError{errCodeForbidden, "channel subscriptions are not available"}
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, channelAuthTimeout)
+	defer cancel()
+	ok, err := channelAuth.CanSeeChannel(ctx, c.userID, channelID)
+	if err != nil {
+		log.Printf("error authorizing subscription of user %s to channel %s: %v", c.userID.Hex(), channelID, err)
+		return &commandError{errCodeUnavailable, "can't tell whether you may see the channel, try again later"}
+	}
+	if !ok {
+		return &commandError{errCodeForbidden, "you may not see this channel"}
+	}
+	return nil
+}
+
+// reply queues a command-ok reply for the client,
+// or a command-error reply if cmdErr is not nil.
+func (n *Notifier) reply(c *client, cmd *command, cmdErr *commandError) {
+	reply := &commandReply{
+		Type:    replyOK,
+		ID:      cmd.ID,
+		Command: cmd.Type,
+	}
+	if cmdErr != nil {
+		reply.Type = replyError
+		reply.Code = cmdErr.code
+		reply.Message = cmdErr.message
+	}
+	j, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("error marshalling command reply: %v", err)
+		return
+	}
+	n.mx.Lock()
+	n.queue(c, j)
+	n.mx.Unlock()
+}
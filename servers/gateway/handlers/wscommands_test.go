@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sendCommand sends cmd over conn and returns the reply.
+func sendCommand(t *testing.T, conn *websocket.Conn, cmd string) *commandReply {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(cmd)); err != nil {
+		t.Fatalf("error sending command: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := &commandReply{}
+	if err := conn.ReadJSON(reply); err != nil {
+		t.Fatalf("error reading reply: %v", err)
+	}
+	return reply
+}
+
+// testChannelAuthorizer lets users see the channels it maps to them,
+// and can't tell for the channels in broken.
+type testChannelAuthorizer struct {
+	members map[string][]bson.ObjectId
+	broken  map[string]bool
+}
+
+// CanSeeChannel implements the ChannelAuthorizer interface for the testChannelAuthorizer.
+func (a *testChannelAuthorizer) CanSeeChannel(ctx context.Context, userID bson.ObjectId, channelID string) (bool, error) {
+	if a.broken[channelID] {
+		return false, errors.New("messaging is down")
+	}
+	for _, member := range a.members[channelID] {
+		if member == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	alice := bson.NewObjectId()
+	aliceConn := dialTestClient(t, srv, alice)
+	defer aliceConn.Close()
+	waitForClients(t, notifier, 1)
+	syncEvents(t, notifier, aliceConn)
+
+	channelID := bson.NewObjectId().Hex()
+	privateChannelID := bson.NewObjectId().Hex()
+	brokenChannelID := bson.NewObjectId().Hex()
+	notifier.SetChannelAuthorizer(&testChannelAuthorizer{
+		members: map[string][]bson.ObjectId{
+			channelID:        {alice},
+			privateChannelID: {bson.NewObjectId()},
+		},
+		broken: map[string]bool{brokenChannelID: true},
+	})
+
+	cases := []struct {
+		name         string
+		cmd          string
+		expectedType string
+		expectedCode string
+	}{
+		{
+			"Invalid JSON",
+			`{"type":`,
+			replyError,
+			errCodeInvalidCommand,
+		},
+		{
+			"Missing Type",
+			`{"id":"1"}`,
+			replyError,
+			errCodeInvalidCommand,
+		},
+		{
+			"Unknown Type",
+			`{"type":"dance"}`,
+			replyError,
+			errCodeUnknownCommand,
+		},
+		{
+			"Invalid Channel ID",
+			`{"type":"subscribe","channelID":"general"}`,
+			replyError,
+			errCodeInvalidCommand,
+		},
+		{
+			"Typing Before Subscribing",
+			`{"type":"typing","channelID":"` + channelID + `"}`,
+			replyError,
+			errCodeNotSubscribed,
+		},
+		{
+			"Impersonating Another User",
+			`{"type":"subscribe","channelID":"` + channelID + `","userID":"` + bson.NewObjectId().Hex() + `"}`,
+			replyError,
+			errCodeForbidden,
+		},
+		{
+			"Subscribe",
+			`{"type":"subscribe","id":"2","channelID":"` + channelID + `","userID":"` + alice.Hex() + `"}`,
+			replyOK,
+			"",
+		},
+		{
+			"Subscribe To Channel User May Not See",
+			`{"type":"subscribe","channelID":"` + privateChannelID + `"}`,
+			replyError,
+			errCodeForbidden,
+		},
+		{
+			"Subscribe When Access Is Unknown",
+			`{"type":"subscribe","channelID":"` + brokenChannelID + `"}`,
+			replyError,
+			errCodeUnavailable,
+		},
+		{
+			"Typing In Channel User May Not See",
+			`{"type":"typing","channelID":"` + privateChannelID + `"}`,
+			replyError,
+			errCodeNotSubscribed,
+		},
+		{
+			"Ack Without Seq",
+			`{"type":"ack"}`,
+			replyError,
+			errCodeInvalidCommand,
+		},
+		{
+			"Ack Ahead Of Last Event",
+			`{"type":"ack","seq":1000000}`,
+			replyError,
+			errCodeInvalidCommand,
+		},
+		{
+			"Ack",
+			`{"type":"ack","seq":1}`,
+			replyOK,
+			"",
+		},
+		{
+			"Unsubscribe",
+			`{"type":"unsubscribe","channelID":"` + channelID + `"}`,
+			replyOK,
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		reply := sendCommand(t, aliceConn, c.cmd)
+		if reply.Type != c.expectedType {
+			t.Errorf("case %s: expected reply type %s but got %s", c.name, c.expectedType, reply.Type)
+		}
+		if reply.Code != c.expectedCode {
+			t.Errorf("case %s: expected error code %q but got %q", c.name, c.expectedCode, reply.Code)
+		}
+	}
+}
+
+func TestWebSocketTypingIndicator(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	alice := bson.NewObjectId()
+	aliceConn := dialTestClient(t, srv, alice)
+	defer aliceConn.Close()
+	bob := bson.NewObjectId()
+	bobConn := dialTestClient(t, srv, bob)
+	defer bobConn.Close()
+	carolConn := dialTestClient(t, srv, bson.NewObjectId())
+	defer carolConn.Close()
+	waitForClients(t, notifier, 3)
+	syncEvents(t, notifier, aliceConn, bobConn, carolConn)
+
+	channelID := bson.NewObjectId().Hex()
+	notifier.SetChannelAuthorizer(&testChannelAuthorizer{
+		members: map[string][]bson.ObjectId{channelID: {alice, bob}},
+	})
+	subscribe := `{"type":"subscribe","channelID":"` + channelID + `"}`
+	sendCommand(t, aliceConn, subscribe)
+	sendCommand(t, bobConn, subscribe)
+
+	if reply := sendCommand(t, aliceConn, `{"type":"typing","channelID":"`+channelID+`"}`); reply.Type != replyOK {
+		t.Fatalf("expected typing command to succeed but got %s: %s", reply.Code, reply.Message)
+	}
+
+	// Bob is subscribed to the channel and should be told Alice is typing,
+	// while Carol is not subscribed and should not.
+	received := syncEvents(t, notifier, bobConn, carolConn)
+	events := received[0]
+	if len(events) != 1 {
+		t.Fatalf("expected bob to receive 1 typing event but got %v", events)
+	}
+	evt := &typingEvent{}
+	if err := json.Unmarshal([]byte(events[0]), evt); err != nil {
+		t.Fatalf("error unmarshalling typing event: %v", err)
+	}
+	if evt.Type != eventTyping || evt.ChannelID != channelID || evt.UserID != alice {
+		t.Errorf("incorrect typing event: %s", events[0])
+	}
+	if events := received[1]; len(events) != 0 {
+		t.Errorf("expected carol to receive no events but got %v", events)
+	}
+}
+
+func TestWebSocketSubscribeWithoutAuthorizer(t *testing.T) {
+	notifier := NewNotifier(DefaultIdleTimeout, presence.NewMemStore(presence.DefaultTTL))
+	srv := newTestNotifierServer(notifier)
+	defer srv.Close()
+
+	conn := dialTestClient(t, srv, bson.NewObjectId())
+	defer conn.Close()
+	waitForClients(t, notifier, 1)
+	syncEvents(t, notifier, conn)
+
+	// Nobody can tell who may see the channel, so nobody may subscribe.
+	reply := sendCommand(t, conn, `{"type":"subscribe","channelID":"`+bson.NewObjectId().Hex()+`"}`)
+	if reply.Type != replyError || reply.Code != errCodeForbidden {
+		t.Errorf("expected %s reply with code %s but got %s with code %q", replyError, errCodeForbidden, reply.Type, reply.Code)
+	}
+}
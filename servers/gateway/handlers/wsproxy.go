@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsDialTimeout is how long connecting to an instance
+// to open a WebSocket may take.
+const wsDialTimeout = time.Second * 5
+
+// goingAwayWait is how long a client has to take the rest of a frame
+// that is being relayed to it when the gateway goes away.
+const goingAwayWait = time.Second * 2
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyWebSocket forwards the WebSocket handshake in r to instance,
+// and if the instance accepts it, splices the client's connection
+// through to the instance until either side closes it.
+// If the instance refuses, its response is relayed to the client as is.
+// The outcome of the handshake is reported to the instance's circuit breaker.
+// The connection is tracked in splices until it is closed.
+func (svc *service) proxyWebSocket(w http.ResponseWriter, r *http.Request, instance *serviceInstance, splices *wsSplices) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// A gateway that is shutting down takes no new WebSockets.
+	goingAway, ok := splices.add()
+	if !ok {
+		respondWithGatewayError(w, &GatewayError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    GatewayErrorUnavailable,
+			Message: "the gateway is shutting down",
+			Service: svc.name,
+		})
+		return
+	}
+	defer splices.done()
+
+	ctx, span := tracing.Start(r.Context(), "proxy "+svc.name)
+	defer span.End()
+	span.SetAttribute("service.instance", instance.address)
+
+	backendConn, err := net.DialTimeout("tcp", instance.address, wsDialTimeout)
+	if err != nil {
+		span.SetError(err)
+		if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after error: %v", svc.name, instance.address, err)
+		}
+		svc.respondUnreachable(w, err)
+		return
+	}
+	defer backendConn.Close()
+
+	// Send the handshake on to the instance,
+	// keeping the Connection and Upgrade headers it needs.
+	outReq := r.WithContext(ctx)
+	outReq.Header = cloneHeader(r.Header)
+	tracing.Inject(ctx, outReq.Header)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outReq.Header.Get("X-Forwarded-For"); len(prior) != 0 {
+			host = prior + ", " + host
+		}
+		outReq.Header.Set("X-Forwarded-For", host)
+	}
+	backendConn.SetDeadline(time.Now().Add(wsDialTimeout))
+	if err := outReq.Write(backendConn); err != nil {
+		span.SetError(err)
+		if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after error: %v", svc.name, instance.address, err)
+		}
+		svc.respondUnreachable(w, err)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outReq)
+	if err != nil {
+		span.SetError(err)
+		if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after error: %v", svc.name, instance.address, err)
+		}
+		svc.respondUnreachable(w, err)
+		return
+	}
+	backendConn.SetDeadline(time.Time{})
+	span.SetAttribute("http.status", resp.StatusCode)
+
+	if resp.StatusCode >= 500 {
+		if instance.breaker.failure() {
+			log.Printf("Microservice %s: instance with address %s ejected after failing with status code %d", svc.name, instance.address, resp.StatusCode)
+		}
+	} else if instance.breaker.success() {
+		log.Printf("Microservice %s: instance with address %s recovered", svc.name, instance.address)
+	}
+
+	// The instance refused to switch protocols,
+	// so relay its answer like any other response.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("error hijacking WebSocket connection: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	// Complete the handshake with the client.
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	// Splice the connections together.
+	// Either side may already have sent frames
+	// that were buffered while reading the handshake,
+	// so copy from the buffers rather than the bare connections.
+	// The instance's frames are relayed whole,
+	// so that the relay can stop between two of them.
+	// Once either side is done, close both so that the other copy ends too.
+	toBackend := make(chan struct{})
+	toClient := make(chan bool, 1)
+	go func() {
+		io.Copy(backendConn, clientBuf.Reader)
+		close(toBackend)
+	}()
+	go func() {
+		betweenFrames, _ := relayFrames(clientConn, backendReader)
+		toClient <- betweenFrames
+	}()
+	clientDone := false
+	select {
+	case <-toBackend:
+	case <-toClient:
+		clientDone = true
+	case <-goingAway:
+		// Stop relaying the instance's frames,
+		// so that nothing else writes to the client,
+		// then tell the client to reconnect elsewhere.
+		// A close frame after part of a frame would corrupt the stream,
+		// so if the relay was cut off partway through one, just hang up.
+		// A client that stopped reading must not hold up the shutdown,
+		// so give it a little while to take the frame it is being sent.
+		backendConn.SetReadDeadline(time.Now())
+		clientConn.SetWriteDeadline(time.Now().Add(goingAwayWait))
+		clientDone = true
+		if <-toClient {
+			writeCloseFrame(clientConn, goingAwayPayload)
+		}
+	}
+	clientConn.Close()
+	backendConn.Close()
+	<-toBackend
+	if !clientDone {
+		<-toClient
+	}
+}
+
+// relayFrames copies the WebSocket frames read from src to dst,
+// writing each one only once its header has been read in full,
+// until either side fails.
+// It reports whether it stopped between two frames,
+// rather than after writing part of one.
+func relayFrames(dst io.Writer, src *bufio.Reader) (bool, error) {
+	header := make([]byte, 14)
+	for {
+		// The first two bytes say how long the rest of the header is.
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return true, err
+		}
+		headerLen := 2
+		switch header[1] & 0x7f {
+		case 126:
+			headerLen += 2
+		case 127:
+			headerLen += 8
+		}
+		if header[1]&0x80 != 0 {
+			// Masked frames carry a 4-byte masking key.
+			headerLen += 4
+		}
+		if _, err := io.ReadFull(src, header[2:headerLen]); err != nil {
+			return true, err
+		}
+		var payloadLen uint64
+		switch header[1] & 0x7f {
+		case 126:
+			payloadLen = uint64(binary.BigEndian.Uint16(header[2:4]))
+		case 127:
+			payloadLen = binary.BigEndian.Uint64(header[2:10])
+		default:
+			payloadLen = uint64(header[1] & 0x7f)
+		}
+		if payloadLen > math.MaxInt64 {
+			return true, fmt.Errorf("invalid WebSocket frame length %d", payloadLen)
+		}
+
+		if _, err := dst.Write(header[:headerLen]); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(dst, src, int64(payloadLen)); err != nil {
+			return false, err
+		}
+	}
+}
+
+// writeCloseFrame writes a WebSocket close frame with payload to conn,
+// as a server, which does not mask its frames.
+func writeCloseFrame(conn net.Conn, payload []byte) error {
+	frame := append([]byte{0x88, byte(len(payload))}, payload...)
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := conn.Write(frame)
+	return err
+}
+
+// wsSplices tracks the WebSocket connections spliced through to microservices,
+// so that they can be closed when the gateway shuts down.
+type wsSplices struct {
+	// goingAway is closed once the gateway is shutting down.
+	goingAway chan struct{}
+	closing   bool
+	open      sync.WaitGroup
+	mx        sync.Mutex
+}
+
+// newWSSplices constructs a new wsSplices.
+func newWSSplices() *wsSplices {
+	return &wsSplices{goingAway: make(chan struct{})}
+}
+
+// add tracks a new connection, and returns the channel
+// that is closed when it must go away.
+// It reports false if the gateway is shutting down.
+func (splices *wsSplices) add() (<-chan struct{}, bool) {
+	splices.mx.Lock()
+	defer splices.mx.Unlock()
+	if splices.closing {
+		return nil, false
+	}
+	splices.open.Add(1)
+	return splices.goingAway, true
+}
+
+// done stops tracking a connection once it is closed.
+func (splices *wsSplices) done() {
+	splices.open.Done()
+}
+
+// close tells every connection to go away,
+// and waits for them to be closed, until ctx is done.
+func (splices *wsSplices) close(ctx context.Context) error {
+	splices.mx.Lock()
+	if !splices.closing {
+		splices.closing = true
+		close(splices.goingAway)
+	}
+	splices.mx.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		splices.open.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error closing proxied WebSocket connections: %v", ctx.Err())
+	}
+}
+
+// respondUnreachable responds with a GatewayError
+// saying that the microservice could not be reached.
+func (svc *service) respondUnreachable(w http.ResponseWriter, err error) {
+	respondWithGatewayError(w, &GatewayError{
+		Status:   http.StatusBadGateway,
+		Code:     GatewayErrorUnreachable,
+		Message:  fmt.Sprintf("error reaching microservice %s: %v", svc.name, err),
+		Service:  svc.name,
+		Attempts: 1,
+	})
+}
+
+// cloneHeader returns a copy of header.
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/identity"
+)
+
+func TestDSDHandlerProxiesWebSockets(t *testing.T) {
+	// A microservice echoing every message back,
+	// to clients that came through the gateway.
+	upgrader := &websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := identity.VerifyRequest(r, testIdentityKey); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v1/test/refused" {
+			http.Error(w, "not here", http.StatusNotFound)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, msg)
+		}
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     addr,
+		Heartbeat:   10,
+	})
+	gateway := httptest.NewServer(newTestDSDHandler(serviceList))
+	defer gateway.Close()
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/v1/test/ws", nil)
+	if err != nil {
+		t.Fatalf("error dialing WebSocket through gateway: %v", err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("error writing message: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, echo, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("error reading message: %v", err)
+		}
+		if string(echo) != msg {
+			t.Errorf("incorrect echo: expected %s but got %s", msg, echo)
+		}
+	}
+
+	// The connection counts as outstanding while it is open.
+	instance := serviceList.services["test"].instances[addr]
+	if outstanding := atomic.LoadInt64(&instance.outstanding); outstanding != 1 {
+		t.Errorf("expected 1 outstanding request while connected but got %d", outstanding)
+	}
+	conn.Close()
+	for i := 0; i < 100 && atomic.LoadInt64(&instance.outstanding) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if outstanding := atomic.LoadInt64(&instance.outstanding); outstanding != 0 {
+		t.Errorf("expected no outstanding requests once disconnected but got %d", outstanding)
+	}
+
+	// A refused handshake reaches the client as is.
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/v1/test/refused", nil)
+	if err == nil {
+		t.Fatalf("expected handshake to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d from refused handshake but got %v", http.StatusNotFound, resp)
+	}
+}
+
+func TestDSDHandlerClosesWebSockets(t *testing.T) {
+	// A microservice that never closes its WebSockets.
+	upgrader := &websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     strings.TrimPrefix(srv.URL, "http://"),
+		Heartbeat:   10,
+	})
+	dsdh := newTestDSDHandler(serviceList)
+	gateway := httptest.NewServer(dsdh)
+	defer gateway.Close()
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/v1/test/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("error dialing WebSocket through gateway: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dsdh.CloseWebSockets(ctx); err != nil {
+		t.Errorf("unexpected error closing WebSockets: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected close code %d but got %v", websocket.CloseGoingAway, err)
+	}
+
+	// New WebSockets are refused.
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatalf("expected handshake to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d once closed but got %v", http.StatusServiceUnavailable, resp)
+	}
+}
+
+func TestDSDHandlerClosesStalledWebSockets(t *testing.T) {
+	// A microservice that keeps sending large messages.
+	upgrader := &websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		message := bytes.Repeat([]byte{'x'}, 1<<20)
+		for {
+			if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	serviceList := NewServiceList()
+	serviceList.Register(&ReceivedService{
+		Name:        "test",
+		PathPattern: "^/v1/test",
+		Address:     strings.TrimPrefix(srv.URL, "http://"),
+		Heartbeat:   10,
+	})
+	dsdh := newTestDSDHandler(serviceList)
+	gateway := httptest.NewServer(dsdh)
+	defer gateway.Close()
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/v1/test/ws"
+
+	// A client that never reads, so that the relay gets stuck writing to it.
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("error dialing WebSocket through gateway: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(time.Millisecond * 500)
+
+	ctx, cancel := context.WithTimeout(context.Background(), goingAwayWait*3)
+	defer cancel()
+	if err := dsdh.CloseWebSockets(ctx); err != nil {
+		t.Errorf("expected a stalled client not to hold up closing WebSockets but got %v", err)
+	}
+}
+
+func TestRelayFrames(t *testing.T) {
+	// Unmasked frames from a server: a short text frame,
+	// one with a 16-bit length, and one with a 64-bit length.
+	short := append([]byte{0x81, 5}, "hello"...)
+	medium := append([]byte{0x82, 126, 0x01, 0x00}, bytes.Repeat([]byte{'m'}, 256)...)
+	long := append([]byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}, bytes.Repeat([]byte{'l'}, 65536)...)
+	// A masked frame from a client.
+	masked := []byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2}
+	stream := bytes.Join([][]byte{short, medium, long, masked}, nil)
+
+	cases := []struct {
+		name                  string
+		input                 []byte
+		expectedBetweenFrames bool
+	}{
+		{"Whole Frames", stream, true},
+		{"Cut Off In Header", stream[:len(short)+3], true},
+		{"Cut Off In Payload", stream[:len(short)+10], false},
+	}
+
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		betweenFrames, err := relayFrames(out, bufio.NewReader(bytes.NewReader(c.input)))
+		if err == nil {
+			t.Errorf("case %s: expected an error once the input ends", c.name)
+		}
+		if betweenFrames != c.expectedBetweenFrames {
+			t.Errorf("case %s: expected stopping between frames: %t, but got %t", c.name, c.expectedBetweenFrames, betweenFrames)
+		}
+		if c.expectedBetweenFrames && !bytes.HasPrefix(c.input, out.Bytes()) {
+			t.Errorf("case %s: expected the frames to be relayed as is", c.name)
+		}
+	}
+
+	// Whole frames are relayed as is, and nothing of a frame
+	// whose header was cut off.
+	out := &bytes.Buffer{}
+	relayFrames(out, bufio.NewReader(bytes.NewReader(stream)))
+	if !bytes.Equal(out.Bytes(), stream) {
+		t.Errorf("expected %d bytes relayed as is but got %d bytes", len(stream), out.Len())
+	}
+	out.Reset()
+	relayFrames(out, bufio.NewReader(bytes.NewReader(stream[:len(short)+3])))
+	if !bytes.Equal(out.Bytes(), short) {
+		t.Errorf("expected only the first frame to be relayed but got %q", out.Bytes())
+	}
+}
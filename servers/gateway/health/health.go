@@ -0,0 +1,150 @@
+// Package health serves the liveness and readiness endpoints
+// orchestrators probe to decide whether to restart a server,
+// and whether to send it traffic.
+// Servers define the Checks of their own dependencies,
+// so that this package doesn't depend on any of them.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Resource paths of the liveness and readiness endpoints.
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// DefaultTimeout is how long readiness checks may take
+// before their dependency is reported down.
+const DefaultTimeout = time.Second * 2
+
+// Statuses of a server and its dependencies.
+const (
+	StatusOK   = "ok"
+	StatusDown = "down"
+)
+
+// Check returns an error if a dependency can't be used.
+// It should give up once ctx is done.
+type Check func(ctx context.Context) error
+
+// DependencyStatus is the status of a dependency.
+type DependencyStatus struct {
+	Status        string  `json:"status"`
+	LatencyMillis float64 `json:"latencyMillis"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// Report is the body of the responses of the health endpoints.
+type Report struct {
+	Status string `json:"status"`
+	// Dependencies are the statuses of the dependencies, by name.
+	Dependencies map[string]*DependencyStatus `json:"dependencies,omitempty"`
+}
+
+// LivenessHandler reports that the server is up and serving requests,
+// whatever the state of its dependencies,
+// so that it is only restarted when it is stuck.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "expect GET or HEAD method only", http.StatusMethodNotAllowed)
+		return
+	}
+	respond(w, http.StatusOK, &Report{Status: StatusOK})
+}
+
+// ReadinessHandler reports whether every dependency of the server can be used,
+// responding with 503 Service Unavailable if any can't,
+// so that orchestrators stop sending it traffic.
+type ReadinessHandler struct {
+	checks  map[string]Check
+	timeout time.Duration
+}
+
+// NewReadinessHandler constructs a new ReadinessHandler
+// running the given checks, by dependency name.
+// Each check may take up to timeout.
+func NewReadinessHandler(checks map[string]Check, timeout time.Duration) *ReadinessHandler {
+	if len(checks) == 0 {
+		panic("no readiness checks")
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &ReadinessHandler{checks, timeout}
+}
+
+// ServeHTTP implements the http.Handler interface for the ReadinessHandler.
+// The checks run at the same time, so the response takes no longer than the timeout.
+func (rh *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "expect GET or HEAD method only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), rh.timeout)
+	defer cancel()
+	report := &Report{Status: StatusOK, Dependencies: make(map[string]*DependencyStatus)}
+	mx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, check := range rh.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			status := run(ctx, check)
+			mx.Lock()
+			report.Dependencies[name] = status
+			mx.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	httpStatus := http.StatusOK
+	for _, status := range report.Dependencies {
+		if status.Status != StatusOK {
+			report.Status = StatusDown
+			httpStatus = http.StatusServiceUnavailable
+		}
+	}
+	respond(w, httpStatus, report)
+}
+
+// run runs check, giving up once ctx is done,
+// even if the check itself doesn't.
+func run(ctx context.Context, check Check) *DependencyStatus {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("check timed out: %v", ctx.Err())
+	}
+	status := &DependencyStatus{
+		Status:        StatusOK,
+		LatencyMillis: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// respond writes report to w as JSON, with the given status code.
+func respond(w http.ResponseWriter, httpStatus int, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	// Probes must always see the current status.
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(report)
+}
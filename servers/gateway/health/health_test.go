@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	resp := httptest.NewRecorder()
+	LivenessHandler(resp, httptest.NewRequest("GET", LivenessPath, nil))
+	if resp.Code != http.StatusOK {
+		t.Errorf("incorrect status code: expected %d but got %d", http.StatusOK, resp.Code)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("connection refused") }
+	// A check that never returns on its own.
+	hanging := func(ctx context.Context) error {
+		time.Sleep(time.Hour)
+		return nil
+	}
+
+	cases := []struct {
+		name           string
+		method         string
+		checks         map[string]Check
+		expectedStatus int
+		expectedDown   []string
+	}{
+		{
+			"All Ready",
+			"GET",
+			map[string]Check{"redis": ok, "mongo": ok},
+			http.StatusOK,
+			nil,
+		},
+		{
+			"Dependency Down",
+			"GET",
+			map[string]Check{"redis": ok, "mongo": failing},
+			http.StatusServiceUnavailable,
+			[]string{"mongo"},
+		},
+		{
+			"Dependency Hanging",
+			"GET",
+			map[string]Check{"redis": ok, "mongo": hanging},
+			http.StatusServiceUnavailable,
+			[]string{"mongo"},
+		},
+		{
+			"Wrong Method",
+			"POST",
+			map[string]Check{"redis": ok},
+			http.StatusMethodNotAllowed,
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		handler := NewReadinessHandler(c.checks, time.Millisecond*100)
+		resp := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(resp, httptest.NewRequest(c.method, ReadinessPath, nil))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("case %s: expected checks to time out, but they took %v", c.name, elapsed)
+		}
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+			continue
+		}
+		if c.expectedStatus == http.StatusMethodNotAllowed {
+			continue
+		}
+
+		report := &Report{}
+		if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+			t.Errorf("case %s: error decoding report: %v", c.name, err)
+			continue
+		}
+		if len(report.Dependencies) != len(c.checks) {
+			t.Errorf("case %s: expected %d dependencies but got %d", c.name, len(c.checks), len(report.Dependencies))
+		}
+		down := map[string]bool{}
+		for _, name := range c.expectedDown {
+			down[name] = true
+		}
+		for name, status := range report.Dependencies {
+			if down[name] && (status.Status != StatusDown || len(status.Error) == 0) {
+				t.Errorf("case %s: expected %s to be down with an error but got %+v", c.name, name, status)
+			}
+			if !down[name] && status.Status != StatusOK {
+				t.Errorf("case %s: expected %s to be ok but got %+v", c.name, name, status)
+			}
+		}
+		if (len(c.expectedDown) == 0) != (report.Status == StatusOK) {
+			t.Errorf("case %s: incorrect overall status %s", c.name, report.Status)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package identity signs and verifies the identity tokens
+// the gateway forwards to microservices.
+// A token says which user, if any, made a request,
+// and proves that the request came through the gateway,
+// since only the gateway and the microservices know the identity key.
+package identity
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HeaderToken is the header the gateway puts identity tokens in.
+const HeaderToken = "X-User-Token"
+
+// DefaultTTL is how long a token is valid for.
+// Tokens are minted for every forwarded request,
+// so they only need to outlive the trip to the microservice.
+const DefaultTTL = time.Minute
+
+// MaxSkew is how far in the future a token may be issued,
+// to leave room for clock skew between the gateway and microservices.
+const MaxSkew = time.Second * 30
+
+// ErrNoToken is returned from VerifyRequest when a request carries no token.
+var ErrNoToken = errors.New("no identity token found in the request")
+
+// ErrInvalidToken is returned from Verify when a token is malformed,
+// or was not signed with the identity key.
+var ErrInvalidToken = errors.New("invalid identity token")
+
+// ErrExpired is returned from Verify when a token is expired,
+// or issued in the future.
+var ErrExpired = errors.New("identity token expired")
+
+// Claims are what a token says about a request.
+type Claims struct {
+	// UserID is the hex-encoded ID of the authenticated user,
+	// or empty if the request is anonymous.
+	UserID string `json:"sub,omitempty"`
+	// User is the JSON of the authenticated user, if any.
+	User      json.RawMessage `json:"user,omitempty"`
+	IssuedAt  int64           `json:"iat"`
+	ExpiresAt int64           `json:"exp"`
+}
+
+// Anonymous reports whether the request was made without a user.
+func (claims *Claims) Anonymous() bool {
+	return len(claims.UserID) == 0
+}
+
+// Sign mints a token for the user with the given ID valid for ttl.
+// user is marshaled into the token as well.
+// An empty userID and a nil user mint a token for an anonymous request.
+//
+// A token is the base64url-encoded JSON of its Claims, a ".",
+// and the base64url-encoded HMAC-SHA256 of the encoded Claims.
+func Sign(userID string, user interface{}, key string, ttl time.Duration) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("identity key has length of zero")
+	}
+	now := time.Now()
+	claims := &Claims{
+		UserID:    userID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	if user != nil {
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return "", fmt.Errorf("error marshaling user: %v", err)
+		}
+		claims.User = userJSON
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling claims: %v", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature(payload, key)), nil
+}
+
+// Verify checks that token was signed with key and is not expired,
+// and returns its Claims.
+func Verify(token string, key string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// Compare in constant time, so that the time it takes
+	// doesn't tell a forger how much of the signature is right.
+	if !hmac.Equal(sig, signature(parts[0], key)) {
+		return nil, ErrInvalidToken
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if now.After(time.Unix(claims.ExpiresAt, 0)) || time.Unix(claims.IssuedAt, 0).After(now.Add(MaxSkew)) {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// VerifyRequest verifies the token in the HeaderToken header of r.
+func VerifyRequest(r *http.Request, key string) (*Claims, error) {
+	token := r.Header.Get(HeaderToken)
+	if len(token) == 0 {
+		return nil, ErrNoToken
+	}
+	return Verify(token, key)
+}
+
+// signature computes the signature of the encoded claims.
+func signature(payload string, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// contextKey is the type of keys of values
+// this package puts in request contexts.
+type contextKey string
+
+// claimsKey is the context key of the verified Claims of a request.
+const claimsKey = contextKey("claims")
+
+// Require wraps handler so that it only gets requests
+// with a valid token signed with key, which came through the gateway.
+// Other requests get a 401 response.
+// The handler can get the verified Claims with FromContext.
+func Require(key string, handler http.Handler) http.Handler {
+	if len(key) == 0 {
+		panic("identity key has length of zero")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := VerifyRequest(r, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error verifying identity: %v", err), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	})
+}
+
+// FromContext returns the Claims Require put in ctx,
+// or nil if there are none.
+func FromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey).(*Claims)
+	return claims
+}
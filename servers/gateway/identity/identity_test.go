@@ -0,0 +1,131 @@
+package identity
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	key := "identity key"
+	user := map[string]string{"id": "5a0e3e2b8b1f2c0001a1b2c3", "userName": "alice"}
+	token, err := Sign(user["id"], user, key, DefaultTTL)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	expired, _ := Sign(user["id"], user, key, -time.Minute)
+
+	// tampered claims another user with the original signature.
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"5a0e3e2b8b1f2c0001ffffff","iat":0,"exp":9999999999}`))
+	tampered := forged + "." + parts[1]
+
+	cases := []struct {
+		name        string
+		token       string
+		key         string
+		expectedErr error
+	}{
+		{
+			"Valid Token",
+			token,
+			key,
+			nil,
+		},
+		{
+			"Wrong Key",
+			token,
+			"another key",
+			ErrInvalidToken,
+		},
+		{
+			"Tampered Claims",
+			tampered,
+			key,
+			ErrInvalidToken,
+		},
+		{
+			"Unsigned Claims",
+			forged,
+			key,
+			ErrInvalidToken,
+		},
+		{
+			"Expired Token",
+			expired,
+			key,
+			ErrExpired,
+		},
+	}
+
+	for _, c := range cases {
+		claims, err := Verify(c.token, c.key)
+		if err != c.expectedErr {
+			t.Errorf("case %s: expected error %v but got %v", c.name, c.expectedErr, err)
+			continue
+		}
+		if err == nil && (claims.UserID != user["id"] || !strings.Contains(string(claims.User), `"userName":"alice"`)) {
+			t.Errorf("case %s: incorrect claims: %+v", c.name, claims)
+		}
+	}
+
+	if _, err := Sign("", nil, "", DefaultTTL); err == nil {
+		t.Errorf("expected error signing with an empty key")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	key := "identity key"
+	var got *Claims
+	handler := Require(key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	anonymous, _ := Sign("", nil, key, DefaultTTL)
+	forged, _ := Sign("5a0e3e2b8b1f2c0001a1b2c3", nil, "guessed key", DefaultTTL)
+
+	cases := []struct {
+		name              string
+		token             string
+		expectedStatus    int
+		expectedAnonymous bool
+	}{
+		{
+			"Anonymous Request Through Gateway",
+			anonymous,
+			http.StatusOK,
+			true,
+		},
+		{
+			"No Token",
+			"",
+			http.StatusUnauthorized,
+			false,
+		},
+		{
+			"Forged Token",
+			forged,
+			http.StatusUnauthorized,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		got = nil
+		r := httptest.NewRequest("GET", "/v1/summary", nil)
+		if len(c.token) != 0 {
+			r.Header.Set(HeaderToken, c.token)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		if resp.Code != c.expectedStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectedStatus, resp.Code)
+		}
+		if resp.Code == http.StatusOK && (got == nil || got.Anonymous() != c.expectedAnonymous) {
+			t.Errorf("case %s: incorrect claims in context: %+v", c.name, got)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 // A Trie represents a trie data structure.
 type Trie struct {
 	root *node
+	// size is the number of key/value pairs in the trie.
+	size int
 	mx   sync.RWMutex
 }
 
@@ -26,10 +28,19 @@ func (trie *Trie) Insert(key string, userID bson.ObjectId) {
 	// Make all keys lowercase, so our search is case-insensitive.
 	key = strings.ToLower(key)
 	trie.mx.Lock()
-	trie.root.insert(key, userID)
+	if trie.root.insert(key, userID) {
+		trie.size++
+	}
 	trie.mx.Unlock()
 }
 
+// Len returns the number of key/value pairs in the trie.
+func (trie *Trie) Len() int {
+	trie.mx.RLock()
+	defer trie.mx.RUnlock()
+	return trie.size
+}
+
 // Search retrieves the first n values that match a given prefix string from the trie.
 // Find the branch of the trie holding keys
 // that start with the prefix string,
@@ -76,7 +87,9 @@ func (trie *Trie) Search(n int, prefix string) map[bson.ObjectId]bool {
 func (trie *Trie) Remove(key string, value bson.ObjectId) {
 	key = strings.ToLower(key)
 	trie.mx.Lock()
-	trie.root.remove(key, value)
+	if trie.root.remove(key, value) {
+		trie.size--
+	}
 	trie.mx.Unlock()
 }
 
@@ -98,7 +111,9 @@ func newNode(char rune) *node {
 	}
 }
 
-func (root *node) insert(key string, userID bson.ObjectId) {
+// insert adds the key/value pair below root,
+// and reports whether it was not there yet.
+func (root *node) insert(key string, userID bson.ObjectId) bool {
 	curNode := root
 	// Loop through each character in the key.
 	for _, char := range key {
@@ -124,6 +139,7 @@ func (root *node) insert(key string, userID bson.ObjectId) {
 	if !hasUserID {
 		curNode.values[userID] = true
 	}
+	return !hasUserID
 }
 
 // root here is not the root of the trie.
@@ -183,20 +199,24 @@ func (root *node) search(n int, results map[bson.ObjectId]bool, totalResults int
 	return results
 }
 
-func (root *node) remove(key string, value bson.ObjectId) {
+// remove removes the key/value pair below root,
+// and reports whether it was there.
+func (root *node) remove(key string, value bson.ObjectId) bool {
 	// Find the node whose value we want to remove for a given key.
 	curNode := root
 	for _, char := range key {
 		_, hasChild := curNode.children[char]
 		if !hasChild {
-			return
+			return false
 		}
 		curNode = curNode.children[char]
 	}
 	// Now our current node is pointing at the node want to remove.
 	// Remove the value.
+	_, hasValue := curNode.values[value]
 	delete(curNode.values, value)
 	curNode.removeDanglingNodes()
+	return hasValue
 }
 
 // Trace up and remove dangling nodes.
@@ -253,3 +253,24 @@ func TestRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestLen(t *testing.T) {
+
+	value := bson.NewObjectId()
+	trie := NewTrie()
+
+	trie.Insert("dog", value)
+	trie.Insert("Dog", value)
+	trie.Insert("do", value)
+	trie.Insert("dog", bson.NewObjectId())
+	if trie.Len() != 3 {
+		t.Errorf("\ncase: %v\ngot: %v\nwant: %v", "duplicate pairs are counted once", trie.Len(), 3)
+	}
+
+	trie.Remove("dog", value)
+	trie.Remove("dog", value)
+	trie.Remove("cat", value)
+	if trie.Len() != 2 {
+		t.Errorf("\ncase: %v\ngot: %v\nwant: %v", "only pairs in the trie are removed", trie.Len(), 2)
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/go-redis/redis"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/announcements"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/eventbus"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/handlers"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/health"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/attempts"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/presence"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/ratelimits"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/resetcodes"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/models/users"
 	"github.com/info344-a17/challenges-zicodeng/servers/gateway/sessions"
-	"github.com/streadway/amqp"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
 	"gopkg.in/mgo.v2"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -49,12 +62,54 @@ func main() {
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 	})
-	pubsub := redisClient.Subscribe("microservices")
+	// Microservices sign their announcements with the registration key,
+	// so that nobody else can register a microservice.
+	registrationKey := os.Getenv("REGISTRATIONKEY")
+	if len(registrationKey) == 0 {
+		log.Fatal("Please set REGISTRATIONKEY environment variable")
+	}
+
+	// Requests forwarded to microservices carry an identity token
+	// signed with the identity key, which the microservices verify.
+	identityKey := os.Getenv("IDENTITYKEY")
+	if len(identityKey) == 0 {
+		log.Fatal("Please set IDENTITYKEY environment variable")
+	}
 
 	serviceList := handlers.NewServiceList()
-	go listenForServices(pubsub, serviceList)
+	// Limit which microservices may claim which paths,
+	// so that the registration key alone can't take over any path.
+	if len(os.Getenv("SERVICEALLOWLIST")) == 0 {
+		log.Fatal("Please set SERVICEALLOWLIST environment variable")
+	}
+	allowlist, err := handlers.ParseAllowlist(os.Getenv("SERVICEALLOWLIST"))
+	if err != nil {
+		log.Fatalf("error parsing SERVICEALLOWLIST: %v", err)
+	}
+	serviceList.SetAllowlist(allowlist)
+	// Nor can the allowlist hand out the paths the gateway serves itself.
+	serviceList.Reserve(
+		"/v1/users",
+		"/v1/sessions",
+		"/v1/resetcodes",
+		"/v1/passwords",
+		"/v1/ws",
+		"/v1/presence",
+		"/v1/health",
+		handlers.AdminServicesPath,
+		handlers.MetricsPath,
+	)
+	// Microservices announce themselves on Redis,
+	// whatever bus the notifier uses.
+	// Subscribe in the background, retrying while Redis is down,
+	// so that the gateway still starts; /readyz reports it down meanwhile.
+	discovering := make(chan struct{})
+	servicesBus := eventbus.NewRedisBus(redisClient)
+	go subscribeToServices(servicesBus, serviceList, registrationKey, discovering)
 	// Remove crashed microservices.
 	go removeCrashedServices(serviceList)
+	// Eject unhealthy microservice instances before they crash.
+	go probeServices(serviceList)
 
 	// Redis store for storing SessionState.
 	sessionStore := sessions.NewRedisStore(redisClient, time.Hour)
@@ -79,25 +134,30 @@ func main() {
 
 	userStore := users.NewMongoStore(mongoSession, "info_344", "users")
 
+	// The dependencies the gateway must reach to be ready for traffic.
+	readinessChecks := map[string]health.Check{
+		"redis": redisCheck(redisClient),
+		"mongo": mongoCheck(mongoSession),
+		"discovery": func(ctx context.Context) error {
+			select {
+			case <-discovering:
+				return nil
+			default:
+				return errors.New("not subscribed to microservice announcements yet")
+			}
+		},
+	}
+
 	// Loading existing users into Trie at start-up.
 	trie := userStore.Index()
 
+	// Measurements exposed to Prometheus.
+	metrics := handlers.NewMetrics()
+	metrics.RegisterTrie(trie)
+	metrics.RegisterServiceList(serviceList)
+
 	// Initialize HandlerContext.
-	ctx := handlers.NewHandlerContext(sessionKey, trie, sessionStore, userStore, attemptStore, resetCodeStore)
-
-	// Messaging microservice addresses.
-	// msgAddrs := os.Getenv("MESSAGESVCADDR")
-	// if len(msgAddrs) == 0 {
-	// 	log.Fatal("Please set MESSAGESVCADDR environment variables")
-	// }
-	// msgAddrSlice := strings.Split(msgAddrs, ",")
-
-	// // Summary microservice addresses.
-	// sumAddrs := os.Getenv("SUMMARYSVCADDR")
-	// if len(sumAddrs) == 0 {
-	// 	log.Fatal("Please set SUMMARYSVCADDR environment variables")
-	// }
-	// sumAddrSlice := strings.Split(sumAddrs, ",")
+	ctx := handlers.NewHandlerContext(sessionKey, trie, sessionStore, userStore, attemptStore, resetCodeStore, metrics)
 
 	// Create a new mux for the web server.
 	mux := http.NewServeMux()
@@ -112,81 +172,308 @@ func main() {
 	mux.HandleFunc("/v1/resetcodes", ctx.ResetCodesHandler)
 	mux.HandleFunc("/v1/passwords", ctx.ResetPasswordHandler)
 
-	notifier := handlers.NewNotifier()
-	mux.Handle("/v1/ws", ctx.NewWebSocketsHandler(notifier))
-	mqAddr := os.Getenv("MQADDR")
-	if len(mqAddr) == 0 {
-		log.Fatal("Please set the MQADDR variable to the address of your MQ server")
+	// How long a WebSocket client may stay silent before it is reaped.
+	wsIdleTimeout := handlers.DefaultIdleTimeout
+	if len(os.Getenv("WSIDLETIMEOUT")) != 0 {
+		wsIdleTimeout, err = time.ParseDuration(os.Getenv("WSIDLETIMEOUT"))
+		if err != nil {
+			log.Fatalf("error parsing WSIDLETIMEOUT: %v", err)
+		}
+	}
+
+	// Redis store for storing the presence of connected users.
+	// Connections are refreshed on every pong,
+	// so give them a few missed pings before they expire.
+	presenceStore := presence.NewRedisStore(redisClient, wsIdleTimeout*3)
+
+	// Which web origins may call the gateway, as JSON.
+	// Any origin may, without credentials, if it is not set.
+	corsPolicy := handlers.DefaultCORSPolicy()
+	if len(os.Getenv("CORSPOLICY")) != 0 {
+		corsPolicy, err = handlers.ParseCORSPolicy([]byte(os.Getenv("CORSPOLICY")))
+		if err != nil {
+			log.Fatalf("error parsing CORSPOLICY: %v", err)
+		}
+	} else {
+		log.Println("CORSPOLICY is not set, any origin may call the gateway without credentials")
+	}
+
+	notifier := handlers.NewNotifier(wsIdleTimeout, presenceStore)
+	metrics.RegisterNotifier(notifier)
+	// WebSockets follow the same origin policy.
+	mux.Handle("/v1/ws", ctx.NewWebSocketsHandler(notifier, corsPolicy))
+	mux.Handle("/v1/ws/stats", ctx.NewWebSocketStatsHandler(notifier))
+	mux.Handle("/v1/presence", ctx.NewPresenceHandler(presenceStore))
+
+	// Pick the event bus the notifier gets its events from.
+	// RabbitMQ is the default, since the microservices send their events there.
+	var bus eventbus.Bus
+	switch os.Getenv("EVENTBUS") {
+	case "", "amqp":
+		mqAddr := os.Getenv("MQADDR")
+		if len(mqAddr) == 0 {
+			log.Fatal("Please set the MQADDR variable to the address of your MQ server")
+		}
+		// The work queue must be declared exactly the way
+		// the microservices sending to it declare it,
+		// or RabbitMQ refuses the declaration.
+		mqConfig := &eventbus.AMQPConfig{Addr: mqAddr}
+		if len(os.Getenv("MQDURABLE")) != 0 {
+			mqConfig.Durable, err = strconv.ParseBool(os.Getenv("MQDURABLE"))
+			if err != nil {
+				log.Fatalf("error parsing MQDURABLE: %v", err)
+			}
+		}
+		amqpBus := eventbus.NewAMQPBus(mqConfig)
+		mux.Handle("/v1/health/mq", handlers.NewMQHealthHandler(amqpBus))
+		readinessChecks["mq"] = busCheck(amqpBus)
+		bus = amqpBus
+	case "redis":
+		bus = eventbus.NewRedisBus(redisClient)
+	case "memory":
+		bus = eventbus.NewMemBus()
+	default:
+		log.Fatalf("unknown EVENTBUS %s, expected amqp, redis or memory", os.Getenv("EVENTBUS"))
+	}
+
+	// Microservices send their events to the work queue,
+	// which is named after the group all gateway instances share.
+	topics := &handlers.EventTopics{
+		Work:   os.Getenv("MQQUEUE"),
+		Fanout: os.Getenv("MQEXCHANGE"),
+	}
+	if len(topics.Work) == 0 {
+		topics.Work = "testQ"
+	}
+	topics.WorkGroup = topics.Work
+	if len(topics.Fanout) == 0 {
+		topics.Fanout = "notifications"
+	}
+	// Load events received from the bus into the notifier,
+	// so that they will be delivered to clients through websocket.
+	if err := notifier.ListenTo(bus, topics); err != nil {
+		log.Fatalf("error listening to event bus: %v", err)
 	}
-	go listenToMQ(mqAddr, notifier)
 
-	// Hard-code the network addresses where our microservice instances
-	// are listening into environment variables the gateway reads at startup.
-	// This is an easy way to get started,
-	// but it doesn't make it easy to dynamically add
-	// new instances of an existing microservice, or entirely new microservices.
+	// Network addresses of microservice instances can also be
+	// hard-coded into environment variables the gateway reads at startup.
+	// Those microservices fall back to these static addresses
+	// whenever none of their discovered instances is available,
+	// so the gateway keeps working while Redis or discovery is down.
+	// A comma-separated list of addresses is accepted.
 
 	// Messaging microservice.
-	// mux.Handle("/v1/channels", newServiceProxy(msgAddrSlice, ctx))
-	// mux.Handle("/v1/channels/", newServiceProxy(msgAddrSlice, ctx))
-	// mux.Handle("/v1/messages/", newServiceProxy(msgAddrSlice, ctx))
+	if msgAddrs := os.Getenv("MESSAGESVCADDR"); len(msgAddrs) != 0 {
+		msgSvc := &handlers.ReceivedService{Name: "messaging", PathPattern: "/v1/(channels|messages)/?"}
+		if err := serviceList.AddFallback(msgSvc, strings.Split(msgAddrs, ",")); err != nil {
+			log.Fatalf("error adding MESSAGESVCADDR: %v", err)
+		}
+	}
 
 	// Summary microservice.
-	// mux.Handle("/v1/summary", newServiceProxy(sumAddrSlice, ctx))
+	if sumAddrs := os.Getenv("SUMMARYSVCADDR"); len(sumAddrs) != 0 {
+		sumSvc := &handlers.ReceivedService{Name: "summary", PathPattern: "/v1/summary"}
+		if err := serviceList.AddFallback(sumSvc, strings.Split(sumAddrs, ",")); err != nil {
+			log.Fatalf("error adding SUMMARYSVCADDR: %v", err)
+		}
+	}
+
+	// The service registry admin API,
+	// protected by its own admin credential rather than user sessions.
+	if adminKey := os.Getenv("ADMINKEY"); len(adminKey) != 0 {
+		adminHandler := handlers.NewAdminHandler(adminKey, serviceList)
+		mux.Handle(handlers.AdminServicesPath, adminHandler)
+		mux.Handle(handlers.AdminServicesPath+"/", adminHandler)
+	} else {
+		log.Println("ADMINKEY is not set, the service registry admin API is disabled")
+	}
+
+	// Prometheus scrapes the metrics with the metrics key as a bearer token.
+	// The metrics tell which microservices run where,
+	// so they are never served to anyone without it.
+	metricsKey := os.Getenv("METRICSKEY")
+	if len(metricsKey) == 0 {
+		log.Fatal("Please set METRICSKEY environment variable")
+	}
+	mux.Handle(handlers.MetricsPath, handlers.NewMetricsEndpointHandler(metrics, metricsKey))
 
 	// Chained middlewares.
 	// Wraps mux inside DSDHandler.
-	dsdMux := handlers.NewDSDHandler(mux, serviceList, ctx)
+	dsdMux := handlers.NewDSDHandler(mux, serviceList, ctx, identityKey)
+	// The microservice serving a channel decides who may subscribe to it.
+	notifier.SetChannelAuthorizer(dsdMux)
+	// Wraps mux inside RateLimitHandler, if rate limits are configured.
+	// Buckets live in Redis, so that all gateway instances share them.
+	var limitedMux http.Handler = dsdMux
+	if len(os.Getenv("RATELIMITS")) != 0 {
+		limits, err := handlers.ParseRateLimits(os.Getenv("RATELIMITS"))
+		if err != nil {
+			log.Fatalf("error parsing RATELIMITS: %v", err)
+		}
+		limitedMux = handlers.NewRateLimitHandler(dsdMux, ratelimits.NewRedisStore(redisClient), limits, serviceList, ctx)
+	} else {
+		log.Println("RATELIMITS is not set, requests are not rate limited")
+	}
+	// Wraps mux inside SessionHandler,
+	// which looks up the session of every request once
+	// for the rate limiter and the handlers after it.
+	sessionMux := handlers.NewSessionHandler(limitedMux, ctx)
 	// Wraps mux inside CORSHandler.
-	corsMux := handlers.NewCORSHandler(dsdMux)
+	corsMux := handlers.NewCORSHandler(sessionMux, corsPolicy)
+	// Wraps mux inside MetricsHandler.
+	meteredMux := handlers.NewMetricsHandler(corsMux, mux, serviceList, metrics)
+	// Wraps mux inside the tracing handler, if a span exporter is set,
+	// which is "stdout", "stderr" or "file:" followed by a path.
+	var tracedMux http.Handler = meteredMux
+	if spec := os.Getenv("TRACEEXPORTER"); len(spec) != 0 {
+		exporter, err := tracing.NewExporter(spec)
+		if err != nil {
+			log.Fatalf("error creating span exporter: %v", err)
+		}
+		tracedMux = tracing.NewHandler(meteredMux, tracing.NewTracer("gateway", exporter))
+	} else {
+		log.Println("TRACEEXPORTER is not set, requests are not traced")
+	}
+	// Wraps mux inside the access log handler,
+	// which gives every request an ID the microservices get too,
+	// and logs it as JSON to standard output.
+	loggedMux := accesslog.NewHandler(tracedMux, accesslog.NewLogger(os.Stdout))
+
+	// Probes are answered before any middleware,
+	// so that they are neither rate limited nor logged,
+	// and no microservice can claim their paths.
+	rootMux := http.NewServeMux()
+	rootMux.HandleFunc(health.LivenessPath, health.LivenessHandler)
+	rootMux.Handle(health.ReadinessPath, health.NewReadinessHandler(readinessChecks, health.DefaultTimeout))
+	rootMux.Handle("/", loggedMux)
+
+	// How long the gateway has to drain its connections once it is shutting down.
+	shutdownTimeout := time.Second * 30
+	if len(os.Getenv("SHUTDOWNTIMEOUT")) != 0 {
+		shutdownTimeout, err = time.ParseDuration(os.Getenv("SHUTDOWNTIMEOUT"))
+		if err != nil {
+			log.Fatalf("error parsing SHUTDOWNTIMEOUT: %v", err)
+		}
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: rootMux,
+	}
+
+	// On SIGINT or SIGTERM, stop accepting connections,
+	// tell WebSocket clients the gateway is going away,
+	// and let the requests already in flight complete,
+	// then close the connections to the event bus, Redis and MongoDB.
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		log.Printf("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		// The server doesn't wait for hijacked connections,
+		// so WebSockets are closed alongside it.
+		drains := []func(context.Context) error{server.Shutdown, notifier.Shutdown, dsdMux.CloseWebSockets}
+		wg := sync.WaitGroup{}
+		for _, drain := range drains {
+			wg.Add(1)
+			go func(drain func(context.Context) error) {
+				defer wg.Done()
+				if err := drain(ctx); err != nil {
+					log.Printf("error shutting down: %v", err)
+				}
+			}(drain)
+		}
+		wg.Wait()
+
+		if err := bus.Close(); err != nil {
+			log.Printf("error closing event bus: %v", err)
+		}
+		servicesBus.Close()
+		if err := redisClient.Close(); err != nil {
+			log.Printf("error closing Redis client: %v", err)
+		}
+		mongoSession.Close()
+		close(stopped)
+	}()
 
 	// Start a web server listening on the address you read from
 	// the environment variable, using the mux you created as
 	// the root handler. Use log.Fatal() to report any errors
 	// that occur when trying to start the web server.
 	log.Printf("Server is listening at https://%s\n", addr)
-	log.Fatal(http.ListenAndServeTLS(addr, tlscert, tlskey, corsMux))
+	if err := server.ListenAndServeTLS(tlscert, tlskey); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Server stopped")
 }
 
 // Constantly listen for "Microservices" Redis channel.
-func listenForServices(pubsub *redis.PubSub, serviceList *handlers.ServiceList) {
-	log.Println("Listening for microservices")
+// The subscription reconnects on its own if the Redis server goes away.
+// Announcements that are not signed with registrationKey,
+// or are invalid, are logged and ignored.
+// Subscribes to microservice announcements,
+// retrying with backoff until it succeeds,
+// then closes discovering and listens for them until bus is closed.
+func subscribeToServices(bus eventbus.Bus, serviceList *handlers.ServiceList, registrationKey string, discovering chan struct{}) {
+	backoff := time.Second
 	for {
-		msg, err := receivePubSubMessage(pubsub)
-		// If there is still an error receiving message even after retries,
-		// return this function.
-		if err != nil {
-			log.Println(err)
+		services, err := bus.Subscribe("microservices", nil)
+		if err == eventbus.ErrClosed {
 			return
 		}
-		svc := &handlers.ReceivedService{}
-		err = json.Unmarshal([]byte(msg.Payload), svc)
-		if err != nil {
-			log.Printf("Error unmarshalling received microservice JSON to struct: %v", err)
+		if err == nil {
+			close(discovering)
+			listenForServices(services, serviceList, registrationKey)
+			return
+		}
+		log.Printf("Error subscribing to microservices, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Second*30 {
+			backoff = time.Second * 30
 		}
-		serviceList.Register(svc)
 	}
 }
 
-var maxReceiveMessageRetries = 5
-
-// If there is an error receiving Redis Pub/Sub messages,
-// that's probably because the Redis server is no longer reachable.
-// If that's the case, try to receive the message again for a max number of retries.
-func receivePubSubMessage(pubsub *redis.PubSub) (*redis.Message, error) {
-	var msg *redis.Message
-	var err error
-	for i := 0; i < maxReceiveMessageRetries; i++ {
-		// pubsub.ReceiveMessage() will block until there is a message to receive.
-		msg, err = pubsub.ReceiveMessage()
-		if err == nil {
-			return msg, nil
+func listenForServices(services *eventbus.Subscription, serviceList *handlers.ServiceList, registrationKey string) {
+	log.Println("Listening for microservices")
+	for {
+		select {
+		case msg := <-services.Messages():
+			svcJSON, err := announcements.Verify(msg.Body, registrationKey)
+			if err != nil {
+				log.Printf("Error verifying microservice announcement: %v", err)
+				continue
+			}
+			svc := &handlers.ReceivedService{}
+			err = json.Unmarshal(svcJSON, svc)
+			if err != nil {
+				log.Printf("Error unmarshalling received microservice JSON to struct: %v", err)
+				continue
+			}
+			if err := serviceList.Register(svc); err != nil {
+				log.Printf("Error registering microservice: %v", err)
+			}
+		case <-services.Done():
+			return
 		}
-		log.Printf("Error receiving message from Redis Pub/Sub: %s", err)
-		log.Printf("Will try again in %d seconds", i*2)
-		time.Sleep(time.Duration(i*2) * time.Second)
 	}
-	return nil, err
+}
+
+// Periodically sends health probes to every service instance,
+// so that failing instances stop receiving traffic
+// well before their heartbeats are missed.
+func probeServices(serviceList *handlers.ServiceList) {
+	client := &http.Client{Timeout: handlers.ProbeTimeout}
+	for {
+		time.Sleep(time.Second * 5)
+		serviceList.Probe(client)
+	}
 }
 
 // Periodically looks for service instances
@@ -198,56 +485,3 @@ func removeCrashedServices(serviceList *handlers.ServiceList) {
 		serviceList.Remove()
 	}
 }
-
-const maxConnRetries = 5
-const qName = "testQ"
-
-func listenToMQ(addr string, notifier *handlers.Notifier) {
-	conn, err := connectToMQ(addr)
-	if err != nil {
-		log.Fatalf("error connecting to MQ server: %s", err)
-	}
-	log.Printf("connected to MQ server")
-	defer conn.Close()
-
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("error opening channel: %v", err)
-	}
-	log.Println("created MQ channel")
-	defer ch.Close()
-
-	q, err := ch.QueueDeclare(qName, false, false, false, false, nil)
-	if err != nil {
-		log.Fatalf("error declaring queue: %v", err)
-	}
-	log.Println("declared MQ queue")
-	messages, err := ch.Consume(q.Name, "", true, false, false, false, nil)
-	if err != nil {
-		log.Fatalf("error listening to queue: %v", err)
-	}
-	log.Println("listening for new MQ messages...")
-	for msg := range messages {
-		// log.Printf("new message id %s received from MQ", string(msg.Body))
-		// Load messages received from RabbitMQ's eventQ channel to
-		// notifier's eventQ channel, so that messages will be
-		// broadcasted to all clients throught websocket.
-		notifier.Notify(msg.Body)
-	}
-}
-
-func connectToMQ(addr string) (*amqp.Connection, error) {
-	mqURL := "amqp://" + addr
-	var conn *amqp.Connection
-	var err error
-	for i := 1; i <= maxConnRetries; i++ {
-		conn, err = amqp.Dial(mqURL)
-		if err == nil {
-			return conn, nil
-		}
-		log.Printf("error connecting to MQ server at %s: %s", mqURL, err)
-		log.Printf("will attempt another connection in %d seconds", i*2)
-		time.Sleep(time.Duration(i*2) * time.Second)
-	}
-	return nil, err
-}
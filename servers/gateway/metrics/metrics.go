@@ -0,0 +1,328 @@
+// Package metrics keeps counters, gauges and histograms,
+// and exposes them in the Prometheus text format.
+// Updating a metric takes a map lookup and an atomic add,
+// and gauges are only computed when the metrics are scraped,
+// so they are cheap enough to leave on in production.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// contentType is the content type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds of histogram buckets
+// suited to request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is the value of a metric for one set of label values.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// metric is a metric that can write itself out.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// desc describes a metric.
+type desc struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric.
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// writeSample writes a sample line of the metric,
+// with the given name suffix and extra label.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName string, extraValue string, value float64) {
+	w.WriteString(d.name + suffix)
+	if len(d.labelNames) != 0 || len(extraName) != 0 {
+		w.WriteByte('{')
+		for i, name := range d.labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name + `="` + escapeLabel(labelValues[i]) + `"`)
+		}
+		if len(extraName) != 0 {
+			if len(d.labelNames) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// escapeLabel escapes a label value for the text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat formats a sample value for the text format.
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Registry holds metrics, and serves them to Prometheus.
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	mx      sync.Mutex
+}
+
+// NewRegistry constructs a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds m to the registry.
+// It panics if a metric with the same name is already registered,
+// since that is a programming error.
+func (reg *Registry) register(d *desc, m metric) {
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	if reg.names[d.name] {
+		panic(fmt.Sprintf("metric %s registered twice", d.name))
+	}
+	reg.names[d.name] = true
+	reg.metrics = append(reg.metrics, m)
+}
+
+// ServeHTTP implements the http.Handler interface for the Registry,
+// writing every metric in the Prometheus text format.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "expect GET method only", http.StatusMethodNotAllowed)
+		return
+	}
+	reg.mx.Lock()
+	metrics := append([]metric(nil), reg.metrics...)
+	reg.mx.Unlock()
+
+	w.Header().Set("Content-Type", contentType)
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	buf.Flush()
+}
+
+// Counter is a metric that only goes up,
+// with a value for each set of label values.
+type Counter struct {
+	desc
+	values sync.Map
+}
+
+// NewCounter registers a new Counter with the given label names.
+func (reg *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labelNames}}
+	reg.register(&c.desc, c)
+	return c
+}
+
+// counterValue is the value of a Counter for a set of label values.
+type counterValue struct {
+	labelValues []string
+	n           int64
+}
+
+// Inc adds one to the value of the Counter for the given label values,
+// which must be as many as its label names.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n to the value of the Counter for the given label values.
+func (c *Counter) Add(n int64, labelValues ...string) {
+	if len(labelValues) != len(c.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", c.name, len(c.labelNames), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	value, found := c.values.Load(key)
+	if !found {
+		value, _ = c.values.LoadOrStore(key, &counterValue{labelValues: append([]string(nil), labelValues...)})
+	}
+	atomic.AddInt64(&value.(*counterValue).n, n)
+}
+
+// Value returns the value of the Counter for the given label values.
+func (c *Counter) Value(labelValues ...string) int64 {
+	if value, found := c.values.Load(labelKey(labelValues)); found {
+		return atomic.LoadInt64(&value.(*counterValue).n)
+	}
+	return 0
+}
+
+// write implements the metric interface for the Counter.
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, value := range sortedValues(&c.values) {
+		v := value.(*counterValue)
+		c.writeSample(w, "", v.labelValues, "", "", float64(atomic.LoadInt64(&v.n)))
+	}
+}
+
+// Histogram is a metric that counts observations in buckets,
+// with a set of buckets for each set of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+	values  sync.Map
+}
+
+// NewHistogram registers a new Histogram with the given bucket upper bounds,
+// which must be sorted, and label names.
+func (reg *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of metric %s are not sorted", name))
+	}
+	h := &Histogram{desc: desc{name, help, "histogram", labelNames}, buckets: buckets}
+	reg.register(&h.desc, h)
+	return h
+}
+
+// histogramValue holds the buckets of a Histogram for a set of label values.
+// counts are not cumulative, they are summed up when written.
+type histogramValue struct {
+	labelValues []string
+	counts      []int64
+	count       int64
+	// sumBits holds the float64 bits of the sum of observations.
+	sumBits uint64
+}
+
+// Observe adds an observation to the Histogram for the given label values.
+func (h *Histogram) Observe(observation float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", h.name, len(h.labelNames), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	value, found := h.values.Load(key)
+	if !found {
+		value, _ = h.values.LoadOrStore(key, &histogramValue{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]int64, len(h.buckets)),
+		})
+	}
+	v := value.(*histogramValue)
+	if i := sort.SearchFloat64s(h.buckets, observation); i < len(h.buckets) {
+		atomic.AddInt64(&v.counts[i], 1)
+	}
+	atomic.AddInt64(&v.count, 1)
+	for {
+		old := atomic.LoadUint64(&v.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + observation)
+		if atomic.CompareAndSwapUint64(&v.sumBits, old, sum) {
+			break
+		}
+	}
+}
+
+// write implements the metric interface for the Histogram.
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	for _, value := range sortedValues(&h.values) {
+		v := value.(*histogramValue)
+		// Read the total first, so that no bucket exceeds it.
+		count := atomic.LoadInt64(&v.count)
+		cumulative := int64(0)
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadInt64(&v.counts[i])
+			if cumulative > count {
+				cumulative = count
+			}
+			h.writeSample(w, "_bucket", v.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", v.labelValues, "le", "+Inf", float64(count))
+		h.writeSample(w, "_sum", v.labelValues, "", "", math.Float64frombits(atomic.LoadUint64(&v.sumBits)))
+		h.writeSample(w, "_count", v.labelValues, "", "", float64(count))
+	}
+}
+
+// sortedValues returns the values of m sorted by key,
+// so that the output is stable.
+func sortedValues(m *sync.Map) []interface{} {
+	keys := []string{}
+	values := map[string]interface{}{}
+	m.Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(string))
+		values[key.(string)] = value
+		return true
+	})
+	sort.Strings(keys)
+	sorted := make([]interface{}, len(keys))
+	for i, key := range keys {
+		sorted[i] = values[key]
+	}
+	return sorted
+}
+
+// funcMetric is a metric whose samples are computed when it is scraped.
+type funcMetric struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by f when it is scraped.
+func (reg *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	reg.NewGaugeVecFunc(name, help, nil, func() []Sample {
+		return []Sample{{Value: f()}}
+	})
+}
+
+// NewCounterFunc registers a counter whose value is computed by f when it is scraped,
+// for things that are already counted elsewhere.
+func (reg *Registry) NewCounterFunc(name string, help string, f func() float64) {
+	m := &funcMetric{desc{name, help, "counter", nil}, func() []Sample {
+		return []Sample{{Value: f()}}
+	}}
+	reg.register(&m.desc, m)
+}
+
+// NewGaugeVecFunc registers a gauge with the given label names,
+// whose samples are computed by collect when it is scraped.
+func (reg *Registry) NewGaugeVecFunc(name string, help string, labelNames []string, collect func() []Sample) {
+	m := &funcMetric{desc{name, help, "gauge", labelNames}, collect}
+	reg.register(&m.desc, m)
+}
+
+// write implements the metric interface for the funcMetric.
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	for _, sample := range m.collect() {
+		if len(sample.LabelValues) != len(m.labelNames) {
+			continue
+		}
+		m.writeSample(w, "", sample.LabelValues, "", "", sample.Value)
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("requests_total", "Requests handled.", "route", "code")
+	latency := reg.NewHistogram("latency_seconds", "Time taken.", []float64{0.1, 1}, "route")
+	reg.NewGaugeFunc("connections", "Open connections.", func() float64 { return 3 })
+	reg.NewGaugeVecFunc("instances", "Instances.", []string{"service"}, func() []Sample {
+		return []Sample{{[]string{"summary"}, 2}, {[]string{`we"ird`}, 1}}
+	})
+
+	// Metrics may be updated concurrently.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requests.Inc("/v1/users", "200")
+			latency.Observe(0.05, "/v1/users")
+		}()
+	}
+	wg.Wait()
+	requests.Inc("/v1/users", "401")
+	latency.Observe(0.5, "/v1/users")
+	latency.Observe(5, "/v1/users")
+
+	if n := requests.Value("/v1/users", "200"); n != 10 {
+		t.Errorf("incorrect counter value: expected 10 but got %d", n)
+	}
+
+	resp := httptest.NewRecorder()
+	reg.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	body := resp.Body.String()
+
+	expectedLines := []string{
+		"# HELP requests_total Requests handled.",
+		"# TYPE requests_total counter",
+		`requests_total{route="/v1/users",code="200"} 10`,
+		`requests_total{route="/v1/users",code="401"} 1`,
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{route="/v1/users",le="0.1"} 10`,
+		`latency_seconds_bucket{route="/v1/users",le="1"} 11`,
+		`latency_seconds_bucket{route="/v1/users",le="+Inf"} 12`,
+		`latency_seconds_sum{route="/v1/users"} 6`,
+		`latency_seconds_count{route="/v1/users"} 12`,
+		"# TYPE connections gauge",
+		"connections 3",
+		`instances{service="summary"} 2`,
+		`instances{service="we\"ird"} 1`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected line %q in:\n%s", line, body)
+		}
+	}
+	if contentType := resp.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("incorrect content type: %s", contentType)
+	}
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a name twice to panic")
+		}
+	}()
+	reg := NewRegistry()
+	reg.NewCounter("requests_total", "Requests handled.")
+	reg.NewCounter("requests_total", "Requests handled.")
+}
@@ -0,0 +1,57 @@
+package presence
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+// MemStore represents an in-process memory presence store.
+// This should be used only for testing and prototyping,
+// since it can't be shared between gateway instances.
+type MemStore struct {
+	entries map[bson.ObjectId]map[string]*Connection
+	ttl     time.Duration
+	mx      sync.Mutex
+}
+
+// NewMemStore constructs and returns a new MemStore.
+func NewMemStore(ttl time.Duration) *MemStore {
+	return &MemStore{
+		entries: make(map[bson.ObjectId]map[string]*Connection),
+		ttl:     ttl,
+	}
+}
+
+// Set sets the status of one of the user's connections.
+func (ms *MemStore) Set(userID bson.ObjectId, connID string, status string) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	if ms.entries[userID] == nil {
+		ms.entries[userID] = make(map[string]*Connection)
+	}
+	ms.entries[userID][connID] = &Connection{status, time.Now()}
+	return nil
+}
+
+// Remove removes one of the user's connections.
+func (ms *MemStore) Remove(userID bson.ObjectId, connID string) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	delete(ms.entries[userID], connID)
+	if len(ms.entries[userID]) == 0 {
+		delete(ms.entries, userID)
+	}
+	return nil
+}
+
+// Get returns the status of the user across all their connections.
+func (ms *MemStore) Get(userID bson.ObjectId) (string, error) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	conns := []*Connection{}
+	for _, conn := range ms.entries[userID] {
+		conns = append(conns, conn)
+	}
+	return aggregate(conns, ms.ttl), nil
+}
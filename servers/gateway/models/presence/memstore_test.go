@@ -0,0 +1,48 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testStore runs a Store through a user
+// connecting from two tabs and then leaving.
+func testStore(t *testing.T, store Store) {
+	userID := bson.NewObjectId()
+
+	expectStatus := func(step string, expected string) {
+		status, err := store.Get(userID)
+		if err != nil {
+			t.Fatalf("%s: error getting presence: %v", step, err)
+		}
+		if status != expected {
+			t.Errorf("%s: expected status %s but got %s", step, expected, status)
+		}
+	}
+
+	expectStatus("before connecting", StatusOffline)
+
+	if err := store.Set(userID, "tab1", StatusOnline); err != nil {
+		t.Fatalf("error setting presence: %v", err)
+	}
+	if err := store.Set(userID, "tab2", StatusAway); err != nil {
+		t.Fatalf("error setting presence: %v", err)
+	}
+	expectStatus("with one tab online", StatusOnline)
+
+	if err := store.Remove(userID, "tab1"); err != nil {
+		t.Fatalf("error removing presence: %v", err)
+	}
+	expectStatus("with one tab away", StatusAway)
+
+	if err := store.Remove(userID, "tab2"); err != nil {
+		t.Fatalf("error removing presence: %v", err)
+	}
+	expectStatus("after leaving", StatusOffline)
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore(time.Minute))
+}
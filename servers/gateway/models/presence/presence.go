@@ -0,0 +1,50 @@
+package presence
+
+import (
+	"time"
+)
+
+// Presence statuses of a user.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// DefaultTTL is how long the status of a connection
+// is trusted without being refreshed. Connections that are not refreshed
+// in time, such as those of a crashed gateway, are ignored.
+const DefaultTTL = time.Minute * 3
+
+// Connection represents the presence of a user
+// on one of their WebSocket connections.
+// A user might have several connections open at once,
+// from different browser tabs or devices.
+type Connection struct {
+	Status   string
+	LastSeen time.Time
+}
+
+// ValidStatus reports whether a client is allowed
+// to set its connection to the given status.
+func ValidStatus(status string) bool {
+	return status == StatusOnline || status == StatusAway
+}
+
+// aggregate returns the status of a user given all their connections.
+// The user is online if any fresh connection is online,
+// away if every fresh connection is away,
+// and offline if there is no fresh connection.
+func aggregate(conns []*Connection, ttl time.Duration) string {
+	status := StatusOffline
+	for _, conn := range conns {
+		if time.Since(conn.LastSeen) > ttl {
+			continue
+		}
+		if conn.Status == StatusOnline {
+			return StatusOnline
+		}
+		status = StatusAway
+	}
+	return status
+}
@@ -0,0 +1,54 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	fresh := time.Now()
+	stale := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		name           string
+		conns          []*Connection
+		expectedStatus string
+	}{
+		{
+			"No Connection",
+			[]*Connection{},
+			StatusOffline,
+		},
+		{
+			"Single Online Connection",
+			[]*Connection{{StatusOnline, fresh}},
+			StatusOnline,
+		},
+		{
+			"Single Away Connection",
+			[]*Connection{{StatusAway, fresh}},
+			StatusAway,
+		},
+		{
+			"Away and Online Connections",
+			[]*Connection{{StatusAway, fresh}, {StatusOnline, fresh}},
+			StatusOnline,
+		},
+		{
+			"Stale Online Connection",
+			[]*Connection{{StatusOnline, stale}, {StatusAway, fresh}},
+			StatusAway,
+		},
+		{
+			"Only Stale Connections",
+			[]*Connection{{StatusOnline, stale}, {StatusAway, stale}},
+			StatusOffline,
+		},
+	}
+
+	for _, c := range cases {
+		if status := aggregate(c.conns, time.Minute); status != c.expectedStatus {
+			t.Errorf("case %s: expected status %s but got %s", c.name, c.expectedStatus, status)
+		}
+	}
+}
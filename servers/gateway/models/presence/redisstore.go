@@ -0,0 +1,101 @@
+package presence
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// RedisStore represents a presence.Store backed by Redis,
+// so that all gateway instances agree on the presence of a user.
+// The connections of a user are stored in a Redis hash,
+// keyed by connection ID.
+type RedisStore struct {
+	// Redis client used to talk to redis server.
+	Client *redis.Client
+	// TTL is how long a connection is trusted without being refreshed.
+	TTL time.Duration
+}
+
+// NewRedisStore constructs a new RedisStore.
+func NewRedisStore(client *redis.Client, ttl time.Duration) *RedisStore {
+
+	// Initialize and return a new RedisStore struct.
+	if client == nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:     "127.0.0.1:6379",
+			Password: "",
+			DB:       0,
+		})
+	}
+
+	return &RedisStore{
+		Client: client,
+		TTL:    ttl,
+	}
+}
+
+// Set sets the status of one of the user's connections.
+func (rs *RedisStore) Set(userID bson.ObjectId, connID string, status string) error {
+	j, err := json.Marshal(&Connection{status, time.Now()})
+	if err != nil {
+		return fmt.Errorf("error marshalling struct to JSON: %v", err)
+	}
+
+	// Expire the whole hash if none of its connections
+	// is refreshed in time, so that users of crashed
+	// gateways don't stay in Redis forever.
+	pipe := rs.Client.TxPipeline()
+	defer pipe.Close()
+	pipe.HSet(getRedisKey(userID), connID, j)
+	pipe.Expire(getRedisKey(userID), rs.TTL)
+	_, err = pipe.Exec()
+	if err != nil {
+		return fmt.Errorf("error saving presence to Redis: %v", err)
+	}
+	return nil
+}
+
+// Remove removes one of the user's connections.
+func (rs *RedisStore) Remove(userID bson.ObjectId, connID string) error {
+	err := rs.Client.HDel(getRedisKey(userID), connID).Err()
+	if err != nil {
+		return fmt.Errorf("error deleting presence: %v", err)
+	}
+	return nil
+}
+
+// Get returns the status of the user across all their connections.
+func (rs *RedisStore) Get(userID bson.ObjectId) (string, error) {
+	vals, err := rs.Client.HGetAll(getRedisKey(userID)).Result()
+	if err != nil {
+		return "", fmt.Errorf("error getting presence from Redis: %v", err)
+	}
+
+	conns := []*Connection{}
+	stale := []string{}
+	for connID, val := range vals {
+		conn := &Connection{}
+		err := json.Unmarshal([]byte(val), conn)
+		if err != nil || time.Since(conn.LastSeen) > rs.TTL {
+			stale = append(stale, connID)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+
+	// Clean up connections left behind by a crashed gateway.
+	if len(stale) > 0 {
+		rs.Client.HDel(getRedisKey(userID), stale...)
+	}
+
+	return aggregate(conns, rs.TTL), nil
+}
+
+// getRedisKey returns the redis key of the hash
+// holding the connections of the given user.
+func getRedisKey(userID bson.ObjectId) string {
+	return "presence:" + userID.Hex()
+}
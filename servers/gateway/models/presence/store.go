@@ -0,0 +1,18 @@
+package presence
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Store stores the presence of users across all their connections.
+type Store interface {
+	// Set sets the status of one of the user's connections,
+	// and refreshes its LastSeen time.
+	Set(userID bson.ObjectId, connID string, status string) error
+
+	// Remove removes one of the user's connections.
+	Remove(userID bson.ObjectId, connID string) error
+
+	// Get returns the status of the user across all their connections.
+	Get(userID bson.ObjectId) (string, error)
+}
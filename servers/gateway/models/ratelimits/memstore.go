@@ -0,0 +1,69 @@
+package ratelimits
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the MemStore forgets full buckets.
+const sweepInterval = time.Minute
+
+// bucket is a token bucket of the MemStore.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will be full again.
+	full time.Time
+}
+
+// MemStore represents a ratelimits.Store backed by memory,
+// for a gateway that runs on its own.
+type MemStore struct {
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mx        sync.Mutex
+}
+
+// NewMemStore constructs a new MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take takes a token from the bucket with the given key.
+func (ms *MemStore) Take(key string, limit *Limit) (*Result, error) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	now := time.Now()
+	b, found := ms.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		ms.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	result := newResult(allowed, b.tokens, limit)
+	b.full = now.Add(result.Reset)
+
+	// Forget full buckets now and then,
+	// since they are no different from missing ones,
+	// so that the map doesn't grow forever.
+	if now.Sub(ms.lastSweep) > sweepInterval {
+		for k, other := range ms.buckets {
+			if now.After(other.full) {
+				delete(ms.buckets, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+	return result, nil
+}
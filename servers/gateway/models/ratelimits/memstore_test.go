@@ -0,0 +1,90 @@
+package ratelimits
+
+import (
+	"testing"
+	"time"
+)
+
+// testStore runs the tests every Store must pass.
+func testStore(t *testing.T, store Store) {
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	limit := &Limit{Rate: 10, Burst: 3}
+
+	// A full bucket lets a burst of requests through.
+	for i := limit.Burst - 1; i >= 0; i-- {
+		result, err := store.Take(key, limit)
+		if err != nil {
+			t.Fatalf("error taking token: %v", err)
+		}
+		if !result.Allowed || result.Remaining != i {
+			t.Errorf("expected request to be allowed with %d tokens left but got %+v", i, result)
+		}
+	}
+
+	// Then requests are refused until a token is added.
+	result, err := store.Take(key, limit)
+	if err != nil {
+		t.Fatalf("error taking token: %v", err)
+	}
+	if result.Allowed {
+		t.Errorf("expected request over the limit to be refused")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second/10 {
+		t.Errorf("expected to retry within 100ms but got %v", result.RetryAfter)
+	}
+
+	time.Sleep(result.RetryAfter + 10*time.Millisecond)
+	result, err = store.Take(key, limit)
+	if err != nil {
+		t.Fatalf("error taking token: %v", err)
+	}
+	if !result.Allowed {
+		t.Errorf("expected request to be allowed once a token is added")
+	}
+
+	// Buckets are independent.
+	result, err = store.Take(key+":other", limit)
+	if err != nil {
+		t.Fatalf("error taking token: %v", err)
+	}
+	if !result.Allowed || result.Remaining != limit.Burst-1 {
+		t.Errorf("expected a new bucket to be full but got %+v", result)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		input         string
+		expectedLimit *Limit
+		expectError   bool
+	}{
+		{"10/s", &Limit{10, 10}, false},
+		{"60/m,5", &Limit{1, 5}, false},
+		{"3600/h", &Limit{1, 3600}, false},
+		{"10", nil, true},
+		{"10/d", nil, true},
+		{"0/s", nil, true},
+		{"10/s,x", nil, true},
+	}
+
+	for _, c := range cases {
+		limit, err := ParseLimit(c.input)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("case %s: expected error but didn't get one", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s: unexpected error: %v", c.input, err)
+			continue
+		}
+		if *limit != *c.expectedLimit {
+			t.Errorf("case %s: expected %+v but got %+v", c.input, c.expectedLimit, limit)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimits
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket:
+// a client may send Burst requests at once,
+// and one more every 1/Rate seconds after that.
+type Limit struct {
+	// Rate is the number of tokens added to the bucket per second.
+	Rate float64
+	// Burst is the number of tokens the bucket holds.
+	Burst int
+}
+
+// ParseLimit parses a Limit in the form "<count>/<unit>" or "<count>/<unit>,<burst>",
+// where unit is "s", "m" or "h", such as "60/m,10".
+// The burst defaults to count.
+func ParseLimit(s string) (*Limit, error) {
+	parts := strings.SplitN(s, ",", 2)
+	rate := strings.SplitN(parts[0], "/", 2)
+	if len(rate) != 2 {
+		return nil, fmt.Errorf("invalid limit %s: expect count/unit", s)
+	}
+	count, err := strconv.Atoi(rate[0])
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid limit %s: count must be a positive integer", s)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[rate[1]]
+	if per == 0 {
+		return nil, fmt.Errorf("invalid limit %s: unit must be s, m or h", s)
+	}
+	limit := &Limit{
+		Rate:  float64(count) / per.Seconds(),
+		Burst: count,
+	}
+	if len(parts) == 2 {
+		limit.Burst, err = strconv.Atoi(parts[1])
+		if err != nil || limit.Burst < 1 {
+			return nil, fmt.Errorf("invalid limit %s: burst must be a positive integer", s)
+		}
+	}
+	return limit, nil
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	// Allowed is true if a token was taken, and the request may proceed.
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long until a token is available again,
+	// if none was.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// newResult returns the Result of taking a token from a bucket
+// that has the given number of tokens left.
+func newResult(allowed bool, tokens float64, limit *Limit) *Result {
+	result := &Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     secondsToDuration((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = secondsToDuration((1 - tokens) / limit.Rate)
+	}
+	return result
+}
+
+// secondsToDuration converts seconds to a time.Duration.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,79 @@
+package ratelimits
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"math"
+	"strconv"
+	"time"
+)
+
+// takeScript takes a token from the bucket in the Redis hash KEYS[1],
+// refilled at ARGV[1] tokens per second up to ARGV[2] tokens,
+// as of ARGV[3] milliseconds since the epoch.
+// It returns 1 if a token was taken and 0 if not,
+// and the tokens left as a string, since Redis truncates Lua numbers.
+// Running it as a script makes taking a token atomic,
+// so that gateway instances sharing a bucket can't both take the last one.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore represents a ratelimits.Store backed by Redis,
+// so that all gateway instances share the buckets of a client.
+// Every bucket is a Redis hash, which expires once it would be full.
+type RedisStore struct {
+	// Redis client used to talk to redis server.
+	Client *redis.Client
+}
+
+// NewRedisStore constructs a new RedisStore.
+func NewRedisStore(client *redis.Client) *RedisStore {
+
+	// Initialize and return a new RedisStore struct.
+	if client == nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:     "127.0.0.1:6379",
+			Password: "",
+			DB:       0,
+		})
+	}
+
+	return &RedisStore{
+		Client: client,
+	}
+}
+
+// Take takes a token from the bucket with the given key.
+func (rs *RedisStore) Take(key string, limit *Limit) (*Result, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	val, err := takeScript.Run(rs.Client, []string{"ratelimit:" + key}, limit.Rate, limit.Burst, now).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error taking token from Redis: %v", err)
+	}
+	reply, ok := val.([]interface{})
+	if !ok || len(reply) != 2 {
+		return nil, fmt.Errorf("unexpected reply from Redis: %v", val)
+	}
+	allowed, _ := reply[0].(int64)
+	tokensVal, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(tokensVal, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tokens left: %v", err)
+	}
+	return newResult(allowed == 1, math.Max(0, tokens), limit), nil
+}
@@ -0,0 +1,27 @@
+package ratelimits
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+/*
+TestRedisStore tests the RedisStore object.
+Like the sessions RedisStore test, this is really more of an
+integration test, and needs a redis server running on its default
+port (6379), or at the address in the REDISADDR environment variable.
+*/
+func TestRedisStore(t *testing.T) {
+	redisaddr := os.Getenv("REDISADDR")
+	if len(redisaddr) == 0 {
+		redisaddr = "127.0.0.1:6379"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: redisaddr,
+	})
+
+	testStore(t, NewRedisStore(client))
+}
@@ -0,0 +1,8 @@
+package ratelimits
+
+// Store stores the token buckets of rate limited clients.
+type Store interface {
+	// Take takes a token from the bucket with the given key,
+	// creating a full bucket with the given limit if there is none yet.
+	Take(key string, limit *Limit) (*Result, error)
+}
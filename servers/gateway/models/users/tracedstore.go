@@ -0,0 +1,102 @@
+package users
+
+import (
+	"context"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/indexes"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TracedStore is a Store that traces every call to the Store it wraps
+// as a span of the request ctx belongs to.
+type TracedStore struct {
+	store Store
+	ctx   context.Context
+}
+
+// NewTracedStore wraps store into a TracedStore
+// tracing calls as part of the request ctx belongs to.
+func NewTracedStore(store Store, ctx context.Context) *TracedStore {
+	if store == nil {
+		panic("nil user store")
+	}
+	return &TracedStore{store, ctx}
+}
+
+// start starts the span of a call to the Store.
+func (ts *TracedStore) start(method string) *tracing.Span {
+	_, span := tracing.Start(ts.ctx, "users."+method)
+	return span
+}
+
+// GetByID returns the User with the given ID.
+func (ts *TracedStore) GetByID(id bson.ObjectId) (*User, error) {
+	span := ts.start("GetByID")
+	defer span.End()
+	user, err := ts.store.GetByID(id)
+	span.SetError(err)
+	return user, err
+}
+
+// GetByEmail returns the User with the given email.
+func (ts *TracedStore) GetByEmail(email string) (*User, error) {
+	span := ts.start("GetByEmail")
+	defer span.End()
+	user, err := ts.store.GetByEmail(email)
+	span.SetError(err)
+	return user, err
+}
+
+// GetByUserName returns the User with the given Username.
+func (ts *TracedStore) GetByUserName(username string) (*User, error) {
+	span := ts.start("GetByUserName")
+	defer span.End()
+	user, err := ts.store.GetByUserName(username)
+	span.SetError(err)
+	return user, err
+}
+
+// Insert converts the NewUser to a User, inserts
+// it into the database, and returns it.
+func (ts *TracedStore) Insert(newUser *NewUser) (*User, error) {
+	span := ts.start("Insert")
+	defer span.End()
+	user, err := ts.store.Insert(newUser)
+	span.SetError(err)
+	return user, err
+}
+
+// Update applies UserUpdates to the given user ID.
+func (ts *TracedStore) Update(userID bson.ObjectId, updates *Updates) error {
+	span := ts.start("Update")
+	defer span.End()
+	err := ts.store.Update(userID, updates)
+	span.SetError(err)
+	return err
+}
+
+// Delete deletes the user with the given ID.
+func (ts *TracedStore) Delete(userID bson.ObjectId) error {
+	span := ts.start("Delete")
+	defer span.End()
+	err := ts.store.Delete(userID)
+	span.SetError(err)
+	return err
+}
+
+// Index stores user information into a trie.
+func (ts *TracedStore) Index() *indexes.Trie {
+	span := ts.start("Index")
+	defer span.End()
+	return ts.store.Index()
+}
+
+// ConvertToUsers converts all keys(User IDs) in a given map to a slice of User.
+func (ts *TracedStore) ConvertToUsers(userIDs map[bson.ObjectId]bool) ([]*User, error) {
+	span := ts.start("ConvertToUsers")
+	defer span.End()
+	span.SetAttribute("users.count", len(userIDs))
+	users, err := ts.store.ConvertToUsers(userIDs)
+	span.SetError(err)
+	return users, err
+}
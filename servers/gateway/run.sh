@@ -19,12 +19,34 @@ export TLSKEY=/etc/letsencrypt/live/info-344-api.zicodeng.me/privkey.pem
 
 export SESSIONKEY=secretsigningkey
 
+# Shared with the microservices, which sign their announcements with it.
+export REGISTRATIONKEY=secretregistrationkey
+# Shared with the microservices, which verify the identity tokens signed with it.
+export IDENTITYKEY=secretidentitykey
+# Which microservices may claim which paths.
+export SERVICEALLOWLIST="messaging=/v1/channels,/v1/messages;summary=/v1/summary"
+
 export ADDR=:443
 export REDISADDR=$REDIS_CONTAINER:6379
 export DBADDR=$MONGO_CONTAINER:27017
 export MQADDR=$MQ_CONTAINER:5672
 
-# Microservice addresses.
+# How many requests each user, or IP address, may send where.
+export RATELIMITS="default=300/m,50;/v1/users=60/m,10;/v1/resetcodes=5/m,2;service:summary=60/m,10"
+
+# Which web origins may call the gateway.
+export CORSPOLICY='{"allowedOrigins":["https://info-344.zicodeng.me"]}'
+
+# Credential of the service registry admin API.
+export ADMINKEY=secretadminkey
+# Bearer token Prometheus scrapes /metrics with.
+export METRICSKEY=secretmetricskey
+
+# How long in-flight requests and WebSockets have to finish on shutdown.
+# The container is given longer than that to stop before it is killed.
+export SHUTDOWNTIMEOUT=30s
+
+# Static microservice addresses, used whenever discovery finds no instance.
 export MESSAGESVCADDR=info-344-messaging:80
 export SUMMARYSVCADDR=info-344-summary:80
 
@@ -92,15 +114,24 @@ docker run \
 -d \
 -p 443:443 \
 --name $GATEWAY_CONTAINER \
+--stop-timeout 40 \
 --network $APP_NETWORK \
 -v /etc/letsencrypt:/etc/letsencrypt:ro \
 -e TLSCERT=$TLSCERT \
 -e TLSKEY=$TLSKEY \
 -e SESSIONKEY=$SESSIONKEY \
+-e REGISTRATIONKEY=$REGISTRATIONKEY \
+-e IDENTITYKEY=$IDENTITYKEY \
+-e SERVICEALLOWLIST="$SERVICEALLOWLIST" \
 -e ADDR=$ADDR \
 -e REDISADDR=$REDISADDR \
 -e DBADDR=$DBADDR \
 -e MQADDR=$MQADDR \
+-e ADMINKEY=$ADMINKEY \
+-e METRICSKEY=$METRICSKEY \
+-e SHUTDOWNTIMEOUT=$SHUTDOWNTIMEOUT \
+-e RATELIMITS="$RATELIMITS" \
+-e CORSPOLICY="$CORSPOLICY" \
 -e MESSAGESVCADDR=$MESSAGESVCADDR \
 -e SUMMARYSVCADDR=$SUMMARYSVCADDR \
 --restart unless-stopped \
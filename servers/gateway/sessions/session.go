@@ -3,6 +3,7 @@ package sessions
 import (
 	"errors"
 	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
 	"net/http"
 	"strings"
 )
@@ -77,17 +78,22 @@ func GetSessionID(r *http.Request, signingKey string) (SessionID, error) {
 // GetState extracts the SessionID from the request,
 // gets the associated state from the provided store into
 // the `sessionState` parameter, and returns the SessionID.
+// It is traced as part of the request.
 func GetState(r *http.Request, signingKey string, store Store, sessionState interface{}) (SessionID, error) {
+	_, span := tracing.Start(r.Context(), "sessions.GetState")
+	defer span.End()
 
 	// Get the SessionID from the request.
 	sessionID, err := GetSessionID(r, signingKey)
 	if err != nil {
+		span.SetError(err)
 		return sessionID, fmt.Errorf("error getting session ID: %v", err)
 	}
 
 	// Get the data associated with that SessionID from the store.
 	err = store.Get(sessionID, sessionState)
 	if err != nil {
+		span.SetError(err)
 		return sessionID, err
 	}
 
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanData is what is exported of a Span once it ends.
+type SpanData struct {
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+	// ParentID is empty for the first span of a trace.
+	ParentID       string            `json:"parentID,omitempty"`
+	Service        string            `json:"service"`
+	Name           string            `json:"name"`
+	Start          time.Time         `json:"start"`
+	DurationMillis float64           `json:"durationMillis"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// Exporter sends the spans that ended somewhere they can be looked at,
+// such as a file or a tracing collector.
+// Export is called on the goroutine that ends the span,
+// so it must be safe for concurrent use, and should not block for long.
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+// WriterExporter writes spans as lines of JSON.
+type WriterExporter struct {
+	out io.Writer
+	mx  sync.Mutex
+}
+
+// NewWriterExporter constructs a new WriterExporter writing to out.
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	if out == nil {
+		panic("nil span writer")
+	}
+	return &WriterExporter{out: out}
+}
+
+// NewFileExporter constructs a new WriterExporter
+// appending to the file at path.
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening span file: %v", err)
+	}
+	return NewWriterExporter(f), nil
+}
+
+// Export implements the Exporter interface for the WriterExporter.
+func (we *WriterExporter) Export(span *SpanData) {
+	j, err := json.Marshal(span)
+	if err != nil {
+		log.Printf("error marshalling span: %v", err)
+		return
+	}
+	we.mx.Lock()
+	defer we.mx.Unlock()
+	if _, err := we.out.Write(append(j, '\n')); err != nil {
+		log.Printf("error writing span: %v", err)
+	}
+}
+
+// NewExporter constructs the Exporter described by spec, which is
+// "stdout", "stderr", or "file:" followed by the path of a file.
+func NewExporter(spec string) (Exporter, error) {
+	switch {
+	case spec == "stdout":
+		return NewWriterExporter(os.Stdout), nil
+	case spec == "stderr":
+		return NewWriterExporter(os.Stderr), nil
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		return NewFileExporter(strings.TrimPrefix(spec, "file:"))
+	default:
+		return nil, fmt.Errorf("unknown span exporter %q, expected stdout, stderr or file:path", spec)
+	}
+}
@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"net/http"
+)
+
+// Handler is a middleware handler that traces every request
+// it passes on to the wrapped handler.
+// Requests carrying a valid traceparent header continue the caller's trace,
+// and every other request starts a new one.
+type Handler struct {
+	handler http.Handler
+	tracer  *Tracer
+}
+
+// NewHandler wraps another handler into Handler, tracing with tracer.
+func NewHandler(handlerToWrap http.Handler, tracer *Tracer) *Handler {
+	if tracer == nil {
+		panic("nil tracer")
+	}
+	return &Handler{handlerToWrap, tracer}
+}
+
+// ServeHTTP implements the http.Handler interface for the Handler.
+// The span of the request is the current span
+// of the context of the request passed on.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := WithTracer(r.Context(), h.tracer)
+	if sc, err := ParseTraceParent(r.Header.Get(HeaderTraceParent)); err == nil {
+		ctx = WithRemoteParent(ctx, sc)
+	}
+	ctx, span := Start(ctx, r.Method+" "+r.URL.Path)
+	defer span.End()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.path", r.URL.Path)
+	if requestID := r.Header.Get(accesslog.HeaderRequestID); len(requestID) != 0 {
+		span.SetAttribute("request.id", requestID)
+	}
+	// Let the access log point at the trace.
+	accesslog.FromContext(ctx).TraceID = hex.EncodeToString(span.context.TraceID[:])
+
+	recorder := accesslog.NewResponseRecorder(w)
+	h.handler.ServeHTTP(recorder, r.WithContext(ctx))
+	span.SetAttribute("http.status", recorder.Status())
+}
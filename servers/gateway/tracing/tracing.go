@@ -0,0 +1,236 @@
+// Package tracing records spans of the work done for a request,
+// and passes the trace context on to microservices
+// in the W3C traceparent header, so that the spans of a request
+// can be put together across the gateway and the microservices.
+// See https://www.w3.org/TR/trace-context/.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderTraceParent is the header the trace context is passed on in.
+const HeaderTraceParent = "traceparent"
+
+// flagSampled is the trace flag saying the trace is recorded.
+const flagSampled = 0x01
+
+// SpanContext identifies a span, and is what is passed on to microservices.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceParent parses a SpanContext from the value of a traceparent header.
+func ParseTraceParent(value string) (*SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	// Later versions may add parts, but must keep the first four.
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, fmt.Errorf("invalid traceparent %q: expect version-traceid-spanid-flags", value)
+	}
+	sc := &SpanContext{}
+	flags := make([]byte, 1)
+	fields := []struct {
+		hex string
+		dst []byte
+	}{
+		{parts[0], make([]byte, 1)},
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], flags},
+	}
+	for _, field := range fields {
+		if len(field.hex) != hex.EncodedLen(len(field.dst)) || strings.ToLower(field.hex) != field.hex {
+			return nil, fmt.Errorf("invalid traceparent %q: expect lowercase hex fields", value)
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.hex)); err != nil {
+			return nil, fmt.Errorf("invalid traceparent %q: %v", value, err)
+		}
+	}
+	if sc.TraceID == ([16]byte{}) || sc.SpanID == ([8]byte{}) {
+		return nil, fmt.Errorf("invalid traceparent %q: trace and span IDs can't be zero", value)
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+	return sc, nil
+}
+
+// TraceParent returns the value of the traceparent header for the SpanContext.
+func (sc *SpanContext) TraceParent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = flagSampled
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// Tracer starts spans for a service, and exports them once they end.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer constructs a new Tracer for the named service.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	if len(service) == 0 {
+		panic("service name has length of zero")
+	}
+	if exporter == nil {
+		panic("nil exporter")
+	}
+	return &Tracer{service, exporter}
+}
+
+// Span is a piece of work done for a request.
+// The methods of a nil Span do nothing,
+// so that code can be traced whether or not tracing is on.
+type Span struct {
+	tracer     *Tracer
+	context    SpanContext
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	attributes map[string]string
+	err        string
+	ended      bool
+	mx         sync.Mutex
+}
+
+// contextKey is the type of keys of values
+// this package puts in contexts.
+type contextKey string
+
+// Context keys of the Tracer, the current Span,
+// and the SpanContext received from the caller.
+const (
+	tracerKey = contextKey("tracer")
+	spanKey   = contextKey("span")
+	remoteKey = contextKey("remote")
+)
+
+// WithTracer returns a copy of ctx in which spans are started by tracer.
+func WithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey, tracer)
+}
+
+// WithRemoteParent returns a copy of ctx in which
+// spans without a local parent are children of sc,
+// which was received from the caller.
+func WithRemoteParent(ctx context.Context, sc *SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// FromContext returns the current Span of ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// Start starts a new Span, named after the work it does,
+// as a child of the current Span of ctx.
+// It returns a copy of ctx in which the new Span is the current one.
+// If ctx has no Tracer, tracing is off, and the returned Span is nil.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	tracer, _ := ctx.Value(tracerKey).(*Tracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: tracer, name: name, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parentID = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey).(*SpanContext); ok {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parentID = remote.SpanID
+	} else {
+		// This is the first span of a new trace.
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// Context returns the SpanContext of the Span.
+func (span *Span) Context() *SpanContext {
+	if span == nil {
+		return nil
+	}
+	sc := span.context
+	return &sc
+}
+
+// SetAttribute records a key/value pair describing the work of the Span.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mx.Lock()
+	defer span.mx.Unlock()
+	if span.attributes == nil {
+		span.attributes = make(map[string]string)
+	}
+	span.attributes[key] = fmt.Sprint(value)
+}
+
+// SetError records that the work of the Span failed with err.
+// A nil err is ignored.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mx.Lock()
+	defer span.mx.Unlock()
+	span.err = err.Error()
+}
+
+// End ends the Span, and exports it if its trace is sampled.
+// Only the first call has any effect.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	end := time.Now()
+	span.mx.Lock()
+	if span.ended {
+		span.mx.Unlock()
+		return
+	}
+	span.ended = true
+	data := &SpanData{
+		TraceID:        hex.EncodeToString(span.context.TraceID[:]),
+		SpanID:         hex.EncodeToString(span.context.SpanID[:]),
+		Service:        span.tracer.service,
+		Name:           span.name,
+		Start:          span.start,
+		DurationMillis: float64(end.Sub(span.start)) / float64(time.Millisecond),
+		Attributes:     span.attributes,
+		Error:          span.err,
+	}
+	span.mx.Unlock()
+
+	if span.parentID != ([8]byte{}) {
+		data.ParentID = hex.EncodeToString(span.parentID[:])
+	}
+	if span.context.Sampled {
+		span.tracer.exporter.Export(data)
+	}
+}
+
+// Inject sets the traceparent header of an outgoing request
+// to the current Span of ctx, so that the callee's spans become its children.
+// If there is no current Span, header is left as is.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set(HeaderTraceParent, span.Context().TraceParent())
+	}
+}
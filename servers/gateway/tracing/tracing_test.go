@@ -0,0 +1,266 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		name            string
+		value           string
+		expectError     bool
+		expectedSampled bool
+	}{
+		{
+			"Valid Sampled",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			false,
+			true,
+		},
+		{
+			"Valid Not Sampled",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00",
+			false,
+			false,
+		},
+		{
+			"Later Version With More Parts",
+			"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+			false,
+			true,
+		},
+		{
+			"Version 00 With More Parts",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+			true,
+			false,
+		},
+		{
+			"Invalid Version",
+			"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			true,
+			false,
+		},
+		{
+			"Uppercase",
+			"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+			true,
+			false,
+		},
+		{
+			"Zero Trace ID",
+			"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+			true,
+			false,
+		},
+		{
+			"Zero Span ID",
+			"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+			true,
+			false,
+		},
+		{
+			"Short Span ID",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71-01",
+			true,
+			false,
+		},
+		{
+			"Empty",
+			"",
+			true,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		sc, err := ParseTraceParent(c.value)
+		if err != nil != c.expectError {
+			t.Errorf("case %s: unexpected error result: %v", c.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sc.Sampled != c.expectedSampled {
+			t.Errorf("case %s: incorrect sampled flag: expected %t but got %t", c.name, c.expectedSampled, sc.Sampled)
+		}
+		if c.value[:2] == "00" && sc.TraceParent() != c.value {
+			t.Errorf("case %s: incorrect traceparent: expected %s but got %s", c.name, c.value, sc.TraceParent())
+		}
+	}
+}
+
+// recordingExporter keeps the spans exported to it.
+type recordingExporter struct {
+	spans []*SpanData
+}
+
+func (re *recordingExporter) Export(span *SpanData) {
+	re.spans = append(re.spans, span)
+}
+
+func TestHandler(t *testing.T) {
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+	const parentID = "b7ad6b7169203331"
+
+	cases := []struct {
+		name             string
+		traceParent      string
+		expectedTraceID  string
+		expectedParentID string
+		expectedSpans    int
+	}{
+		{
+			"Continued Trace",
+			"00-" + traceID + "-" + parentID + "-01",
+			traceID,
+			parentID,
+			2,
+		},
+		{
+			"Not Sampled Trace",
+			"00-" + traceID + "-" + parentID + "-00",
+			traceID,
+			parentID,
+			0,
+		},
+		{
+			"New Trace",
+			"",
+			"",
+			"",
+			2,
+		},
+		{
+			"Invalid Trace",
+			"garbage",
+			"",
+			"",
+			2,
+		},
+	}
+
+	for _, c := range cases {
+		exporter := &recordingExporter{}
+		var injected string
+		handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := Start(r.Context(), "work")
+			span.SetAttribute("answer", 42)
+			span.SetError(errors.New("failed"))
+			header := http.Header{}
+			Inject(ctx, header)
+			injected = header.Get(HeaderTraceParent)
+			span.End()
+			span.End()
+			w.WriteHeader(http.StatusTeapot)
+		}), NewTracer("test", exporter))
+
+		r := httptest.NewRequest("GET", "/v1/test", nil)
+		if len(c.traceParent) != 0 {
+			r.Header.Set(HeaderTraceParent, c.traceParent)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		sc, err := ParseTraceParent(injected)
+		if err != nil {
+			t.Errorf("case %s: error parsing injected traceparent: %v", c.name, err)
+			continue
+		}
+		if len(exporter.spans) != c.expectedSpans {
+			t.Errorf("case %s: expected %d spans but got %d", c.name, c.expectedSpans, len(exporter.spans))
+			continue
+		}
+		if c.expectedSpans == 0 {
+			if sc.Sampled {
+				t.Errorf("case %s: expected not sampled flag to be passed on", c.name)
+			}
+			continue
+		}
+
+		// The inner span ends first.
+		work, request := exporter.spans[0], exporter.spans[1]
+		if work.Name != "work" || request.Name != "GET /v1/test" || request.Service != "test" {
+			t.Errorf("case %s: incorrect span names: %s, %s", c.name, work.Name, request.Name)
+		}
+		if len(c.expectedTraceID) != 0 && request.TraceID != c.expectedTraceID {
+			t.Errorf("case %s: incorrect trace ID: expected %s but got %s", c.name, c.expectedTraceID, request.TraceID)
+		}
+		if request.ParentID != c.expectedParentID {
+			t.Errorf("case %s: incorrect parent ID: expected %q but got %q", c.name, c.expectedParentID, request.ParentID)
+		}
+		if work.TraceID != request.TraceID || work.ParentID != request.SpanID {
+			t.Errorf("case %s: expected work span to be a child of the request span", c.name)
+		}
+		if !strings.Contains(injected, work.SpanID) {
+			t.Errorf("case %s: expected injected traceparent %s to carry the work span", c.name, injected)
+		}
+		if work.Attributes["answer"] != "42" || work.Error != "failed" || request.Attributes["http.status"] != "418" {
+			t.Errorf("case %s: incorrect attributes: %v, %v", c.name, work, request.Attributes)
+		}
+	}
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	// Code can be traced whether or not tracing is on.
+	ctx, span := Start(context.Background(), "work")
+	if span != nil {
+		t.Fatalf("expected nil span without a tracer")
+	}
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+	header := http.Header{}
+	header.Set(HeaderTraceParent, "untouched")
+	Inject(ctx, header)
+	if header.Get(HeaderTraceParent) != "untouched" {
+		t.Errorf("expected traceparent to be left as is without a span")
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	cases := []struct {
+		name        string
+		spec        string
+		expectError bool
+	}{
+		{"Stdout", "stdout", false},
+		{"Stderr", "stderr", false},
+		{"File", "file:" + path, false},
+		{"File Without Path", "file:", true},
+		{"Unknown", "jaeger", true},
+	}
+	for _, c := range cases {
+		if _, err := NewExporter(c.spec); err != nil != c.expectError {
+			t.Errorf("case %s: unexpected error result: %v", c.name, err)
+		}
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exporter := NewWriterExporter(buf)
+	exporter.Export(&SpanData{TraceID: "1", SpanID: "2", Name: "first"})
+	exporter.Export(&SpanData{TraceID: "1", SpanID: "3", ParentID: "2", Name: "second"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines but got %q", buf.String())
+	}
+	span := &SpanData{}
+	if err := json.Unmarshal([]byte(lines[1]), span); err != nil {
+		t.Fatalf("error unmarshalling span: %v", err)
+	}
+	if span.Name != "second" || span.ParentID != "2" {
+		t.Errorf("incorrect span: %s", lines[1])
+	}
+}
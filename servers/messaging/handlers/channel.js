@@ -48,8 +48,8 @@ const ChannelHandler = (channelStore, messageStore) => {
             description = req.body.description;
         }
 
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const channel = new Channel(name, description, user);
 
         channelStore
@@ -67,23 +67,50 @@ const ChannelHandler = (channelStore, messageStore) => {
             });
     });
 
-    // Respond with the latest 50 messages posted to the specified channel.
+    // The gateway asks here whether a user may subscribe to the specified channel.
+    // Respond with the status code 404 (Not Found) if there is no such channel,
+    // without looking up its messages, since only the headers are sent.
+    router.head('/v1/channels/:channelID', (req, res) => {
+        const channelID = new mongodb.ObjectID(req.params.channelID);
+        channelStore
+            .get(channelID)
+            .then(channel => {
+                res.status(channel ? 200 : 404).end();
+            })
+            .catch(err => {
+                console.log(err);
+                res.status(500).end();
+            });
+    });
+
+    // Respond with the latest 50 messages posted to the specified channel,
+    // or with the status code 404 (Not Found) if there is no such channel.
     router.get('/v1/channels/:channelID', (req, res) => {
         const channelID = new mongodb.ObjectID(req.params.channelID);
-        messageStore
-            .getAll(channelID)
+        channelStore
+            .get(channelID)
+            .then(channel => {
+                if (!channel) {
+                    res.set('Content-Type', 'text/plain');
+                    res.status(404).send('no such channel found');
+                    throw breakSignal;
+                }
+                return messageStore.getAll(channelID);
+            })
             .then(messages => {
                 res.json(messages);
             })
             .catch(err => {
-                console.log(err);
+                if (err !== breakSignal) {
+                    console.log(err);
+                }
             });
     });
 
     // Create a new message in this channel.
     router.post('/v1/channels/:channelID', (req, res) => {
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const channelID = new mongodb.ObjectID(req.params.channelID);
         const messageBody = req.body.body;
         const message = new Message(channelID, messageBody, user);
@@ -97,9 +124,18 @@ const ChannelHandler = (channelStore, messageStore) => {
         const promises = [];
         if (URLs.size > 0) {
             const summarySvcAddr = 'http://' + (process.env.SUMMARYSVCADDR || 'localhost:5000');
+            // The summary service only answers requests carrying an identity token,
+            // so pass on the one the gateway signed for this request,
+            // along with the request ID, so that both requests are logged together.
+            const config = {
+                headers: {
+                    'X-User-Token': req.get('X-User-Token'),
+                    'X-Request-ID': req.get('X-Request-ID') || ''
+                }
+            };
             for (let URL of URLs) {
                 let reqURL = summarySvcAddr + '/v1/summary?url=' + URL;
-                promises.push(axios.get(reqURL));
+                promises.push(axios.get(reqURL, config));
             }
         }
 
@@ -135,8 +171,8 @@ const ChannelHandler = (channelStore, messageStore) => {
 
     // Allow channel creator to modify this channel.
     router.patch('/v1/channels/:channelID', (req, res) => {
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const channelID = new mongodb.ObjectID(req.params.channelID);
         channelStore
             .get(channelID)
@@ -184,8 +220,8 @@ const ChannelHandler = (channelStore, messageStore) => {
     // If the current user created the channel, delete it and all messages related to it.
     // If the current user isn't the creator, respond with the status code 403 (Forbidden).
     router.delete('/v1/channels/:channelID', (req, res, next) => {
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const channelID = new mongodb.ObjectID(req.params.channelID);
         channelStore
             .get(channelID)
@@ -19,8 +19,8 @@ const MessageHandler = messageStore => {
 
     // Allow message creator to modify this message.
     router.patch('/v1/messages/:messageID', (req, res) => {
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const messageID = new mongodb.ObjectID(req.params.messageID);
 
         messageStore
@@ -57,8 +57,8 @@ const MessageHandler = messageStore => {
 
     // Allow message creator to delete this message.
     router.delete('/v1/messages/:messageID', (req, res) => {
-        const userJSON = req.get('X-User');
-        const user = JSON.parse(userJSON);
+        // Set by the middleware that verifies the identity token.
+        const user = req.user;
         const messageID = new mongodb.ObjectID(req.params.messageID);
 
         messageStore
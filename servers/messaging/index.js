@@ -15,6 +15,21 @@ const qName = 'testQ';
 const mqAddr = process.env.MQADDR || '192.168.99.100:5672';
 const mqURL = `amqp://${mqAddr}`;
 
+const crypto = require('crypto');
+// The gateway only registers announcements signed with the registration key.
+const registrationKey = process.env.REGISTRATIONKEY;
+if (!registrationKey) {
+    console.error('Please set REGISTRATIONKEY environment variable');
+    process.exit(1);
+}
+
+// The gateway signs the identity of every request it forwards with the identity key.
+const identityKey = process.env.IDENTITYKEY;
+if (!identityKey) {
+    console.error('Please set IDENTITYKEY environment variable');
+    process.exit(1);
+}
+
 const express = require('express');
 const app = express();
 const morgan = require('morgan');
@@ -49,26 +64,32 @@ const portNum = parseInt(port);
             heartbeat: heartBeat
         };
         setInterval(() => {
-            publisher.publish('microservices', JSON.stringify(msgSvc));
+            publisher.publish('microservices', signAnnouncement(msgSvc));
         }, 1000 * heartBeat);
 
         // Add global middlewares.
-        app.use(morgan(process.env.LOG_FORMAT || 'dev'));
+        // Log the request ID the gateway gave each request,
+        // so that it can be matched with the gateway's log.
+        morgan.token('request-id', req => req.get('X-Request-ID') || '-');
+        app.use(morgan(process.env.LOG_FORMAT || ':request-id :method :url :status :response-time ms'));
         // Parses posted JSON and makes
         // it available from req.body.
         app.use(express.json());
 
         // All of the following APIs require the user to be authenticated.
-        // If the user is not authenticated,
+        // If the request did not come through the gateway,
+        // or the user is not authenticated,
         // respond immediately with the status code 401 (Unauthorized).
         app.use((req, res, next) => {
-            const userJSON = req.get('X-User');
-            if (!userJSON) {
+            const claims = verifyIdentity(req.get('X-User-Token'));
+            if (!claims || !claims.sub) {
                 res.set('Content-Type', 'text/plain');
-                res.status(401).send('no X-User header found in the request');
+                res.status(401).send('no valid identity token found in the request');
                 // Stop continuing.
                 return;
             }
+            // Make the user available from req.user.
+            req.user = claims.user;
             // Invoke next chained handler if the user is authenticated.
             next();
         });
@@ -105,3 +126,52 @@ const portNum = parseInt(port);
         console.log(err);
     }
 })();
+
+// Sign a microservice announcement the way the gateway verifies it:
+// an HMAC-SHA256 of the timestamp, a '.', and the service JSON.
+// Sign every announcement anew, since the gateway rejects old ones.
+function signAnnouncement(svc) {
+    const service = JSON.stringify(svc);
+    const timestamp = Math.floor(Date.now() / 1000);
+    const signature = crypto
+        .createHmac('sha256', registrationKey)
+        .update(`${timestamp}.${service}`)
+        .digest('hex');
+    // Embed the exact service JSON that was signed.
+    return `{"service":${service},"timestamp":${timestamp},"signature":"${signature}"}`;
+}
+
+// Verify an identity token the way the gateway signs it:
+// the base64url-encoded claims JSON, a '.',
+// and the base64url-encoded HMAC-SHA256 of the encoded claims.
+// Return the claims, or null if the token is invalid or expired.
+function verifyIdentity(token) {
+    if (!token) {
+        return null;
+    }
+    const parts = token.split('.');
+    if (parts.length !== 2) {
+        return null;
+    }
+    const expected = crypto
+        .createHmac('sha256', identityKey)
+        .update(parts[0])
+        .digest();
+    const signature = Buffer.from(parts[1], 'base64');
+    // Compare in constant time.
+    if (signature.length !== expected.length || !crypto.timingSafeEqual(signature, expected)) {
+        return null;
+    }
+    let claims;
+    try {
+        claims = JSON.parse(Buffer.from(parts[0], 'base64').toString());
+    } catch (err) {
+        return null;
+    }
+    // Leave room for clock skew between the gateway and this microservice.
+    const now = Math.floor(Date.now() / 1000);
+    if (now > claims.exp || claims.iat > now + 30) {
+        return null;
+    }
+    return claims;
+}
@@ -5,6 +5,10 @@ set -e
 export MESSAGING_CONTAINER=info-344-messaging
 export MQ_CONTAINER=rabbitmq-server
 export APP_NETWORK=appnet
+# Must match the gateway's, which only registers announcements signed with it.
+export REGISTRATIONKEY=secretregistrationkey
+# Must match the gateway's, which signs the identity of every request with it.
+export IDENTITYKEY=secretidentitykey
 
 docker pull zicodeng/$MESSAGING_CONTAINER
 
@@ -30,6 +34,8 @@ docker run \
 -e MQADDR=$MQ_CONTAINER:5672 \
 -e DBADDR=mongo-server:27017 \
 -e REDISADDR=redis-server \
+-e REGISTRATIONKEY=$REGISTRATIONKEY \
+-e IDENTITYKEY=$IDENTITYKEY \
 -e SUMMARYSVCADDR=info-344-summary:80 \
 --name $MESSAGING_CONTAINER \
 --network $APP_NETWORK \
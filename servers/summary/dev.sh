@@ -4,5 +4,10 @@ set -e
 
 export ADDR=localhost:5000
 export REDISADDR=192.168.99.100:6379
+# Must match the gateway's.
+export REGISTRATIONKEY="secret registration key"
+export IDENTITYKEY="secret identity key"
+# Write spans to a file rather than a collector.
+export TRACEEXPORTER="file:summary-spans.json"
 
 go run main.go
\ No newline at end of file
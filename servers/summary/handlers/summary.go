@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
 	"golang.org/x/net/html"
 	"io"
 	"net/http"
@@ -60,7 +61,11 @@ func SummaryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Call fetchHTML() to fetch the requested URL.
+	_, span := tracing.Start(r.Context(), "fetchHTML")
+	span.SetAttribute("page.url", pageURL)
 	htmlStream, err := fetchHTML(pageURL)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error fetching HTML: %v\n", err), http.StatusBadRequest)
 		return
@@ -69,7 +74,11 @@ func SummaryHandler(w http.ResponseWriter, r *http.Request) {
 	defer htmlStream.Close()
 
 	// Call extractSummary() to extract the page summary meta-data.
+	// Most of the page is downloaded while it is tokenized.
+	_, span = tracing.Start(r.Context(), "extractSummary")
 	pageSummary, err := extractSummary(pageURL, htmlStream)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error extracting summary: %v", err), http.StatusBadRequest)
 		return
@@ -1,15 +1,26 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"github.com/go-redis/redis"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/accesslog"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/announcements"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/health"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/identity"
+	"github.com/info344-a17/challenges-zicodeng/servers/gateway/tracing"
 	"github.com/info344-a17/challenges-zicodeng/servers/summary/handlers"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout is how long in-flight requests
+// have to complete once the server is shutting down.
+const shutdownTimeout = time.Second * 30
+
 func main() {
 	addr := os.Getenv("ADDR")
 	if len(addr) == 0 {
@@ -26,26 +37,99 @@ func main() {
 		Addr: redisAddr,
 	})
 
-	go publishService(addr, redisClient)
+	// The gateway only registers announcements signed with the registration key.
+	registrationKey := os.Getenv("REGISTRATIONKEY")
+	if len(registrationKey) == 0 {
+		log.Fatal("Please set REGISTRATIONKEY environment variable")
+	}
+
+	// The gateway signs the identity of every request it forwards with the identity key.
+	identityKey := os.Getenv("IDENTITYKEY")
+	if len(identityKey) == 0 {
+		log.Fatal("Please set IDENTITYKEY environment variable")
+	}
+
+	// Closing stop makes publishService announce that this instance is leaving.
+	stop := make(chan struct{})
+	left := make(chan struct{})
+	go func() {
+		publishService(addr, redisClient, registrationKey, stop)
+		close(left)
+	}()
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/v1/summary", handlers.SummaryHandler)
+	// Only serve requests that came through the gateway.
+	mux.Handle("/v1/summary", identity.Require(identityKey, http.HandlerFunc(handlers.SummaryHandler)))
+
+	// Trace requests as part of the gateway's traces, if a span exporter is set.
+	var handler http.Handler = mux
+	if spec := os.Getenv("TRACEEXPORTER"); len(spec) != 0 {
+		exporter, err := tracing.NewExporter(spec)
+		if err != nil {
+			log.Fatalf("error creating span exporter: %v", err)
+		}
+		handler = tracing.NewHandler(mux, tracing.NewTracer("summary", exporter))
+	}
+
+	// Probes are answered before the access log, so that they don't flood it.
+	// The summary service needs Redis to announce itself to the gateway.
+	rootMux := http.NewServeMux()
+	rootMux.HandleFunc(health.LivenessPath, health.LivenessHandler)
+	rootMux.Handle(health.ReadinessPath, health.NewReadinessHandler(map[string]health.Check{
+		"redis": func(ctx context.Context) error {
+			return redisClient.WithContext(ctx).Ping().Err()
+		},
+	}, health.DefaultTimeout))
+	// Log every request with the request ID the gateway gave it,
+	// so that it can be matched with the gateway's log.
+	rootMux.Handle("/", accesslog.NewHandler(handler, accesslog.NewLogger(os.Stdout)))
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: rootMux,
+	}
+
+	// On SIGINT or SIGTERM, tell the gateway this instance is leaving,
+	// so that it stops sending requests here,
+	// then let the requests already in flight complete.
+	idle := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		log.Printf("Received %v, shutting down", sig)
+		close(stop)
+		<-left
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down server: %v", err)
+		}
+		close(idle)
+	}()
 
 	log.Printf("Server is listening at http://%s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+	log.Println("Server stopped")
 }
 
 // summaryService contains information about this microservice.
 type summaryService struct {
+	Type        string `json:",omitempty"`
 	Name        string
 	PathPattern string
 	Address     string
 	Heartbeat   int
 }
 
-// publishes information about this microservice to Redis Pub/Sub.
-func publishService(addr string, redisClient *redis.Client) {
+// publishes information about this microservice to Redis Pub/Sub,
+// until stop is closed. Then it announces that this instance is leaving.
+func publishService(addr string, redisClient *redis.Client, registrationKey string, stop <-chan struct{}) {
 	sumSvc := &summaryService{
 		Name:        "summary",
 		PathPattern: "/v1/summary",
@@ -53,12 +137,28 @@ func publishService(addr string, redisClient *redis.Client) {
 		Heartbeat:   10,
 	}
 
-	j, err := json.Marshal(sumSvc)
-	if nil != err {
-		log.Printf("error marshalling struct to JSON: %v\n", err)
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			announce(sumSvc, redisClient, registrationKey)
+		case <-stop:
+			announce(&summaryService{Type: "leaving", Name: sumSvc.Name, Address: sumSvc.Address}, redisClient, registrationKey)
+			return
+		}
 	}
+}
 
-	for _ = range time.Tick(time.Second * 10) {
-		redisClient.Publish("microservices", j)
+// announce signs an announcement and publishes it to Redis Pub/Sub.
+// Every announcement is signed anew, since the gateway rejects old ones.
+func announce(svc *summaryService, redisClient *redis.Client, registrationKey string) {
+	j, err := announcements.Sign(svc, registrationKey)
+	if nil != err {
+		log.Printf("error signing announcement: %v\n", err)
+		return
+	}
+	if err := redisClient.Publish("microservices", j).Err(); err != nil {
+		log.Printf("error publishing announcement: %v\n", err)
 	}
 }
@@ -4,6 +4,10 @@ set -e
 
 export ADDR=info-344-summary:80
 export REDISADDR=redis-server:6379
+# Must match the gateway's, which only registers announcements signed with it.
+export REGISTRATIONKEY=secretregistrationkey
+# Must match the gateway's, which signs the identity of every request with it.
+export IDENTITYKEY=secretidentitykey
 
 export SUMMARY_CONTAINER=info-344-summary
 export APP_NETWORK=appnet
@@ -28,6 +32,8 @@ docker run \
 -d \
 -e ADDR=$ADDR \
 -e REDISADDR=$REDISADDR \
+-e REGISTRATIONKEY=$REGISTRATIONKEY \
+-e IDENTITYKEY=$IDENTITYKEY \
 --name $SUMMARY_CONTAINER \
 --network $APP_NETWORK \
 --restart unless-stopped \